@@ -0,0 +1,204 @@
+package main
+
+// admin module provides admin HTTP handlers
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// BackupHandler streams badger backup of our DB, the optional since
+// parameter allows to create incremental backup of entries which were
+// added/modified since given version. The version of the backup, which can be
+// used in next incremental backup, is returned via X-Backup-Version trailer.
+func BackupHandler(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if v := r.FormValue("since"); v != "" {
+		val, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			msg := "unable to parse since parameter"
+			handleError(w, r, msg, badRequest(err))
+			return
+		}
+		since = val
+	}
+	if err := requireBadger("backup"); err != nil {
+		handleError(w, r, "unable to backup DB", err)
+		return
+	}
+	tstamp := time.Now().UTC().Format("20060102-150405")
+	fname := fmt.Sprintf("%s%s%s", backupPrefix, tstamp, backupSuffix)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fname))
+	w.Header().Set("Trailer", "X-Backup-Version")
+	disableWriteTimeout(w, r)
+	w.WriteHeader(http.StatusOK)
+	version, err := DB.Backup(w, since)
+	if err != nil {
+		// we already sent response header, therefore we can only log the error
+		slog.ErrorContext(r.Context(), "unable to backup DB", "error", err)
+		return
+	}
+	w.Header().Set("X-Backup-Version", fmt.Sprintf("%d", version+1))
+}
+
+// helper function to write JSON response
+func writeJSON(w http.ResponseWriter, r *http.Request, rec interface{}) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		msg := "unable to marshal record"
+		handleError(w, r, msg, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// SnapshotsHandler lists all DB snapshots
+func SnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := listSnapshots()
+	if err != nil {
+		msg := "unable to list snapshots"
+		handleError(w, r, msg, err)
+		return
+	}
+	writeJSON(w, r, snapshots)
+}
+
+// CreateSnapshotHandler creates new DB snapshot with given name
+func CreateSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	snap, err := createSnapshot(r.FormValue("name"))
+	if err != nil {
+		msg := "unable to create snapshot"
+		handleError(w, r, msg, err)
+		return
+	}
+	writeJSON(w, r, snap)
+}
+
+// ExportSnapshotHandler streams DB content as of given snapshot in badger
+// backup format
+func ExportSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, err := getSnapshot(name); err != nil {
+		msg := "unable to export snapshot"
+		handleError(w, r, msg, err)
+		return
+	}
+	fname := fmt.Sprintf("%s%s%s", backupPrefix, name, backupSuffix)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fname))
+	disableWriteTimeout(w, r)
+	w.WriteHeader(http.StatusOK)
+	if err := exportSnapshot(w, name); err != nil {
+		slog.ErrorContext(r.Context(), "unable to export snapshot", "name", name, "error", err)
+	}
+}
+
+// DeleteSnapshotHandler deletes given DB snapshot
+func DeleteSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := deleteSnapshot(name); err != nil {
+		msg := "unable to delete snapshot"
+		handleError(w, r, msg, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// RestoreSnapshotHandler restores DB to the state of given snapshot
+func RestoreSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := restoreSnapshot(name); err != nil {
+		msg := "unable to restore snapshot"
+		handleError(w, r, msg, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteRecordHandler deletes key-value pair and its reverse look-up pair
+// from DB, it is used by routers to remove records from shards they do not
+// belong to
+func DeleteRecordHandler(w http.ResponseWriter, r *http.Request) {
+	if forwardToLeader(w, r) {
+		return
+	}
+	rec, err := deleteRecord(r.Context(), mux.Vars(r)["key"])
+	if err != nil {
+		msg := "unable to delete key value"
+		handleError(w, r, msg, err)
+		return
+	}
+	writeJSON(w, r, rec)
+}
+
+// ExportHandler streams DB records in JSON, NDJSON or CSV format, the
+// records can be filtered by key prefix and/or namespace and exported
+// as of given snapshot
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	prefix, err := keyPrefix(r.FormValue("prefix"), r.FormValue("namespace"))
+	if err != nil {
+		msg := "unable to export records"
+		handleError(w, r, msg, badRequest(err))
+		return
+	}
+	if _, err := newRecordWriter(ioutil.Discard, format); err != nil {
+		msg := "unable to export records"
+		handleError(w, r, msg, badRequest(err))
+		return
+	}
+	if snapshot := r.FormValue("snapshot"); snapshot != "" {
+		if _, err := getSnapshot(snapshot); err != nil {
+			msg := "unable to export records"
+			handleError(w, r, msg, err)
+			return
+		}
+	}
+	if isRouter() {
+		handleError(w, r, "unable to export records", errRouterList)
+		return
+	}
+	w.Header().Set("Content-Type", formatContentType(format))
+	disableWriteTimeout(w, r)
+	w.WriteHeader(http.StatusOK)
+	_, err = exportRecords(w, format, prefix, r.FormValue("snapshot"))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "unable to export records", "error", err)
+	}
+}
+
+// GCHandler runs badger value log GC and optionally flattens LSM tree
+func GCHandler(w http.ResponseWriter, r *http.Request) {
+	ratio := Config.GCDiscardRatio
+	if v := r.FormValue("ratio"); v != "" {
+		val, err := strconv.ParseFloat(v, 64)
+		if err == nil && (val <= 0 || val >= 1) {
+			err = fmt.Errorf("discard ratio %v should be in (0, 1) range", val)
+		}
+		if err != nil {
+			msg := "invalid discard ratio"
+			handleError(w, r, msg, badRequest(err))
+			return
+		}
+		ratio = val
+	}
+	flatten := r.FormValue("flatten") == "true"
+	result, err := runGC(ratio, flatten)
+	if err != nil {
+		msg := "unable to run GC"
+		handleError(w, r, msg, err)
+		return
+	}
+	writeJSON(w, r, result)
+}
@@ -0,0 +1,107 @@
+package main
+
+// auth module provides token based authentication of our server
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// authTokens represents list of tokens allowed to access our server
+var authTokens []string
+
+// errUnauthorized is returned when client does not provide valid credentials
+var errUnauthorized = newError(UnauthorizedCode, errors.New("missing or invalid credentials"))
+
+// helper function to read authentication tokens from given file, the file
+// contains one token per line, empty lines and comments are ignored
+func readAuthTokens(fname string) ([]string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var tokens []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		token := strings.TrimSpace(scanner.Text())
+		if token == "" || strings.HasPrefix(token, "#") {
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, scanner.Err()
+}
+
+// initialize authentication tokens
+func initAuth() error {
+	if Config.AuthTokenFile == "" {
+		return nil
+	}
+	tokens, err := readAuthTokens(Config.AuthTokenFile)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return errors.New("no authentication tokens found in " + Config.AuthTokenFile)
+	}
+	authTokens = tokens
+	log.Printf("loaded %d authentication tokens", len(tokens))
+	return nil
+}
+
+// helper function to check if given token is valid
+func validToken(token string) bool {
+	valid := false
+	for _, t := range authTokens {
+		// we compare all tokens to not leak which one matched via timing
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// helper function to check if HTTP request is authenticated, we accept
+// either verified client certificate or bearer token
+func authenticated(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	return ok && validToken(strings.TrimSpace(token))
+}
+
+// helper function to check if admin end-points can be accessed, i.e. the
+// server has authentication tokens or listeners with client certificates
+func adminAccess() bool {
+	if len(authTokens) > 0 {
+		return true
+	}
+	for _, lc := range listeners() {
+		if lc.ClientCA != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// auth middleware rejects requests without valid credentials
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authenticated(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cmskv"`)
+			handleError(w, r, "unable to authenticate request", errUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
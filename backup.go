@@ -0,0 +1,159 @@
+package main
+
+// backup module provides backup and restore functionality of badger DB
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// badgerBitDelete defines badger meta bit of deleted entries in backups
+const badgerBitDelete byte = 1 << 0
+
+// prefix and suffix of backup files produced by backup scheduler
+const (
+	backupPrefix = "cmskv-"
+	backupSuffix = ".bak"
+)
+
+// helper function to restore DB from given backup reader
+func restoreDB(r io.Reader) error {
+	if err := requireBadger("restore"); err != nil {
+		return err
+	}
+	return DB.Load(r, 256)
+}
+
+// helper function to load badger backup into DB, only the keys accepted by
+// given function are loaded
+func loadBackup(r io.Reader, keep func(key []byte) bool) error {
+	if err := requireBadger("restore"); err != nil {
+		return err
+	}
+	wb := DB.NewWriteBatch()
+	defer wb.Cancel()
+	sr := &snapshotReader{r: bufio.NewReader(r), expired: true}
+	now := uint64(time.Now().Unix())
+	var last []byte
+	for {
+		kv, err := sr.next()
+		if err != nil {
+			return err
+		}
+		if kv == nil {
+			break
+		}
+		// versions of the key follow its latest version
+		if last != nil && bytes.Equal(kv.Key, last) {
+			continue
+		}
+		last = kv.Key
+		if len(kv.Meta) > 0 && kv.Meta[0]&badgerBitDelete != 0 || !keep(kv.Key) {
+			continue
+		}
+		if kv.ExpiresAt > 0 && kv.ExpiresAt <= now {
+			continue
+		}
+		e := badger.NewEntry(kv.Key, kv.Value)
+		e.ExpiresAt = kv.ExpiresAt
+		if len(kv.UserMeta) > 0 {
+			e.UserMeta = kv.UserMeta[0]
+		}
+		if err := wb.SetEntry(e); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// helper function to write full DB backup into given file, the backup is
+// written into temporary file first and then renamed to avoid partial backups
+func backupFile(fname string, since uint64) (uint64, error) {
+	if err := requireBadger("backup"); err != nil {
+		return 0, err
+	}
+	tmp := fname + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	version, err := DB.Backup(file, since)
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return version, os.Rename(tmp, fname)
+}
+
+// helper function to remove old backup files and keep only given number of
+// recent ones
+func pruneBackups(dir string, retention int) {
+	files, err := filepath.Glob(filepath.Join(dir, backupPrefix+"*"+backupSuffix))
+	if err != nil {
+		slog.Error("unable to list backup files", "error", err)
+		return
+	}
+	if len(files) <= retention {
+		return
+	}
+	// backup file names contain time stamps, therefore sorted names are
+	// sorted by time as well
+	sort.Strings(files)
+	for _, fname := range files[:len(files)-retention] {
+		if err := os.Remove(fname); err != nil {
+			slog.Error("unable to remove backup file", "file", fname, "error", err)
+			continue
+		}
+		log.Println("remove old backup file", fname)
+	}
+}
+
+// helper function to periodically backup DB into given directory until
+// given context is cancelled
+func backupScheduler(ctx context.Context, dir, interval string, retention int) {
+	period, err := time.ParseDuration(interval)
+	if err != nil {
+		slog.Error("unable to parse backup interval", "interval", interval, "error", err)
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		slog.Error("unable to create backup directory", "dir", dir, "error", err)
+		return
+	}
+	log.Printf("backup scheduler dir=%s interval=%s retention=%d", dir, interval, retention)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		tstamp := time.Now().UTC().Format("20060102-150405")
+		fname := filepath.Join(dir, fmt.Sprintf("%s%s%s", backupPrefix, tstamp, backupSuffix))
+		time0 := time.Now()
+		version, err := backupFile(fname, 0)
+		if err != nil {
+			slog.Error("unable to backup DB", "error", err)
+			continue
+		}
+		log.Printf("backup %s version=%d time=%v", fname, version, time.Since(time0))
+		pruneBackups(dir, retention)
+	}
+}
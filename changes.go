@@ -0,0 +1,536 @@
+package main
+
+// changes module provides change stream of our DB based on badger
+// subscriptions, it is used by read-only replicas to follow the primary
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	bpb "github.com/dgraph-io/badger/v3/pb"
+)
+
+// changesHeartbeat defines interval between heartbeat events of change stream
+const changesHeartbeat = time.Second
+
+// changesQueueSize defines number of change batches buffered for a stream,
+// slow consumers are disconnected when the queue is full to not block writes
+const changesQueueSize = 10000
+
+// changesMarkerPrefix defines prefix of marker keys which are used to wait
+// for subscription of a stream
+const changesMarkerPrefix = systemPrefix + "changes/"
+
+// changesDeletedPrefix defines prefix of marker keys of deleted keys, badger
+// compaction discards tombstones of deleted keys, therefore the markers keep
+// deletes visible to change stream catch-up until they are pruned
+const changesDeletedPrefix = systemPrefix + "deleted/"
+
+// changesHorizonKey holds the latest DB version of pruned delete markers,
+// the changes since this or older version can not be streamed anymore
+const changesHorizonKey = systemPrefix + "horizon"
+
+// changesPruneInterval defines how often expired delete markers are pruned
+const changesPruneInterval = time.Hour
+
+// badgerInternalPrefix defines prefix of badger internal keys, e.g. transaction
+// markers, which are delivered by subscriptions
+const badgerInternalPrefix = "!badger!"
+
+// errSlowConsumer is returned when consumer of change stream is not able to
+// keep up with changes
+var errSlowConsumer = errors.New("change stream consumer is too slow")
+
+// errHistoryGone is returned when change stream is requested since version
+// which is older than retained history of deletes
+var errHistoryGone = errors.New("change history is no longer retained")
+
+// ChangeEvent represents change of a key in DB, the heartbeat events have no
+// key and report stream position, i.e. all changes up to their version were
+// delivered
+type ChangeEvent struct {
+	Key       []byte `json:"key,omitempty"`       // changed key
+	Value     []byte `json:"value,omitempty"`     // new value of the key
+	Version   uint64 `json:"version"`             // DB version of the change or stream position
+	ExpiresAt uint64 `json:"expiresAt,omitempty"` // expiration time of the key in seconds since epoch
+	Deleted   bool   `json:"deleted,omitempty"`   // key is deleted or expired
+	Time      int64  `json:"time,omitempty"`      // time of heartbeat in nanoseconds since epoch
+}
+
+// helper function to check if event is a heartbeat
+func (e ChangeEvent) heartbeat() bool {
+	return len(e.Key) == 0
+}
+
+// helper function to remove duplicate and nested prefixes, e.g. users:
+// prefix covers users:a prefix, no prefixes means all keys
+func normalizePrefixes(prefixes []string) []string {
+	sort.Strings(prefixes)
+	var out []string
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			return []string{""}
+		}
+		if len(out) > 0 && strings.HasPrefix(prefix, out[len(out)-1]) {
+			continue
+		}
+		out = append(out, prefix)
+	}
+	if len(out) == 0 {
+		return []string{""}
+	}
+	return out
+}
+
+// helper function to return marker key of given deleted key
+func deletedMarker(key []byte) []byte {
+	return append([]byte(changesDeletedPrefix), key...)
+}
+
+// helper function to return value of delete marker, i.e. time of delete
+func deletedMarkerValue() []byte {
+	return []byte(strconv.FormatInt(time.Now().Unix(), 10))
+}
+
+// helper function to read history horizon, i.e. the latest version of
+// pruned delete markers
+func historyHorizon() (uint64, error) {
+	val, err := KV.Get([]byte(changesHorizonKey))
+	if errors.Is(err, errKeyNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(val), 10, 64)
+}
+
+// helper function to check that changes since given version are retained,
+// the deletes made since older versions may be already pruned
+func checkHistory(since uint64) error {
+	if since == 0 || DB == nil {
+		return nil
+	}
+	horizon, err := historyHorizon()
+	if err != nil {
+		return err
+	}
+	if since <= horizon {
+		err := fmt.Errorf("%w, changes since version %d are pruned up to version %d", errHistoryGone, since, horizon)
+		return newError(HistoryGoneCode, err)
+	}
+	return nil
+}
+
+// helper function to remove delete markers older than given retention, the
+// history horizon is advanced before the markers are removed
+func pruneDeleted(retention time.Duration) (int, error) {
+	cutoff := time.Now().Add(-retention).Unix()
+	var horizon uint64
+	var entries []KVEntry
+	err := DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(changesDeletedPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			// malformed markers are pruned as well
+			if tstamp, err := strconv.ParseInt(string(val), 10, 64); err == nil && tstamp > cutoff {
+				continue
+			}
+			horizon = max(horizon, item.Version())
+			entries = append(entries, KVEntry{Key: item.KeyCopy(nil), Delete: true})
+		}
+		return nil
+	})
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+	current, err := historyHorizon()
+	if err != nil {
+		return 0, err
+	}
+	if horizon > current {
+		err := KV.Set([]byte(changesHorizonKey), []byte(strconv.FormatUint(horizon, 10)), 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+	for i := 0; i < len(entries); i += importBatchSize {
+		if err := KV.Batch(entries[i:min(i+importBatchSize, len(entries))]); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+// helper function to periodically prune delete markers older than given
+// retention
+func deletedPruner(ctx context.Context, retention string) {
+	period, err := time.ParseDuration(retention)
+	if err != nil {
+		slog.Error("unable to parse changes retention", "retention", retention, "error", err)
+		return
+	}
+	ticker := time.NewTicker(changesPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		count, err := pruneDeleted(period)
+		if err != nil {
+			slog.Error("unable to prune delete markers", "error", err)
+		} else if count > 0 {
+			log.Printf("pruned %d delete markers older than %s", count, retention)
+		}
+	}
+}
+
+// helper function to check if key is deleted or expired as of given version,
+// badger subscriptions do not distinguish deleted keys from empty values
+func deletedAt(key []byte, version uint64) (bool, error) {
+	deleted := true
+	err := DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.AllVersions = true
+		opts.PrefetchValues = false
+		opts.Prefix = key
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(key); it.ValidForPrefix(key); it.Next() {
+			item := it.Item()
+			if !bytes.Equal(item.Key(), key) {
+				break
+			}
+			if item.Version() == version {
+				deleted = item.IsDeletedOrExpired()
+				break
+			}
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// helper function to convert badger subscription record into change event
+func changeEvent(kv *bpb.KV) (ChangeEvent, error) {
+	ev := ChangeEvent{Key: kv.Key, Value: kv.Value, Version: kv.Version, ExpiresAt: kv.ExpiresAt}
+	if ev.ExpiresAt > 0 && ev.ExpiresAt <= uint64(time.Now().Unix()) {
+		ev.Deleted = true
+	} else if len(ev.Value) == 0 {
+		deleted, err := deletedAt(ev.Key, ev.Version)
+		if err != nil {
+			return ev, err
+		}
+		ev.Deleted = deleted
+	}
+	if ev.Deleted {
+		ev.Value = nil
+		ev.ExpiresAt = 0
+	}
+	return ev, nil
+}
+
+// helper function to send changes of keys with given prefixes made since
+// given version, it returns read timestamp of the catch-up
+func catchUp(prefixes []string, since uint64, fn func(events []ChangeEvent) error) (uint64, error) {
+	var readTs uint64
+	err := DB.View(func(txn *badger.Txn) error {
+		readTs = txn.ReadTs()
+		if since > readTs {
+			// nothing has changed since given version
+			return nil
+		}
+		var events []ChangeEvent
+		for _, prefix := range prefixes {
+			opts := badger.DefaultIteratorOptions
+			opts.AllVersions = true
+			opts.Prefix = []byte(prefix)
+			it := txn.NewIterator(opts)
+			var last []byte
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				// items of the same key are ordered from latest version
+				if last != nil && bytes.Equal(item.Key(), last) {
+					continue
+				}
+				last = item.KeyCopy(last)
+				if isSystemKey(string(last)) || item.Version() < since {
+					continue
+				}
+				ev := ChangeEvent{Key: item.KeyCopy(nil), Version: item.Version(), ExpiresAt: item.ExpiresAt()}
+				if item.IsDeletedOrExpired() {
+					if since == 0 {
+						continue
+					}
+					ev.Deleted = true
+					ev.ExpiresAt = 0
+				} else {
+					val, err := item.ValueCopy(nil)
+					if err != nil {
+						it.Close()
+						return err
+					}
+					ev.Value = val
+				}
+				events = append(events, ev)
+				if len(events) >= 1000 {
+					if err := fn(events); err != nil {
+						it.Close()
+						return err
+					}
+					events = nil
+				}
+			}
+			it.Close()
+		}
+
+		// tombstones of deleted keys may be discarded by compaction,
+		// therefore deletes are also sent from delete markers (i.e. delete
+		// may be sent twice), the keys which were set again after delete
+		// are already sent above
+		for _, prefix := range prefixes {
+			if since == 0 {
+				break
+			}
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			opts.Prefix = []byte(changesDeletedPrefix + prefix)
+			it := txn.NewIterator(opts)
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				if item.Version() < since {
+					continue
+				}
+				key := item.KeyCopy(nil)[len(changesDeletedPrefix):]
+				cur, err := txn.Get(key)
+				if err == nil && cur.Version() > item.Version() {
+					continue
+				} else if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+					it.Close()
+					return err
+				}
+				events = append(events, ChangeEvent{Key: key, Version: item.Version(), Deleted: true})
+				if len(events) >= 1000 {
+					if err := fn(events); err != nil {
+						it.Close()
+						return err
+					}
+					events = nil
+				}
+			}
+			it.Close()
+		}
+		if len(events) > 0 {
+			return fn(events)
+		}
+		return nil
+	})
+	return readTs, err
+}
+
+// helper function to stream changes of keys with given prefixes since given
+// version, the stream starts with catch-up of changes made since given
+// version (or all keys if version is zero) followed by live changes and
+// periodic heartbeats, it runs until given context is cancelled
+func streamChanges(ctx context.Context, prefixes []string, since uint64, fn func(events []ChangeEvent) error) error {
+	if err := requireBadger("change stream"); err != nil {
+		return err
+	}
+	if err := checkHistory(since); err != nil {
+		return err
+	}
+	prefixes = normalizePrefixes(prefixes)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// subscribe to changes before catch-up to not miss any of them, badger
+	// registers subscriber asynchronously, therefore we write marker key
+	// until it is delivered to our subscriber
+	queue := make(chan *bpb.KVList, changesQueueSize)
+	subErr := make(chan error, 1)
+	var pending []*bpb.KV
+	if !Config.ReadOnly {
+		marker := []byte(changesMarkerPrefix + newRequestID())
+		matches := [][]byte{marker}
+		for _, prefix := range prefixes {
+			matches = append(matches, []byte(prefix))
+		}
+		go func() {
+			subErr <- DB.Subscribe(ctx, func(list *bpb.KVList) error {
+				select {
+				case queue <- list:
+					return nil
+				default:
+					return errSlowConsumer
+				}
+			}, matches...)
+		}()
+		var err error
+		pending, err = waitMarker(ctx, marker, queue, subErr)
+		if err != nil {
+			return err
+		}
+	}
+
+	readTs, err := catchUp(prefixes, since, fn)
+	if err != nil {
+		return err
+	}
+	pos := readTs
+	heartbeat := func() error {
+		return fn([]ChangeEvent{{Version: pos, Time: time.Now().UnixNano()}})
+	}
+	if err := heartbeat(); err != nil {
+		return err
+	}
+	send := func(kvs []*bpb.KV) error {
+		var events []ChangeEvent
+		for _, kv := range kvs {
+			// changes visible to catch-up were already sent, the changes
+			// of single transaction share the same version
+			if kv.Version <= readTs {
+				continue
+			}
+			pos = kv.Version
+			key := string(kv.Key)
+			if isSystemKey(key) || strings.HasPrefix(key, badgerInternalPrefix) {
+				continue
+			}
+			ev, err := changeEvent(kv)
+			if err != nil {
+				return err
+			}
+			events = append(events, ev)
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		return fn(events)
+	}
+	if err := send(pending); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(changesHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-subErr:
+			if err == nil {
+				err = errStoreClosed
+			}
+			return err
+		case list := <-queue:
+			if err := send(list.Kv); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := heartbeat(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// helper function to write marker key until it is delivered by subscription,
+// the changes received before the marker are returned
+func waitMarker(ctx context.Context, marker []byte, queue chan *bpb.KVList, subErr chan error) ([]*bpb.KV, error) {
+	defer DB.Update(func(txn *badger.Txn) error {
+		return txn.Delete(marker)
+	})
+	var pending []*bpb.KV
+	for i := 0; i < 50; i++ {
+		err := DB.Update(func(txn *badger.Txn) error {
+			return txn.Set(marker, nil)
+		})
+		if err != nil {
+			return nil, err
+		}
+		timeout := time.After(100 * time.Millisecond)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case err := <-subErr:
+				return nil, fmt.Errorf("unable to subscribe to changes: %w", err)
+			case list := <-queue:
+				for _, kv := range list.Kv {
+					if bytes.Equal(kv.Key, marker) {
+						return pending, nil
+					}
+					pending = append(pending, kv)
+				}
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+	return nil, errors.New("unable to subscribe to changes")
+}
+
+// ChangesHandler streams changes of DB keys in NDJSON format, the optional
+// prefix parameters limit the stream to given key prefixes and since
+// parameter defines version to start from
+func ChangesHandler(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if v := r.FormValue("since"); v != "" {
+		val, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			msg := "unable to parse since parameter"
+			handleError(w, r, msg, badRequest(err))
+			return
+		}
+		since = val
+	}
+	if err := requireBadger("change stream"); err != nil {
+		handleError(w, r, "unable to stream changes", err)
+		return
+	}
+	if err := checkHistory(since); err != nil {
+		handleError(w, r, "unable to stream changes", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	disableWriteTimeout(w, r)
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	ctx, cancel := streamContext(r.Context())
+	defer cancel()
+	err := streamChanges(ctx, r.Form["prefix"], since, func(events []ChangeEvent) error {
+		for _, ev := range events {
+			if err := enc.Encode(ev); err != nil {
+				return err
+			}
+		}
+		return rc.Flush()
+	})
+	if err != nil && ctx.Err() == nil {
+		// we already sent response header, therefore we can only log the error
+		slog.ErrorContext(r.Context(), "change stream is terminated", "error", err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+// changes_test module provides tests of change stream catch-up and history
+// of deleted keys
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helper function to open badger DB in temporary directory as our DB, the
+// previous DB is restored at the end of the test
+func setupBadger(t *testing.T) {
+	t.Helper()
+	db, kv := DB, KV
+	var err error
+	DB, err = openDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	KV = badgerStore{db: DB}
+	t.Cleanup(func() {
+		KV.Close()
+		DB, KV = db, kv
+	})
+}
+
+// helper function to collect catch-up events of all keys since given version
+func catchUpEvents(t *testing.T, since uint64) (map[string]ChangeEvent, uint64) {
+	t.Helper()
+	events := make(map[string]ChangeEvent)
+	readTs, err := catchUp([]string{""}, since, func(evs []ChangeEvent) error {
+		for _, ev := range evs {
+			// deletes may be sent twice, from tombstone and delete marker
+			if prev, ok := events[string(ev.Key)]; ok && prev.Deleted != ev.Deleted {
+				t.Errorf("conflicting events of key %s", ev.Key)
+			}
+			events[string(ev.Key)] = ev
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events, readTs
+}
+
+// TestCatchUpDeletes checks that catch-up reports deletes via delete markers
+// and does not report deletes of keys which were set again
+func TestCatchUpDeletes(t *testing.T) {
+	setupBadger(t)
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if err := KV.Set([]byte(key), []byte("v"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, readTs := catchUpEvents(t, 0)
+	since := readTs + 1
+	if err := KV.Delete([]byte("k1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := KV.Batch([]KVEntry{{Key: []byte("k2"), Delete: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := KV.Set([]byte("k2"), []byte("v2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	events, _ := catchUpEvents(t, since)
+	if ev, ok := events["k1"]; !ok || !ev.Deleted {
+		t.Errorf("expect delete event of k1, got %+v", ev)
+	}
+	if ev, ok := events["k2"]; !ok || ev.Deleted || string(ev.Value) != "v2" {
+		t.Errorf("expect set event of k2, got %+v", ev)
+	}
+	if ev, ok := events["k3"]; ok {
+		t.Errorf("expect no event of unchanged k3, got %+v", ev)
+	}
+	for key := range events {
+		if isSystemKey(key) {
+			t.Errorf("unexpected event of system key %s", key)
+		}
+	}
+}
+
+// TestPruneDeleted checks that pruning of delete markers advances history
+// horizon and change stream rejects versions older than the horizon
+func TestPruneDeleted(t *testing.T) {
+	setupBadger(t)
+	if err := KV.Set([]byte("k1"), []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkHistory(1); err != nil {
+		t.Fatalf("expect retained history before pruning, got %v", err)
+	}
+	if err := KV.Delete([]byte("k1")); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := pruneDeleted(0); err != nil || count != 1 {
+		t.Fatalf("expect one pruned marker, got %d %v", count, err)
+	}
+	if count, err := pruneDeleted(0); err != nil || count != 0 {
+		t.Fatalf("expect no markers after pruning, got %d %v", count, err)
+	}
+	horizon, err := historyHorizon()
+	if err != nil || horizon == 0 {
+		t.Fatalf("expect history horizon after pruning, got %d %v", horizon, err)
+	}
+	if err := checkHistory(horizon); !errors.Is(err, errHistoryGone) {
+		t.Fatalf("expect errHistoryGone since horizon, got %v", err)
+	}
+	if err := checkHistory(horizon + 1); err != nil {
+		t.Fatalf("expect retained history after horizon, got %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/admin/changes?since="+strconv.FormatUint(horizon, 10), nil)
+	w := httptest.NewRecorder()
+	ChangesHandler(w, r)
+	if w.Code != http.StatusGone {
+		t.Fatalf("expect %d status of pruned history, got %d %s", http.StatusGone, w.Code, w.Body.String())
+	}
+}
+
+// TestWatchReset checks that watch stream since pruned history starts with
+// reset event followed by all existing keys
+func TestWatchReset(t *testing.T) {
+	setupBadger(t)
+	for _, key := range []string{"k0", "k1"} {
+		if err := KV.Set([]byte(key), []byte("v"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := KV.Delete([]byte("k0")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pruneDeleted(0); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest("GET", "/watch?since=1", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	WatchHandler(w, r)
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "event: reset\n") {
+		t.Fatalf("expect reset event, got %s", body)
+	}
+	if !strings.Contains(body, `"key":"k1","value":"v","op":"set"`) || strings.Contains(body, `"key":"k0"`) {
+		t.Fatalf("expect existing keys after reset, got %s", body)
+	}
+}
@@ -0,0 +1,1027 @@
+package main
+
+// cluster module provides clustered mode of our server, the writes are
+// replicated across cluster nodes via raft consensus and followers forward
+// write requests to the cluster leader
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// read consistency levels of clustered mode
+const (
+	consistencyLinearizable = "linearizable"
+	consistencyStale        = "stale"
+)
+
+// clusterPrefix defines prefix of system keys which are replicated across
+// cluster nodes, other system keys are local to the node
+const clusterPrefix = systemPrefix + "cluster/"
+
+// clusterNodePrefix defines prefix of keys which hold HTTP URLs of cluster nodes
+const clusterNodePrefix = clusterPrefix + "nodes/"
+
+// clusterForwardHeader marks requests forwarded to the leader, the leader
+// never forwards such requests again to avoid forwarding loops
+const clusterForwardHeader = "X-Cmskv-Forwarded-By"
+
+// commands of raft log
+const (
+	clusterStore      = "store"       // store records and their reverse look-up records
+	clusterSet        = "set"         // set records without reverse look-up records
+	clusterDelete     = "delete"      // delete record and its reverse look-up record
+	clusterAddNode    = "add_node"    // register HTTP URL of cluster node
+	clusterRemoveNode = "remove_node" // remove HTTP URL of cluster node
+)
+
+// ClusterConfig represents configuration of clustered mode
+type ClusterConfig struct {
+	NodeID          string   `json:"node_id"`          // unique id of the node, enables clustered mode
+	RaftAddress     string   `json:"raft_address"`     // advertisable address of raft transport, e.g. node1:9220
+	URL             string   `json:"url"`              // HTTP URL of the node, default http://<hostname>:<port>
+	Dir             string   `json:"dir"`              // directory of raft log and snapshots, default <db>.raft
+	Bootstrap       bool     `json:"bootstrap"`        // bootstrap new cluster with this node
+	Join            []string `json:"join"`             // URLs of cluster nodes to join on first start
+	TokenFile       string   `json:"token_file"`       // file with bearer token of membership requests, required
+	CACert          string   `json:"ca_cert"`          // CA file to verify certificates of cluster nodes
+	ApplyTimeout    string   `json:"apply_timeout"`    // max time to commit write, default 10s
+	ReadConsistency string   `json:"read_consistency"` // default read consistency: linearizable (default) or stale
+}
+
+// ClusterNode represents member of the cluster
+type ClusterNode struct {
+	ID       string `json:"id"`                 // node id
+	Address  string `json:"address"`            // raft address of the node
+	URL      string `json:"url,omitempty"`      // HTTP URL of the node
+	Suffrage string `json:"suffrage,omitempty"` // voter or nonvoter
+	Leader   bool   `json:"leader,omitempty"`   // node is cluster leader
+}
+
+// ClusterStatus represents status of the cluster as seen by the node
+type ClusterStatus struct {
+	Node         string        `json:"node"`         // id of the node
+	State        string        `json:"state"`        // raft state of the node
+	Leader       string        `json:"leader"`       // id of cluster leader
+	Term         uint64        `json:"term"`         // current raft term
+	LastIndex    uint64        `json:"lastIndex"`    // last index of raft log
+	CommitIndex  uint64        `json:"commitIndex"`  // last committed index of raft log
+	AppliedIndex uint64        `json:"appliedIndex"` // last index applied to DB
+	Nodes        []ClusterNode `json:"nodes"`        // cluster members
+}
+
+// clusterCommand represents entry of raft log
+type clusterCommand struct {
+	Op        string       `json:"op"`                  // command
+	Records   []Record     `json:"records,omitempty"`   // records to store or set
+	Key       string       `json:"key,omitempty"`       // key of record or id of node to remove
+	ExpiresAt int64        `json:"expiresAt,omitempty"` // expiration time of set records in nanoseconds since epoch
+	Node      *ClusterNode `json:"node,omitempty"`      // node to register
+}
+
+// clusterResult represents result of applied raft log entry
+type clusterResult struct {
+	Record Record
+	Err    error
+}
+
+// clusterRecord represents record of raft snapshot
+type clusterRecord struct {
+	Key       []byte `json:"key"`
+	Value     []byte `json:"value"`
+	ExpiresAt uint64 `json:"expiresAt,omitempty"`
+}
+
+// cluster state of the node
+var (
+	clusterRaft         *raft.Raft
+	clusterLog          *raftLogStore
+	clusterClient       *http.Client
+	clusterToken        string
+	clusterApplyTimeout time.Duration
+)
+
+// errNoLeader is returned when cluster has no leader, e.g. during election
+var errNoLeader = errors.New("cluster has no leader")
+
+// helper function to check if server runs in clustered mode
+func isClustered() bool {
+	return Config.Cluster.NodeID != ""
+}
+
+// helper function to return error of features which are not available
+// in clustered mode since they modify DB outside of raft log
+func requireStandalone(feature string) error {
+	if isClustered() {
+		return newError(UnavailableCode, fmt.Errorf("%s is not supported in clustered mode", feature))
+	}
+	return nil
+}
+
+// helper function to check if key is replicated across cluster nodes
+func clusterReplicated(key string) bool {
+	return !isSystemKey(key) || strings.HasPrefix(key, clusterPrefix)
+}
+
+// helper function to create error returned when write or linearizable read
+// is requested from node which is not cluster leader
+func notLeaderError() error {
+	leader := "unknown"
+	if _, id := clusterRaft.LeaderWithID(); id != "" {
+		leader = string(id)
+	}
+	return newError(UnavailableCode, fmt.Errorf("%w, leader is %s", raft.ErrNotLeader, leader))
+}
+
+// helper function to check if command modifies records, such commands are
+// forwarded by followers to cluster leader
+func clusterDataCommand(op string) bool {
+	return op == clusterStore || op == clusterSet || op == clusterDelete
+}
+
+// helper function to commit given command via raft log, the command is
+// applied to DB of every cluster node and its result is returned. The
+// followers forward commands which modify records to cluster leader, i.e.
+// gRPC and RESP writes can be sent to any node.
+func clusterApply(ctx context.Context, cmd clusterCommand) (Record, error) {
+	if clusterDataCommand(cmd.Op) && clusterRaft.State() != raft.Leader {
+		var rec Record
+		err := leaderRequest(ctx, "POST", "/admin/cluster/apply", cmd, &rec)
+		return rec, err
+	}
+	return raftApply(ctx, cmd)
+}
+
+// helper function to commit given command via raft log of this node
+func raftApply(ctx context.Context, cmd clusterCommand) (Record, error) {
+	_, span := tracer.Start(ctx, "raft.apply")
+	defer span.End()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return Record{}, err
+	}
+	future := clusterRaft.Apply(data, clusterApplyTimeout)
+	if err := future.Error(); err != nil {
+		spanError(span, err)
+		switch {
+		case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrLeadershipLost):
+			return Record{}, notLeaderError()
+		case errors.Is(err, raft.ErrEnqueueTimeout), errors.Is(err, raft.ErrRaftShutdown):
+			return Record{}, newError(UnavailableCode, err)
+		}
+		return Record{}, err
+	}
+	res, ok := future.Response().(clusterResult)
+	if !ok {
+		return Record{}, fmt.Errorf("unexpected raft response %T", future.Response())
+	}
+	spanError(span, res.Err)
+	return res.Record, res.Err
+}
+
+// clusterFSM implements raft FSM interface on top of our DB
+type clusterFSM struct{}
+
+// Apply implements raft FSM interface, the log entries may be applied again
+// after restart therefore all commands should be idempotent
+func (clusterFSM) Apply(entry *raft.Log) interface{} {
+	var cmd clusterCommand
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		return clusterResult{Err: err}
+	}
+	ctx := context.Background()
+	var res clusterResult
+	switch cmd.Op {
+	case clusterStore:
+		for _, rec := range cmd.Records {
+			if res.Err = commitRecord(ctx, rec.Key, rec.Value); res.Err != nil {
+				break
+			}
+		}
+	case clusterSet:
+		var ttl time.Duration
+		if cmd.ExpiresAt > 0 {
+			ttl = time.Until(time.Unix(0, cmd.ExpiresAt))
+		}
+		if cmd.ExpiresAt > 0 && ttl <= 0 {
+			// records are already expired, e.g. when log is applied again
+			var entries []KVEntry
+			for _, rec := range cmd.Records {
+				entries = append(entries, KVEntry{Key: []byte(rec.Key), Delete: true})
+			}
+			res.Err = KV.Batch(entries)
+		} else {
+			res.Err = commitRecords(ctx, cmd.Records, ttl)
+		}
+	case clusterDelete:
+		res.Record, res.Err = removeRecord(ctx, cmd.Key)
+	case clusterAddNode:
+		res.Err = KV.Set([]byte(clusterNodePrefix+cmd.Node.ID), []byte(cmd.Node.URL), 0)
+	case clusterRemoveNode:
+		res.Err = KV.Delete([]byte(clusterNodePrefix + cmd.Key))
+	default:
+		res.Err = fmt.Errorf("unknown cluster command %s", cmd.Op)
+	}
+	// client errors, e.g. missing key, are reported to the client only
+	if res.Err != nil && serverError(res.Err).Status() >= http.StatusInternalServerError {
+		slog.Error("unable to apply raft log entry", "index", entry.Index, "op", cmd.Op, "error", res.Err)
+	}
+	return res
+}
+
+// Snapshot implements raft FSM interface, the snapshot holds read
+// transaction which is persisted in background
+func (clusterFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return &clusterSnapshot{txn: DB.NewTransaction(false)}, nil
+}
+
+// Restore implements raft FSM interface, it replaces replicated keys of our
+// DB with the content of given snapshot
+func (clusterFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	time0 := time.Now()
+
+	// remove replicated keys in chunks since iteration does not allow writes
+	var after []byte
+	for {
+		var entries []KVEntry
+		err := KV.Iterate(nil, after, func(key, value []byte) error {
+			after = key
+			if clusterReplicated(string(key)) {
+				entries = append(entries, KVEntry{Key: key, Delete: true})
+			}
+			if len(entries) >= importBatchSize {
+				return errStopIteration
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if err := KV.Batch(entries); err != nil {
+			return err
+		}
+	}
+
+	// load snapshot records
+	var count int
+	var entries []KVEntry
+	dec := json.NewDecoder(bufio.NewReader(rc))
+	for {
+		var rec clusterRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("unable to decode raft snapshot: %w", err)
+		}
+		var ttl time.Duration
+		if rec.ExpiresAt > 0 {
+			ttl = time.Until(time.Unix(int64(rec.ExpiresAt), 0))
+			if ttl <= 0 {
+				continue
+			}
+		}
+		entries = append(entries, KVEntry{Key: rec.Key, Value: rec.Value, TTL: ttl})
+		count++
+		if len(entries) >= importBatchSize {
+			if err := KV.Batch(entries); err != nil {
+				return err
+			}
+			entries = nil
+		}
+	}
+	if len(entries) > 0 {
+		if err := KV.Batch(entries); err != nil {
+			return err
+		}
+	}
+	log.Printf("cluster: restored %d records from raft snapshot in %v", count, time.Since(time0))
+	return nil
+}
+
+// clusterSnapshot implements raft FSMSnapshot interface
+type clusterSnapshot struct {
+	txn *badger.Txn
+}
+
+// Persist implements raft FSMSnapshot interface
+func (s *clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.write(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// helper function to write replicated keys of snapshot transaction
+func (s *clusterSnapshot) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	it := s.txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if !clusterReplicated(string(item.Key())) {
+			continue
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		rec := clusterRecord{Key: item.KeyCopy(nil), Value: val, ExpiresAt: item.ExpiresAt()}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Release implements raft FSMSnapshot interface
+func (s *clusterSnapshot) Release() {
+	s.txn.Discard()
+}
+
+// helper function to start raft node, new cluster is bootstrapped if
+// bootstrap option is set and the node joins existing cluster via one of
+// configured nodes if it has no raft state
+func startCluster(ctx context.Context) error {
+	cc := &Config.Cluster
+	if err := requireBadger("clustered mode"); err != nil {
+		return err
+	}
+	if Config.ReadOnly || isReplica() {
+		return errors.New("clustered mode can not be used in read-only or replica modes")
+	}
+	if cc.RaftAddress == "" {
+		return errors.New("raft address of the node is not provided")
+	}
+	if cc.ReadConsistency != consistencyLinearizable && cc.ReadConsistency != consistencyStale {
+		return fmt.Errorf("unsupported read consistency %s", cc.ReadConsistency)
+	}
+	if cc.URL == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		cc.URL = fmt.Sprintf("http://%s:%d", hostname, Config.Port)
+	}
+	if cc.Dir == "" {
+		cc.Dir = strings.TrimSuffix(Config.BadgerDB, "/") + ".raft"
+	}
+	var err error
+	clusterApplyTimeout, err = time.ParseDuration(cc.ApplyTimeout)
+	if err != nil {
+		return fmt.Errorf("unable to parse apply timeout: %w", err)
+	}
+	clusterClient, err = newHTTPClient(cc.CACert)
+	if err != nil {
+		return err
+	}
+	// membership end-points are authenticated by cluster token only,
+	// therefore we do not start cluster node without it
+	if cc.TokenFile == "" {
+		return errors.New("cluster token file is not provided")
+	}
+	clusterToken, err = readToken(cc.TokenFile)
+	if err != nil {
+		return err
+	}
+	if clusterToken == "" {
+		return fmt.Errorf("no cluster token found in %s", cc.TokenFile)
+	}
+
+	// raft log and snapshots are kept outside of our DB
+	if err := os.MkdirAll(cc.Dir, 0755); err != nil {
+		return err
+	}
+	logger := hclog.New(&hclog.LoggerOptions{Name: "raft", Output: log.Writer(), Level: hclog.Info, DisableTime: true})
+	clusterLog, err = openRaftLog(filepath.Join(cc.Dir, "log"))
+	if err != nil {
+		return fmt.Errorf("unable to open raft log: %w", err)
+	}
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(cc.Dir, 2, logger)
+	if err != nil {
+		return err
+	}
+	addr, err := net.ResolveTCPAddr("tcp", cc.RaftAddress)
+	if err != nil {
+		return err
+	}
+	// raft TCP transport is neither encrypted nor authenticated, the raft
+	// address should be reachable only from private network of the cluster
+	transport, err := raft.NewTCPTransportWithLogger(cc.RaftAddress, addr, 3, 10*time.Second, logger)
+	if err != nil {
+		return err
+	}
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(cc.NodeID)
+	conf.Logger = logger
+	// our DB already holds the state of applied log entries, therefore the
+	// snapshot is not restored on start, it would delete and load again all
+	// replicated keys, and log entries after snapshot are applied again
+	// since the commands are idempotent
+	conf.NoSnapshotRestoreOnStart = true
+	hasState, err := raft.HasExistingState(clusterLog, clusterLog, snapshots)
+	if err != nil {
+		return err
+	}
+	clusterRaft, err = raft.NewRaft(conf, clusterFSM{}, clusterLog, clusterLog, snapshots, transport)
+	if err != nil {
+		return err
+	}
+	log.Printf("cluster: node %s raft=%s url=%s existing state=%v", cc.NodeID, cc.RaftAddress, cc.URL, hasState)
+	if !hasState && cc.Bootstrap {
+		servers := []raft.Server{{Suffrage: raft.Voter, ID: conf.LocalID, Address: transport.LocalAddr()}}
+		if err := clusterRaft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+			return fmt.Errorf("unable to bootstrap cluster: %w", err)
+		}
+		log.Printf("cluster: bootstrap new cluster")
+	}
+	startTask(func() { watchLeadership(ctx) })
+	if !hasState && !cc.Bootstrap && len(cc.Join) > 0 {
+		startTask(func() { joinCluster(ctx) })
+	}
+	return nil
+}
+
+// helper function to return cluster node of this server
+func localNode() ClusterNode {
+	cc := Config.Cluster
+	return ClusterNode{ID: cc.NodeID, Address: cc.RaftAddress, URL: cc.URL}
+}
+
+// helper function to register URL of the node when it becomes cluster
+// leader, other nodes register their URLs when they join the cluster
+func watchLeadership(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case leader := <-clusterRaft.LeaderCh():
+			if !leader {
+				log.Printf("cluster: node %s lost leadership", Config.Cluster.NodeID)
+				continue
+			}
+			log.Printf("cluster: node %s is leader", Config.Cluster.NodeID)
+			node := localNode()
+			if val, err := KV.Get([]byte(clusterNodePrefix + node.ID)); err == nil && string(val) == node.URL {
+				continue
+			}
+			if _, err := clusterApply(ctx, clusterCommand{Op: clusterAddNode, Node: &node}); err != nil {
+				slog.Error("cluster: unable to register node", "node", node.ID, "error", err)
+			}
+		}
+	}
+}
+
+// helper function to join existing cluster via one of configured nodes,
+// the attempts are repeated until the node joins or server is stopped
+func joinCluster(ctx context.Context) {
+	body, err := json.Marshal(localNode())
+	if err != nil {
+		slog.Error("cluster: unable to marshal node", "error", err)
+		return
+	}
+	for {
+		for _, nodeURL := range Config.Cluster.Join {
+			err := postJoin(ctx, nodeURL, body)
+			if err == nil {
+				log.Printf("cluster: joined cluster via %s", nodeURL)
+				return
+			}
+			slog.Warn("cluster: unable to join cluster", "node", nodeURL, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// helper function to send join request to given cluster node
+func postJoin(ctx context.Context, nodeURL string, body []byte) error {
+	rurl := strings.TrimSuffix(nodeURL, "/") + strings.TrimSuffix(Config.Base, "/") + "/admin/cluster/join"
+	req, err := http.NewRequestWithContext(ctx, "POST", rurl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", newRequestID())
+	req.Header.Set("Authorization", "Bearer "+clusterToken)
+	resp, err := clusterClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var rec ErrorRecord
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err := json.Unmarshal(data, &rec); err == nil && rec.Error != "" {
+			return fmt.Errorf("node responded with %d: %s", resp.StatusCode, rec.Error)
+		}
+		return fmt.Errorf("node responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// helper function to stop raft node, the leadership is transferred to
+// another voter to shorten unavailability of the cluster
+func shutdownCluster() {
+	if clusterRaft == nil {
+		return
+	}
+	if clusterRaft.State() == raft.Leader {
+		future := clusterRaft.GetConfiguration()
+		if err := future.Error(); err == nil && len(future.Configuration().Servers) > 1 {
+			log.Println("shutdown: transferring cluster leadership")
+			if err := clusterRaft.LeadershipTransfer().Error(); err != nil {
+				slog.Warn("shutdown: unable to transfer cluster leadership", "error", err)
+			}
+		}
+	}
+	log.Println("shutdown: stopping raft node")
+	if err := clusterRaft.Shutdown().Error(); err != nil {
+		slog.Error("shutdown: unable to stop raft node", "error", err)
+	}
+	if err := clusterLog.Close(); err != nil {
+		slog.Error("shutdown: unable to close raft log", "error", err)
+	}
+}
+
+// helper function to return HTTP URL of cluster leader
+func leaderURL() (string, error) {
+	_, id := clusterRaft.LeaderWithID()
+	if id == "" {
+		return "", newError(UnavailableCode, errNoLeader)
+	}
+	val, err := KV.Get([]byte(clusterNodePrefix + string(id)))
+	if err == errKeyNotFound {
+		return "", newError(UnavailableCode, fmt.Errorf("URL of cluster leader %s is unknown", id))
+	}
+	return string(val), err
+}
+
+// helper function to forward HTTP request to cluster leader, it returns
+// false if request should be served by this node, i.e. server is not
+// clustered or the node is cluster leader
+func forwardToLeader(w http.ResponseWriter, r *http.Request) bool {
+	if !isClustered() || clusterRaft.State() == raft.Leader {
+		return false
+	}
+	if r.Header.Get(clusterForwardHeader) != "" {
+		handleError(w, r, "unable to serve forwarded request", notLeaderError())
+		return true
+	}
+	leader, err := leaderURL()
+	if err != nil {
+		handleError(w, r, "unable to forward request to cluster leader", err)
+		return true
+	}
+	target, err := url.Parse(leader)
+	if err != nil {
+		handleError(w, r, "unable to forward request to cluster leader", err)
+		return true
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			pr.Out.Header.Set(clusterForwardHeader, Config.Cluster.NodeID)
+		},
+		Transport: clusterClient.Transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			handleError(w, r, "unable to forward request to cluster leader", newError(UnavailableCode, err))
+		},
+	}
+	slog.DebugContext(r.Context(), "forward request to cluster leader", "leader", leader)
+	proxy.ServeHTTP(w, r)
+	return true
+}
+
+// helper function to send request with cluster token to cluster leader and
+// decode its response into given object
+func leaderRequest(ctx context.Context, method, path string, body any, out any) error {
+	leader, err := leaderURL()
+	if err != nil {
+		return err
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	rurl := strings.TrimSuffix(leader, "/") + strings.TrimSuffix(Config.Base, "/") + path
+	req, err := http.NewRequestWithContext(ctx, method, rurl, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+clusterToken)
+	req.Header.Set(clusterForwardHeader, Config.Cluster.NodeID)
+	if rid := requestID(ctx); rid != "" {
+		req.Header.Set("X-Request-ID", rid)
+	}
+	slog.DebugContext(ctx, "send request to cluster leader", "leader", leader, "path", path)
+	resp, err := clusterClient.Do(req)
+	if err != nil {
+		return newError(UnavailableCode, fmt.Errorf("cluster leader: %w", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var rec ErrorRecord
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err := json.Unmarshal(data, &rec); err != nil || rec.Code == "" {
+			return newError(UnavailableCode, fmt.Errorf("cluster leader responded with %d", resp.StatusCode))
+		}
+		if rec.Code == NotFoundCode {
+			return errKeyNotFound
+		}
+		return newError(rec.Code, fmt.Errorf("cluster leader: %s", rec.Error))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// clusterReadIndex represents commit index of cluster leader which should be
+// applied by the node before it serves linearizable read
+type clusterReadIndex struct {
+	Index uint64 `json:"index"`
+}
+
+// helper function to return commit index of this node after it confirms
+// that it is still cluster leader
+func leaderReadIndex() (uint64, error) {
+	index := clusterRaft.CommitIndex()
+	if err := clusterRaft.VerifyLeader().Error(); err != nil {
+		return 0, notLeaderError()
+	}
+	return index, nil
+}
+
+// helper function to wait until this node has applied all log entries
+// committed by cluster leader at the time of the read, after that local
+// reads are linearizable. The followers obtain commit index from the leader.
+func linearizableRead(ctx context.Context) error {
+	_, span := tracer.Start(ctx, "raft.verify")
+	defer span.End()
+	var index uint64
+	var err error
+	if clusterRaft.State() == raft.Leader {
+		index, err = leaderReadIndex()
+	} else {
+		var ri clusterReadIndex
+		err = leaderRequest(ctx, "GET", "/admin/cluster/read-index", nil, &ri)
+		index = ri.Index
+	}
+	if err != nil {
+		spanError(span, err)
+		return err
+	}
+	deadline := time.Now().Add(clusterApplyTimeout)
+	for clusterRaft.AppliedIndex() < index {
+		if time.Now().After(deadline) {
+			return newError(UnavailableCode, errors.New("timeout while waiting for raft log to be applied"))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// helper function to prepare local read of clustered node according to
+// given read consistency, the default consistency of the cluster is used if
+// it is not provided
+func consistentRead(ctx context.Context, consistency string) error {
+	if !isClustered() {
+		return nil
+	}
+	if consistency == "" {
+		consistency = Config.Cluster.ReadConsistency
+	}
+	switch consistency {
+	case consistencyStale:
+		return nil
+	case consistencyLinearizable:
+		return linearizableRead(ctx)
+	}
+	return badRequest(fmt.Errorf("unsupported read consistency %s", consistency))
+}
+
+// helper function to prepare read of clustered node according to read
+// consistency of the request, it returns true if request is already served,
+// i.e. it failed
+func clusterRead(w http.ResponseWriter, r *http.Request) bool {
+	if err := consistentRead(r.Context(), r.FormValue("consistency")); err != nil {
+		handleError(w, r, "unable to fetch key value", err)
+		return true
+	}
+	return false
+}
+
+// helper function to collect cluster status
+func clusterStatus() (ClusterStatus, error) {
+	status := ClusterStatus{
+		Node:         Config.Cluster.NodeID,
+		State:        clusterRaft.State().String(),
+		LastIndex:    clusterRaft.LastIndex(),
+		CommitIndex:  clusterRaft.CommitIndex(),
+		AppliedIndex: clusterRaft.AppliedIndex(),
+		Nodes:        []ClusterNode{},
+	}
+	status.Term, _ = strconv.ParseUint(clusterRaft.Stats()["term"], 10, 64)
+	_, leader := clusterRaft.LeaderWithID()
+	status.Leader = string(leader)
+	future := clusterRaft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return status, err
+	}
+	for _, srv := range future.Configuration().Servers {
+		node := ClusterNode{
+			ID:       string(srv.ID),
+			Address:  string(srv.Address),
+			Suffrage: strings.ToLower(srv.Suffrage.String()),
+			Leader:   srv.ID == leader,
+		}
+		if val, err := KV.Get([]byte(clusterNodePrefix + node.ID)); err == nil {
+			node.URL = string(val)
+		}
+		status.Nodes = append(status.Nodes, node)
+	}
+	return status, nil
+}
+
+// helper function to write cluster status
+func writeClusterStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := clusterStatus()
+	if err != nil {
+		handleError(w, r, "unable to get cluster status", err)
+		return
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		handleError(w, r, "unable to marshal cluster status", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// helper function to return error of cluster end-points in standalone mode
+func requireCluster() error {
+	if !isClustered() {
+		return newError(UnavailableCode, errors.New("clustered mode is not enabled"))
+	}
+	return nil
+}
+
+// helper function to check if HTTP request carries cluster token
+func clusterAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || clusterToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(clusterToken), []byte(strings.TrimSpace(token))) == 1
+}
+
+// helper function to reject membership requests without cluster token
+func requireClusterToken(w http.ResponseWriter, r *http.Request, msg string) bool {
+	if clusterAuthorized(r) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="cmskv"`)
+	handleError(w, r, msg, errUnauthorized)
+	return false
+}
+
+// ClusterHandler provides status of the cluster
+func ClusterHandler(w http.ResponseWriter, r *http.Request) {
+	if err := requireCluster(); err != nil {
+		handleError(w, r, "unable to get cluster status", err)
+		return
+	}
+	writeClusterStatus(w, r)
+}
+
+// JoinClusterHandler adds node to the cluster as voter, the request should
+// carry cluster token and it is forwarded to cluster leader
+func JoinClusterHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	msg := "unable to join cluster"
+	if err := requireCluster(); err != nil {
+		handleError(w, r, msg, err)
+		return
+	}
+	if !requireClusterToken(w, r, msg) {
+		return
+	}
+	if forwardToLeader(w, r) {
+		return
+	}
+	var node ClusterNode
+	if err := json.NewDecoder(r.Body).Decode(&node); err != nil {
+		handleError(w, r, "unable to decode cluster node", badRequest(err))
+		return
+	}
+	if node.ID == "" || node.Address == "" {
+		handleError(w, r, msg, badRequest(errors.New("node id and address are required")))
+		return
+	}
+	future := clusterRaft.AddVoter(raft.ServerID(node.ID), raft.ServerAddress(node.Address), 0, clusterApplyTimeout)
+	if err := future.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			err = notLeaderError()
+		}
+		handleError(w, r, msg, err)
+		return
+	}
+	if node.URL != "" {
+		cmd := clusterCommand{Op: clusterAddNode, Node: &ClusterNode{ID: node.ID, URL: node.URL}}
+		if _, err := clusterApply(r.Context(), cmd); err != nil {
+			handleError(w, r, "unable to register cluster node", err)
+			return
+		}
+	}
+	slog.InfoContext(r.Context(), "cluster: node joined", "node", node.ID, "address", node.Address, "url", node.URL)
+	writeClusterStatus(w, r)
+}
+
+// RemoveClusterNodeHandler removes node from the cluster, the request
+// should carry cluster token and it is forwarded to cluster leader
+func RemoveClusterNodeHandler(w http.ResponseWriter, r *http.Request) {
+	msg := "unable to remove cluster node"
+	if err := requireCluster(); err != nil {
+		handleError(w, r, msg, err)
+		return
+	}
+	if !requireClusterToken(w, r, msg) {
+		return
+	}
+	if forwardToLeader(w, r) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	future := clusterRaft.RemoveServer(raft.ServerID(id), 0, clusterApplyTimeout)
+	if err := future.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			err = notLeaderError()
+		}
+		handleError(w, r, msg, err)
+		return
+	}
+	// the leader which removed itself is not able to commit anymore
+	if _, err := clusterApply(r.Context(), clusterCommand{Op: clusterRemoveNode, Key: id}); err != nil {
+		slog.WarnContext(r.Context(), "cluster: unable to remove node URL", "node", id, "error", err)
+	}
+	slog.InfoContext(r.Context(), "cluster: node removed", "node", id)
+	writeClusterStatus(w, r)
+}
+
+// ApplyClusterHandler commits command which modifies records on behalf of
+// cluster follower, the request should carry cluster token
+func ApplyClusterHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	msg := "unable to apply cluster command"
+	if err := requireCluster(); err != nil {
+		handleError(w, r, msg, err)
+		return
+	}
+	if !requireClusterToken(w, r, msg) {
+		return
+	}
+	var cmd clusterCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		handleError(w, r, "unable to decode cluster command", badRequest(err))
+		return
+	}
+	if !clusterDataCommand(cmd.Op) {
+		handleError(w, r, msg, badRequest(fmt.Errorf("unsupported cluster command %s", cmd.Op)))
+		return
+	}
+	// the command is never forwarded again to avoid forwarding loops
+	rec, err := raftApply(r.Context(), cmd)
+	if err != nil {
+		handleError(w, r, msg, err)
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		handleError(w, r, "unable to marshal record", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// ReadIndexHandler provides commit index of cluster leader to followers
+// which serve linearizable reads, the request should carry cluster token
+func ReadIndexHandler(w http.ResponseWriter, r *http.Request) {
+	msg := "unable to get read index"
+	if err := requireCluster(); err != nil {
+		handleError(w, r, msg, err)
+		return
+	}
+	if !requireClusterToken(w, r, msg) {
+		return
+	}
+	index, err := leaderReadIndex()
+	if err != nil {
+		handleError(w, r, msg, err)
+		return
+	}
+	data, err := json.Marshal(clusterReadIndex{Index: index})
+	if err != nil {
+		handleError(w, r, "unable to marshal read index", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// ClusterMetrics represents metrics of clustered node
+type ClusterMetrics struct {
+	State        string `json:"state"`        // raft state of the node
+	Leader       bool   `json:"leader"`       // node is cluster leader
+	Term         uint64 `json:"term"`         // current raft term
+	CommitIndex  uint64 `json:"commitIndex"`  // last committed index of raft log
+	AppliedIndex uint64 `json:"appliedIndex"` // last index applied to DB
+	Nodes        int    `json:"nodes"`        // number of cluster members
+}
+
+// helper function to collect cluster metrics
+func clusterMetrics() *ClusterMetrics {
+	if !isClustered() || clusterRaft == nil {
+		return nil
+	}
+	status, _ := clusterStatus()
+	return &ClusterMetrics{
+		State:        status.State,
+		Leader:       status.Leader == status.Node,
+		Term:         status.Term,
+		CommitIndex:  status.CommitIndex,
+		AppliedIndex: status.AppliedIndex,
+		Nodes:        len(status.Nodes),
+	}
+}
+
+// helper function to generate cluster metrics in prometheus format
+func promClusterMetrics(prefix string, data *ClusterMetrics) string {
+	var out string
+	leader := 0
+	if data.Leader {
+		leader = 1
+	}
+	out += fmt.Sprintf("# HELP %s_cluster_leader reports if node is cluster leader\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_cluster_leader gauge\n", prefix)
+	out += fmt.Sprintf("%s_cluster_leader %v\n", prefix, leader)
+	out += fmt.Sprintf("# HELP %s_cluster_term reports current raft term\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_cluster_term gauge\n", prefix)
+	out += fmt.Sprintf("%s_cluster_term %v\n", prefix, data.Term)
+	out += fmt.Sprintf("# HELP %s_cluster_commit_index reports last committed index of raft log\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_cluster_commit_index gauge\n", prefix)
+	out += fmt.Sprintf("%s_cluster_commit_index %v\n", prefix, data.CommitIndex)
+	out += fmt.Sprintf("# HELP %s_cluster_applied_index reports last raft log index applied to DB\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_cluster_applied_index gauge\n", prefix)
+	out += fmt.Sprintf("%s_cluster_applied_index %v\n", prefix, data.AppliedIndex)
+	out += fmt.Sprintf("# HELP %s_cluster_nodes reports number of cluster members\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_cluster_nodes gauge\n", prefix)
+	out += fmt.Sprintf("%s_cluster_nodes %v\n", prefix, data.Nodes)
+	return out
+}
+
+// helper function to check cluster status
+func checkCluster() (string, string) {
+	_, leader := clusterRaft.LeaderWithID()
+	if leader == "" {
+		return statusFail, errNoLeader.Error()
+	}
+	return statusOK, fmt.Sprintf("state %s, leader %s", clusterRaft.State(), leader)
+}
@@ -0,0 +1,239 @@
+package main
+
+// cluster_test module provides test of clustered mode which runs cluster
+// nodes as separate processes on localhost
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// test tokens of cluster nodes
+const (
+	testAdminToken   = "admin-token"
+	testClusterToken = "cluster-token"
+)
+
+// testNode represents cluster node running as separate process
+type testNode struct {
+	id   string
+	url  string
+	resp string // address of RESP listener
+	cmd  *exec.Cmd
+	logs string
+}
+
+// helper function to get free TCP port on localhost
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// helper function to build server binary in given directory
+func buildServer(t *testing.T, dir string) string {
+	t.Helper()
+	bin := filepath.Join(dir, "cmskv")
+	out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("unable to build server: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// helper function to start cluster node with given cluster config
+func startNode(t *testing.T, bin, dir, id string, cluster map[string]interface{}) *testNode {
+	t.Helper()
+	port := freePort(t)
+	node := &testNode{id: id, url: fmt.Sprintf("http://127.0.0.1:%d", port)}
+	node.resp = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	cluster["node_id"] = id
+	cluster["raft_address"] = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	cluster["url"] = node.url
+	cluster["token_file"] = filepath.Join(dir, "cluster.token")
+	config := map[string]interface{}{
+		"port":            port,
+		"db":              filepath.Join(dir, id),
+		"auth_token_file": filepath.Join(dir, "auth.token"),
+		"resp":            map[string]interface{}{"address": node.resp},
+		"cluster":         cluster,
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fconfig := filepath.Join(dir, id+".json")
+	if err := os.WriteFile(fconfig, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	node.logs = filepath.Join(dir, id+".log")
+	logs, err := os.Create(node.logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.cmd = exec.Command(bin, "-config", fconfig)
+	node.cmd.Stdout = logs
+	node.cmd.Stderr = logs
+	if err := node.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		node.cmd.Process.Kill()
+		node.cmd.Wait()
+		logs.Close()
+		if t.Failed() {
+			data, _ := os.ReadFile(node.logs)
+			t.Logf("logs of node %s:\n%s", id, data)
+		}
+	})
+	return node
+}
+
+// helper function to send HTTP request to the node
+func (n *testNode) request(method, path, token, body string) (int, string, error) {
+	req, err := http.NewRequest(method, n.url+path, strings.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data), err
+}
+
+// helper function to get cluster status from the node
+func (n *testNode) status() (ClusterStatus, error) {
+	var status ClusterStatus
+	code, body, err := n.request("GET", "/admin/cluster", testAdminToken, "")
+	if err != nil {
+		return status, err
+	}
+	if code != http.StatusOK {
+		return status, fmt.Errorf("status %d: %s", code, body)
+	}
+	err = json.Unmarshal([]byte(body), &status)
+	return status, err
+}
+
+// helper function to wait until given condition is met
+func waitFor(t *testing.T, msg string, cond func() error) {
+	t.Helper()
+	var err error
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); {
+		if err = cond(); err == nil {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Fatalf("%s: %v", msg, err)
+}
+
+// TestCluster runs three nodes cluster on localhost and checks replication
+// of writes and authentication of membership requests
+func TestCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip cluster test in short mode")
+	}
+	dir := t.TempDir()
+	bin := buildServer(t, dir)
+	tokens := testAdminToken + "\n" + testClusterToken + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "auth.token"), []byte(tokens), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cluster.token"), []byte(testClusterToken), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	n1 := startNode(t, bin, dir, "n1", map[string]interface{}{"bootstrap": true})
+	waitFor(t, "n1 is not leader", func() error {
+		status, err := n1.status()
+		if err == nil && status.Leader != "n1" {
+			err = fmt.Errorf("leader %q", status.Leader)
+		}
+		return err
+	})
+	join := map[string]interface{}{"join": []string{n1.url}}
+	n2 := startNode(t, bin, dir, "n2", join)
+	n3 := startNode(t, bin, dir, "n3", join)
+	waitFor(t, "nodes did not join cluster", func() error {
+		status, err := n1.status()
+		if err == nil && len(status.Nodes) != 3 {
+			err = fmt.Errorf("cluster has %d nodes", len(status.Nodes))
+		}
+		return err
+	})
+
+	// writes to follower are forwarded to the leader and replicated
+	code, body, err := n2.request("POST", "/store", testAdminToken, `{"key":"k1","value":"v1"}`)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("store via follower: %d %s %v", code, body, err)
+	}
+	waitFor(t, "record is not replicated", func() error {
+		code, body, err := n3.request("GET", "/fetch/k1?consistency=stale", testAdminToken, "")
+		if err == nil && (code != http.StatusOK || !strings.Contains(body, "v1")) {
+			err = fmt.Errorf("fetch: %d %s", code, body)
+		}
+		return err
+	})
+
+	// RESP writes to followers are forwarded to the leader and followers
+	// serve linearizable reads
+	c3 := dialRESP(t, n3.resp)
+	c3.expect("+OK", "SET", "k2", "v2")
+	hash := c3.do("ANON", "alice")
+	c2 := dialRESP(t, n2.resp)
+	c2.expect("v2", "GET", "k2")
+	c2.expect("alice", "GET", hash)
+	c2.expect("-ERR cluster leader: key alice has reverse look-up record, use store API to change it", "SET", "alice", "x")
+	c2.expect("+OK", "AUTH", testAdminToken)
+	c2.expect(":1", "DEL", "k2")
+	c3.expect("(nil)", "GET", "k2")
+
+	// membership requests require cluster token
+	node := `{"id":"n4","address":"127.0.0.1:1"}`
+	for _, token := range []string{"", testAdminToken} {
+		code, body, err := n2.request("POST", "/admin/cluster/join", token, node)
+		if err != nil || code != http.StatusUnauthorized {
+			t.Fatalf("join with token %q: expect 401, got %d %s %v", token, code, body, err)
+		}
+		code, body, err = n1.request("DELETE", "/admin/cluster/nodes/n3", token, "")
+		if err != nil || code != http.StatusUnauthorized {
+			t.Fatalf("remove with token %q: expect 401, got %d %s %v", token, code, body, err)
+		}
+	}
+
+	// the follower forwards membership request to the leader
+	code, body, err = n2.request("DELETE", "/admin/cluster/nodes/n3", testClusterToken, "")
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("remove node: %d %s %v", code, body, err)
+	}
+	waitFor(t, "node is not removed", func() error {
+		status, err := n2.status()
+		if err == nil && len(status.Nodes) != 2 {
+			err = fmt.Errorf("cluster has %d nodes", len(status.Nodes))
+		}
+		return err
+	})
+}
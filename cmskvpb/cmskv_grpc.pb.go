@@ -0,0 +1,449 @@
+// cmskv gRPC API, it mirrors store and fetch HTTP APIs of cmskv server
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: cmskv.proto
+
+package cmskvpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	KV_Store_FullMethodName     = "/cmskv.v1.KV/Store"
+	KV_Fetch_FullMethodName     = "/cmskv.v1.KV/Fetch"
+	KV_BulkStore_FullMethodName = "/cmskv.v1.KV/BulkStore"
+	KV_BulkFetch_FullMethodName = "/cmskv.v1.KV/BulkFetch"
+	KV_Delete_FullMethodName    = "/cmskv.v1.KV/Delete"
+	KV_List_FullMethodName      = "/cmskv.v1.KV/List"
+	KV_Changes_FullMethodName   = "/cmskv.v1.KV/Changes"
+)
+
+// KVClient is the client API for KV service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// KV service provides access to cmskv store
+type KVClient interface {
+	// Store stores key-value pair
+	Store(ctx context.Context, in *StoreRequest, opts ...grpc.CallOption) (*StoreResponse, error)
+	// Fetch fetches key-value pair
+	Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*Record, error)
+	// BulkStore stores stream of key-value pairs
+	BulkStore(ctx context.Context, opts ...grpc.CallOption) (KV_BulkStoreClient, error)
+	// BulkFetch fetches key-value pairs of given keys
+	BulkFetch(ctx context.Context, in *BulkFetchRequest, opts ...grpc.CallOption) (*BulkFetchResponse, error)
+	// Delete deletes key-value pair
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*Record, error)
+	// List streams key-value pairs matching given filter
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (KV_ListClient, error)
+	// Changes streams changes of keys, it is used by read-only replicas
+	Changes(ctx context.Context, in *ChangesRequest, opts ...grpc.CallOption) (KV_ChangesClient, error)
+}
+
+type kVClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKVClient(cc grpc.ClientConnInterface) KVClient {
+	return &kVClient{cc}
+}
+
+func (c *kVClient) Store(ctx context.Context, in *StoreRequest, opts ...grpc.CallOption) (*StoreResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StoreResponse)
+	err := c.cc.Invoke(ctx, KV_Store_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVClient) Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*Record, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Record)
+	err := c.cc.Invoke(ctx, KV_Fetch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVClient) BulkStore(ctx context.Context, opts ...grpc.CallOption) (KV_BulkStoreClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &KV_ServiceDesc.Streams[0], KV_BulkStore_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &kVBulkStoreClient{ClientStream: stream}
+	return x, nil
+}
+
+type KV_BulkStoreClient interface {
+	Send(*StoreRequest) error
+	CloseAndRecv() (*BulkStoreResponse, error)
+	grpc.ClientStream
+}
+
+type kVBulkStoreClient struct {
+	grpc.ClientStream
+}
+
+func (x *kVBulkStoreClient) Send(m *StoreRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *kVBulkStoreClient) CloseAndRecv() (*BulkStoreResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(BulkStoreResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *kVClient) BulkFetch(ctx context.Context, in *BulkFetchRequest, opts ...grpc.CallOption) (*BulkFetchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BulkFetchResponse)
+	err := c.cc.Invoke(ctx, KV_BulkFetch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*Record, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Record)
+	err := c.cc.Invoke(ctx, KV_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (KV_ListClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &KV_ServiceDesc.Streams[1], KV_List_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &kVListClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type KV_ListClient interface {
+	Recv() (*Record, error)
+	grpc.ClientStream
+}
+
+type kVListClient struct {
+	grpc.ClientStream
+}
+
+func (x *kVListClient) Recv() (*Record, error) {
+	m := new(Record)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *kVClient) Changes(ctx context.Context, in *ChangesRequest, opts ...grpc.CallOption) (KV_ChangesClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &KV_ServiceDesc.Streams[2], KV_Changes_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &kVChangesClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type KV_ChangesClient interface {
+	Recv() (*ChangeEvent, error)
+	grpc.ClientStream
+}
+
+type kVChangesClient struct {
+	grpc.ClientStream
+}
+
+func (x *kVChangesClient) Recv() (*ChangeEvent, error) {
+	m := new(ChangeEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// KVServer is the server API for KV service.
+// All implementations must embed UnimplementedKVServer
+// for forward compatibility
+//
+// KV service provides access to cmskv store
+type KVServer interface {
+	// Store stores key-value pair
+	Store(context.Context, *StoreRequest) (*StoreResponse, error)
+	// Fetch fetches key-value pair
+	Fetch(context.Context, *FetchRequest) (*Record, error)
+	// BulkStore stores stream of key-value pairs
+	BulkStore(KV_BulkStoreServer) error
+	// BulkFetch fetches key-value pairs of given keys
+	BulkFetch(context.Context, *BulkFetchRequest) (*BulkFetchResponse, error)
+	// Delete deletes key-value pair
+	Delete(context.Context, *DeleteRequest) (*Record, error)
+	// List streams key-value pairs matching given filter
+	List(*ListRequest, KV_ListServer) error
+	// Changes streams changes of keys, it is used by read-only replicas
+	Changes(*ChangesRequest, KV_ChangesServer) error
+	mustEmbedUnimplementedKVServer()
+}
+
+// UnimplementedKVServer must be embedded to have forward compatible implementations.
+type UnimplementedKVServer struct {
+}
+
+func (UnimplementedKVServer) Store(context.Context, *StoreRequest) (*StoreResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Store not implemented")
+}
+func (UnimplementedKVServer) Fetch(context.Context, *FetchRequest) (*Record, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Fetch not implemented")
+}
+func (UnimplementedKVServer) BulkStore(KV_BulkStoreServer) error {
+	return status.Errorf(codes.Unimplemented, "method BulkStore not implemented")
+}
+func (UnimplementedKVServer) BulkFetch(context.Context, *BulkFetchRequest) (*BulkFetchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BulkFetch not implemented")
+}
+func (UnimplementedKVServer) Delete(context.Context, *DeleteRequest) (*Record, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedKVServer) List(*ListRequest, KV_ListServer) error {
+	return status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedKVServer) Changes(*ChangesRequest, KV_ChangesServer) error {
+	return status.Errorf(codes.Unimplemented, "method Changes not implemented")
+}
+func (UnimplementedKVServer) mustEmbedUnimplementedKVServer() {}
+
+// UnsafeKVServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to KVServer will
+// result in compilation errors.
+type UnsafeKVServer interface {
+	mustEmbedUnimplementedKVServer()
+}
+
+func RegisterKVServer(s grpc.ServiceRegistrar, srv KVServer) {
+	s.RegisterService(&KV_ServiceDesc, srv)
+}
+
+func _KV_Store_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StoreRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVServer).Store(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KV_Store_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVServer).Store(ctx, req.(*StoreRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KV_Fetch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FetchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVServer).Fetch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KV_Fetch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVServer).Fetch(ctx, req.(*FetchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KV_BulkStore_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(KVServer).BulkStore(&kVBulkStoreServer{ServerStream: stream})
+}
+
+type KV_BulkStoreServer interface {
+	SendAndClose(*BulkStoreResponse) error
+	Recv() (*StoreRequest, error)
+	grpc.ServerStream
+}
+
+type kVBulkStoreServer struct {
+	grpc.ServerStream
+}
+
+func (x *kVBulkStoreServer) SendAndClose(m *BulkStoreResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *kVBulkStoreServer) Recv() (*StoreRequest, error) {
+	m := new(StoreRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _KV_BulkFetch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BulkFetchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVServer).BulkFetch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KV_BulkFetch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVServer).BulkFetch(ctx, req.(*BulkFetchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KV_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KV_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KV_List_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KVServer).List(m, &kVListServer{ServerStream: stream})
+}
+
+type KV_ListServer interface {
+	Send(*Record) error
+	grpc.ServerStream
+}
+
+type kVListServer struct {
+	grpc.ServerStream
+}
+
+func (x *kVListServer) Send(m *Record) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _KV_Changes_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ChangesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KVServer).Changes(m, &kVChangesServer{ServerStream: stream})
+}
+
+type KV_ChangesServer interface {
+	Send(*ChangeEvent) error
+	grpc.ServerStream
+}
+
+type kVChangesServer struct {
+	grpc.ServerStream
+}
+
+func (x *kVChangesServer) Send(m *ChangeEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// KV_ServiceDesc is the grpc.ServiceDesc for KV service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var KV_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cmskv.v1.KV",
+	HandlerType: (*KVServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Store",
+			Handler:    _KV_Store_Handler,
+		},
+		{
+			MethodName: "Fetch",
+			Handler:    _KV_Fetch_Handler,
+		},
+		{
+			MethodName: "BulkFetch",
+			Handler:    _KV_BulkFetch_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _KV_Delete_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "BulkStore",
+			Handler:       _KV_BulkStore_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "List",
+			Handler:       _KV_List_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Changes",
+			Handler:       _KV_Changes_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "cmskv.proto",
+}
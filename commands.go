@@ -0,0 +1,273 @@
+package main
+
+// commands module provides cmskv command line sub-commands
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// helper function to print usage of cmskv sub-commands
+func commandsUsage() {
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  encrypt [-out <dir>]")
+	fmt.Fprintln(os.Stderr, "        encrypt existing unencrypted DB in place or into new DB directory")
+	fmt.Fprintln(os.Stderr, "  backup -file <file> [-since <version>]")
+	fmt.Fprintln(os.Stderr, "        write full or incremental DB backup into given file")
+	fmt.Fprintln(os.Stderr, "  restore -file <file>")
+	fmt.Fprintln(os.Stderr, "        restore DB from given backup file, the server should be stopped")
+	fmt.Fprintln(os.Stderr, "  snapshot create|list|export|delete|restore [-name <name>] [-file <file>]")
+	fmt.Fprintln(os.Stderr, "        manage point-in-time DB snapshots, export writes snapshot in backup format")
+	fmt.Fprintln(os.Stderr, "  export [-format json|ndjson|csv] [-prefix <prefix>] [-namespace <ns>] [-snapshot <name>] [-file <file>]")
+	fmt.Fprintln(os.Stderr, "        export DB records into given file or stdout")
+	fmt.Fprintln(os.Stderr, "  import [-format json|ndjson|csv] [-prefix <prefix>] [-namespace <ns>] [-dry-run] [-overwrite] -file <file>")
+	fmt.Fprintln(os.Stderr, "        import DB records from given file and report conflicts with existing entries")
+	fmt.Fprintln(os.Stderr, "  rebalance [-dry-run]")
+	fmt.Fprintln(os.Stderr, "        move records of router shards to shards they belong to, e.g. after new shards are added")
+}
+
+// helper function to run given sub-command
+func runCommand(args []string) {
+	var err error
+	switch args[0] {
+	case "encrypt":
+		err = encryptCommand(args[1:])
+	case "backup":
+		err = backupCommand(args[1:])
+	case "restore":
+		err = restoreCommand(args[1:])
+	case "snapshot":
+		err = snapshotCommand(args[1:])
+	case "export":
+		err = exportCommand(args[1:])
+	case "import":
+		err = importCommand(args[1:])
+	case "rebalance":
+		err = rebalanceCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n", args[0])
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatalf("command %s failed, error: %v", args[0], err)
+	}
+}
+
+// encrypt command encrypts existing badger DB with configured encryption key
+func encryptCommand(args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	var out string
+	fs.StringVar(&out, "out", "", "output DB directory, if empty the DB is encrypted in place")
+	fs.Parse(args)
+	if Config.Engine != "badger" {
+		return fmt.Errorf("encryption is not supported by %s engine", Config.Engine)
+	}
+	return encryptDB(Config.BadgerDB, out)
+}
+
+// helper function to open DB, execute given function and close DB
+func withDB(f func() error) error {
+	var err error
+	KV, err = openStore(Config.BadgerDB)
+	if err != nil {
+		return err
+	}
+	err = f()
+	if e := KV.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// backup command writes DB backup into given file
+func backupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	var fname string
+	fs.StringVar(&fname, "file", "", "backup file name")
+	var since uint64
+	fs.Uint64Var(&since, "since", 0, "create incremental backup since given version")
+	fs.Parse(args)
+	if fname == "" {
+		return errors.New("no backup file is provided")
+	}
+	return withDB(func() error {
+		version, err := backupFile(fname, since)
+		if err == nil {
+			fmt.Printf("backup %s, next incremental backup version %d\n", fname, version+1)
+		}
+		return err
+	})
+}
+
+// restore command loads given backup file into DB
+func restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	var fname string
+	fs.StringVar(&fname, "file", "", "backup file name")
+	fs.Parse(args)
+	if fname == "" {
+		return errors.New("no backup file is provided")
+	}
+	file, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return withDB(func() error {
+		return restoreDB(file)
+	})
+}
+
+// snapshot command manages DB snapshots
+func snapshotCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no snapshot action is provided")
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	var name string
+	fs.StringVar(&name, "name", "", "snapshot name")
+	var fname string
+	fs.StringVar(&fname, "file", "", "output file of snapshot export")
+	fs.Parse(args[1:])
+	return withDB(func() error {
+		switch action {
+		case "create":
+			snap, err := createSnapshot(name)
+			if err == nil {
+				fmt.Printf("snapshot %s version %d\n", snap.Name, snap.Version)
+			}
+			return err
+		case "list":
+			snapshots, err := listSnapshots()
+			for _, snap := range snapshots {
+				tstamp := time.Unix(snap.Created, 0).UTC().Format(time.RFC3339)
+				fmt.Printf("%s version=%d created=%s\n", snap.Name, snap.Version, tstamp)
+			}
+			return err
+		case "export":
+			if fname == "" {
+				return errors.New("no output file is provided")
+			}
+			file, err := os.Create(fname)
+			if err != nil {
+				return err
+			}
+			err = exportSnapshot(file, name)
+			if e := file.Close(); err == nil {
+				err = e
+			}
+			return err
+		case "delete":
+			return deleteSnapshot(name)
+		case "restore":
+			return restoreSnapshot(name)
+		}
+		return fmt.Errorf("unknown snapshot action %s", action)
+	})
+}
+
+// export command exports DB records
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var format, prefix, namespace, snapshot, fname string
+	fs.StringVar(&format, "format", "json", "export format: json, ndjson or csv")
+	fs.StringVar(&prefix, "prefix", "", "export records with given key prefix")
+	fs.StringVar(&namespace, "namespace", "", "export records of given namespace")
+	fs.StringVar(&snapshot, "snapshot", "", "export records as of given snapshot")
+	fs.StringVar(&fname, "file", "", "output file, by default records are written to stdout")
+	fs.Parse(args)
+	prefix, err := keyPrefix(prefix, namespace)
+	if err != nil {
+		return err
+	}
+	out := os.Stdout
+	if fname != "" {
+		out, err = os.Create(fname)
+		if err != nil {
+			return err
+		}
+	}
+	return withDB(func() error {
+		count, err := exportRecords(out, format, prefix, snapshot)
+		if fname != "" {
+			if e := out.Close(); err == nil {
+				err = e
+			}
+		}
+		if err == nil {
+			log.Printf("exported %d records", count)
+		}
+		return err
+	})
+}
+
+// import command imports DB records
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var format, prefix, namespace, fname string
+	fs.StringVar(&format, "format", "json", "import format: json, ndjson or csv")
+	fs.StringVar(&prefix, "prefix", "", "import records with given key prefix")
+	fs.StringVar(&namespace, "namespace", "", "import records of given namespace")
+	fs.StringVar(&fname, "file", "", "input file")
+	var dryRun, overwrite bool
+	fs.BoolVar(&dryRun, "dry-run", false, "report new records and conflicts without writing to DB")
+	fs.BoolVar(&overwrite, "overwrite", false, "overwrite existing records with conflicting values")
+	fs.Parse(args)
+	if fname == "" {
+		return errors.New("no input file is provided")
+	}
+	prefix, err := keyPrefix(prefix, namespace)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return withDB(func() error {
+		report, err := importRecords(file, format, prefix, dryRun, overwrite)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			fmt.Println(string(data))
+		}
+		return err
+	})
+}
+
+// rebalance command moves records of router shards to shards they belong to
+func rebalanceCommand(args []string) error {
+	fs := flag.NewFlagSet("rebalance", flag.ExitOnError)
+	var dryRun bool
+	fs.BoolVar(&dryRun, "dry-run", false, "report records to move without changing shards")
+	fs.Parse(args)
+	if !isRouter() {
+		return errors.New("no router shards are configured")
+	}
+	if err := initRouter(); err != nil {
+		return err
+	}
+	time0 := time.Now()
+	report, err := rebalanceShards(context.Background(), dryRun)
+	data, e := json.MarshalIndent(report, "", "  ")
+	if e == nil {
+		fmt.Println(string(data))
+	}
+	if err == nil {
+		log.Printf("rebalance completed in %v", time.Since(time0))
+	}
+	return err
+}
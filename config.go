@@ -4,18 +4,97 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"strings"
 )
 
 // Configuration stores server configuration parameters
 type Configuration struct {
 	Port          int    `json:"port"`     // server port number
 	Base          string `json:"base"`     // base URL
-	Verbose       int    `json:"verbose"`  // verbose output
+	Verbose       int    `json:"verbose"`  // verbose output, deprecated in favor of log_level
 	UTC           bool   `json:"utc"`      // report logger time in UTC
 	BadgerDB      string `json:"db"`       // db file name
 	LimiterPeriod string `json:"rate"`     // github.com/ulule/limiter rate value
 	LogFile       string `json:"log_file"` // server log file
 	SHA           string `json:"sha"`      // sha version: sha1, sha256, sha512
+	Engine        string `json:"engine"`   // storage engine: badger (default), bbolt or memory
+
+	MetricsPrefix    string `json:"metrics_prefix"`     // prefix of prometheus metrics, default cmskv
+	KeyCountInterval string `json:"key_count_interval"` // interval between key count samples, e.g. 5m
+
+	ReadOnly    bool   `json:"read_only"`     // open DB in read-only mode
+	MinDiskFree uint64 `json:"min_disk_free"` // min free disk space (bytes) of DB area for readiness check, 0 disables it
+
+	LogFormat string `json:"log_format"` // log format: text (default) or json
+	LogLevel  string `json:"log_level"`  // log level: debug, info (default), warn, error
+
+	// number of versions of each key to keep in badger DB
+	VersionsToKeep int `json:"versions_to_keep"`
+
+	// directory of snapshot files, default <db>.snapshots
+	SnapshotDir string `json:"snapshot_dir"`
+
+	// badger encryption key is never provided in configuration, instead
+	// we read it either from a file or from environment variable
+	EncryptionKeyFile     string `json:"encryption_key_file"`     // file with encryption key
+	EncryptionKeyEnv      string `json:"encryption_key_env"`      // env variable with encryption key
+	EncryptionKeyRotation string `json:"encryption_key_rotation"` // rotation duration of data keys, e.g. 240h
+
+	// scheduled backups
+	BackupDir       string `json:"backup_dir"`       // directory to write scheduled backups
+	BackupInterval  string `json:"backup_interval"`  // interval between backups, e.g. 24h
+	BackupRetention int    `json:"backup_retention"` // number of backup files to keep
+
+	// OpenTelemetry tracing, spans are exported either to OTLP HTTP endpoint
+	// or to a local file
+	TracingEndpoint    string  `json:"tracing_endpoint"`     // OTLP HTTP endpoint, e.g. localhost:4318
+	TracingInsecure    bool    `json:"tracing_insecure"`     // use HTTP instead of HTTPS for OTLP endpoint
+	TracingFile        string  `json:"tracing_file"`         // file to write spans to
+	TracingServiceName string  `json:"tracing_service_name"` // service name of spans, default cmskv
+	TracingSampleRatio float64 `json:"tracing_sample_ratio"` // fraction of sampled traces, default 1
+
+	// value log garbage collection
+	GCInterval     string  `json:"gc_interval"`      // interval between GC runs, e.g. 10m
+	GCDiscardRatio float64 `json:"gc_discard_ratio"` // discard ratio of value log files to rewrite
+
+	// change stream
+	ChangesRetention string `json:"changes_retention"` // time to keep deletes for change stream catch-up, default 168h
+
+	// graceful shutdown
+	ShutdownTimeout string `json:"shutdown_timeout"` // time to drain requests and background tasks, e.g. 20s
+
+	// HTTP server timeouts and limits
+	ReadTimeout       string           `json:"read_timeout"`        // max time to read request, default 30s
+	ReadHeaderTimeout string           `json:"read_header_timeout"` // max time to read request headers, default 10s
+	WriteTimeout      string           `json:"write_timeout"`       // max time to write response, no timeout by default
+	IdleTimeout       string           `json:"idle_timeout"`        // max time of idle keep-alive connection, default 2m
+	MaxHeaderBytes    int              `json:"max_header_bytes"`    // max size of request headers, default 1MB
+	MaxBodySize       int64            `json:"max_body_size"`       // max size of request body, 0 means no limit
+	MaxBodySizes      map[string]int64 `json:"max_body_sizes"`      // max size of request body per route, e.g. {"/store": 4096}
+	MaxConnections    int              `json:"max_connections"`     // max number of concurrent connections per listener, 0 means no limit
+
+	// server listeners, if not provided server listens on TCP port
+	Listeners     []ListenerConfig `json:"listeners"`       // list of TCP, TLS and unix socket listeners
+	AuthTokenFile string           `json:"auth_token_file"` // file with bearer tokens used by auth middleware
+
+	// gRPC API listener, gRPC server is started if its address is provided
+	GRPC ListenerConfig `json:"grpc"`
+
+	// Redis RESP protocol listener, RESP server is started if its address is provided
+	RESP ListenerConfig `json:"resp"`
+
+	// read-only replica mode, it is enabled if primary URL is provided
+	Replica ReplicaConfig `json:"replica"`
+
+	// webhooks notified about store and delete events
+	Webhooks []WebhookConfig `json:"webhooks"`
+
+	// clustered mode, it is enabled if node id is provided
+	Cluster ClusterConfig `json:"cluster"`
+
+	// router mode, it is enabled if backend shards are provided
+	Router RouterConfig `json:"router"`
 }
 
 // Config variable represents configuration object
@@ -25,7 +104,7 @@ var Config Configuration
 func (c *Configuration) String() string {
 	data, err := json.Marshal(c)
 	if err != nil {
-		log.Println("ERROR: fail to marshal configuration", err)
+		log.Println("fail to marshal configuration", err)
 		return ""
 	}
 	return string(data)
@@ -49,8 +128,75 @@ func parseConfig(configFile string) error {
 	if Config.BadgerDB == "" {
 		Config.BadgerDB = "/tmp/badger.db"
 	}
+	if Config.SnapshotDir == "" {
+		Config.SnapshotDir = strings.TrimSuffix(Config.BadgerDB, "/") + ".snapshots"
+	}
+	if Config.Engine == "" {
+		Config.Engine = "badger"
+	}
 	if Config.LimiterPeriod == "" {
 		Config.LimiterPeriod = "100-S"
 	}
+	if Config.MetricsPrefix == "" {
+		Config.MetricsPrefix = "cmskv"
+	}
+	if Config.KeyCountInterval == "" {
+		Config.KeyCountInterval = "5m"
+	}
+	if Config.TracingServiceName == "" {
+		Config.TracingServiceName = "cmskv"
+	}
+	if Config.TracingSampleRatio == 0 {
+		Config.TracingSampleRatio = 1
+	}
+	if Config.BackupInterval == "" {
+		Config.BackupInterval = "24h"
+	}
+	if Config.BackupRetention == 0 {
+		Config.BackupRetention = 7
+	}
+	if Config.GCInterval == "" {
+		Config.GCInterval = "10m"
+	}
+	if Config.GCDiscardRatio == 0 {
+		Config.GCDiscardRatio = 0.5
+	}
+	if Config.ChangesRetention == "" {
+		Config.ChangesRetention = "168h"
+	}
+	if Config.ShutdownTimeout == "" {
+		// leave time to close DB within default kubernetes grace period
+		Config.ShutdownTimeout = "20s"
+	}
+	if Config.ReadTimeout == "" {
+		Config.ReadTimeout = "30s"
+	}
+	if Config.ReadHeaderTimeout == "" {
+		Config.ReadHeaderTimeout = "10s"
+	}
+	if Config.IdleTimeout == "" {
+		Config.IdleTimeout = "2m"
+	}
+	if Config.MaxHeaderBytes == 0 {
+		Config.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+	if Config.Replica.ReconnectInterval == "" {
+		Config.Replica.ReconnectInterval = "5s"
+	}
+	if Config.Replica.MaxLag == "" {
+		Config.Replica.MaxLag = "30s"
+	}
+	if Config.Cluster.ApplyTimeout == "" {
+		Config.Cluster.ApplyTimeout = "10s"
+	}
+	if Config.Cluster.ReadConsistency == "" {
+		Config.Cluster.ReadConsistency = consistencyLinearizable
+	}
+	if Config.Router.VirtualNodes == 0 {
+		Config.Router.VirtualNodes = 128
+	}
+	if Config.Router.Timeout == "" {
+		Config.Router.Timeout = "10s"
+	}
 	return nil
 }
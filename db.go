@@ -0,0 +1,161 @@
+package main
+
+// db module provides helper functions to open badger DB
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// default name of environment variable which holds badger encryption key
+const encryptionKeyEnv = "CMSKV_ENCRYPTION_KEY"
+
+// helper function to read badger encryption key from either key file
+// or environment variable, the key should be 16, 24 or 32 bytes long to
+// use AES-128, AES-192 or AES-256, respectively
+func encryptionKey() ([]byte, error) {
+	var key string
+	if Config.EncryptionKeyFile != "" {
+		data, err := ioutil.ReadFile(Config.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = strings.TrimSpace(string(data))
+	} else {
+		env := Config.EncryptionKeyEnv
+		if env == "" {
+			env = encryptionKeyEnv
+		}
+		key = strings.TrimSpace(os.Getenv(env))
+	}
+	if key == "" {
+		return nil, nil
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return []byte(key), nil
+	}
+	msg := fmt.Sprintf("invalid encryption key size %d, should be 16, 24 or 32 bytes", len(key))
+	return nil, errors.New(msg)
+}
+
+// helper function to construct badger options for given DB path
+// and encryption key
+func dbOptions(path string, key []byte) (badger.Options, error) {
+	opts := badger.DefaultOptions(path).WithLogger(badgerLogger{})
+	if Config.ReadOnly {
+		opts = opts.WithReadOnly(true)
+	}
+	if Config.VersionsToKeep > 1 {
+		opts = opts.WithNumVersionsToKeep(Config.VersionsToKeep)
+	}
+	if len(key) == 0 {
+		return opts, nil
+	}
+	opts = opts.WithEncryptionKey(key)
+	// badger recommends to use index cache with encryption, see
+	// https://dgraph.io/docs/badger/get-started/#encryption-mode
+	opts = opts.WithIndexCacheSize(100 << 20)
+	if Config.EncryptionKeyRotation != "" {
+		d, err := time.ParseDuration(Config.EncryptionKeyRotation)
+		if err != nil {
+			return opts, err
+		}
+		opts = opts.WithEncryptionKeyRotationDuration(d)
+	}
+	return opts, nil
+}
+
+// helper function to open badger DB with our configuration
+func openDB(path string) (*badger.DB, error) {
+	key, err := encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	opts, err := dbOptions(path, key)
+	if err != nil {
+		return nil, err
+	}
+	return badger.Open(opts)
+}
+
+// helper function to copy content of src DB into dst DB
+func copyDB(src, dst *badger.DB) error {
+	r, w := io.Pipe()
+	go func() {
+		_, err := src.Backup(w, 0)
+		w.CloseWithError(err)
+	}()
+	return dst.Load(r, 256)
+}
+
+// helper function to encrypt existing unencrypted badger DB, if out
+// is empty the DB is encrypted in place, i.e. its encrypted copy replaces
+// the original DB
+func encryptDB(path, out string) error {
+	key, err := encryptionKey()
+	if err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return errors.New("no encryption key is provided")
+	}
+	inPlace := out == ""
+	if inPlace {
+		out = fmt.Sprintf("%s.encrypted", strings.TrimSuffix(path, "/"))
+	}
+	if _, err := os.Stat(out); err == nil {
+		return fmt.Errorf("output DB %s already exists", out)
+	}
+
+	// open source DB without encryption
+	src, err := badger.Open(badger.DefaultOptions(path))
+	if err != nil {
+		return err
+	}
+	opts, err := dbOptions(out, key)
+	if err != nil {
+		src.Close()
+		return err
+	}
+	dst, err := badger.Open(opts)
+	if err != nil {
+		src.Close()
+		return err
+	}
+	err = copyDB(src, dst)
+	src.Close()
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.RemoveAll(out)
+		return err
+	}
+	log.Printf("badger DB %s is encrypted into %s", path, out)
+	if !inPlace {
+		return nil
+	}
+
+	// swap original DB with encrypted one and remove plain-text data
+	orig := fmt.Sprintf("%s.orig", strings.TrimSuffix(path, "/"))
+	if err := os.Rename(path, orig); err != nil {
+		return err
+	}
+	if err := os.Rename(out, path); err != nil {
+		os.Rename(orig, path)
+		return err
+	}
+	log.Printf("badger DB %s is replaced with its encrypted version", path)
+	return os.RemoveAll(orig)
+}
@@ -0,0 +1,204 @@
+package main
+
+// dbmetrics module provides metrics of badger DB
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto"
+)
+
+// KeyCount represents estimated number of keys in DB, it is periodically
+// updated by key counter
+var KeyCount uint64
+
+// KeyCountTime represents time (seconds since epoch) of last key count update
+var KeyCountTime int64
+
+// CacheMetrics represents metrics of badger block or index cache
+type CacheMetrics struct {
+	Hits        uint64  `json:"hits"`        // number of cache hits
+	Misses      uint64  `json:"misses"`      // number of cache misses
+	Ratio       float64 `json:"ratio"`       // cache hit ratio
+	KeysAdded   uint64  `json:"keysAdded"`   // number of keys added to the cache
+	KeysEvicted uint64  `json:"keysEvicted"` // number of keys evicted from the cache
+}
+
+// LevelMetrics represents metrics of LSM tree level
+type LevelMetrics struct {
+	Level     int   `json:"level"`     // level number
+	NumTables int   `json:"numTables"` // number of tables in the level
+	Size      int64 `json:"size"`      // size of the level in bytes
+}
+
+// DBMetrics represents metrics of badger DB
+type DBMetrics struct {
+	LSMSize       int64          `json:"lsmSize"`       // size of LSM tree in bytes
+	VlogSize      int64          `json:"vlogSize"`      // size of value log in bytes
+	NumTables     int            `json:"numTables"`     // total number of tables
+	Levels        []LevelMetrics `json:"levels"`        // LSM tree levels
+	PendingWrites int64          `json:"pendingWrites"` // number of pending writes
+	MaxVersion    uint64         `json:"maxVersion"`    // max version of DB
+	KeyCount      uint64         `json:"keyCount"`      // estimated number of keys
+	KeyCountTime  int64          `json:"keyCountTime"`  // time of last key count
+	BlockCache    CacheMetrics   `json:"blockCache"`    // block cache metrics
+	IndexCache    CacheMetrics   `json:"indexCache"`    // index cache metrics
+}
+
+// helper function to convert ristretto metrics into cache metrics
+func cacheMetrics(m *ristretto.Metrics) CacheMetrics {
+	return CacheMetrics{
+		Hits:        m.Hits(),
+		Misses:      m.Misses(),
+		Ratio:       m.Ratio(),
+		KeysAdded:   m.KeysAdded(),
+		KeysEvicted: m.KeysEvicted(),
+	}
+}
+
+// helper function to collect badger DB metrics
+func dbMetrics() DBMetrics {
+	m := DBMetrics{
+		KeyCount:     atomic.LoadUint64(&KeyCount),
+		KeyCountTime: atomic.LoadInt64(&KeyCountTime),
+	}
+	// other metrics are provided only by badger engine
+	if DB == nil || DB.IsClosed() {
+		return m
+	}
+	m.LSMSize, m.VlogSize = DB.Size()
+	m.NumTables = len(DB.Tables())
+	for _, l := range DB.Levels() {
+		m.Levels = append(m.Levels, LevelMetrics{Level: l.Level, NumTables: l.NumTables, Size: l.Size})
+	}
+	if v, ok := y.PendingWrites.Get(Config.BadgerDB).(*expvar.Int); ok {
+		m.PendingWrites = v.Value()
+	}
+	m.MaxVersion = DB.MaxVersion()
+	m.BlockCache = cacheMetrics(DB.BlockCacheMetrics())
+	m.IndexCache = cacheMetrics(DB.IndexCacheMetrics())
+	return m
+}
+
+// helper function to count keys in DB, system keys are not counted, the
+// badger keys are counted without reading their values from value log
+func countKeys() (uint64, error) {
+	var count uint64
+	if DB != nil {
+		err := DB.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				if !isSystemKey(string(it.Item().Key())) {
+					count++
+				}
+			}
+			return nil
+		})
+		return count, err
+	}
+	err := KV.Iterate(nil, nil, func(key, value []byte) error {
+		if !isSystemKey(string(key)) {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// helper function to periodically sample number of keys in DB until given
+// context is cancelled
+func keyCounter(ctx context.Context, interval string) {
+	period, err := time.ParseDuration(interval)
+	if err != nil {
+		slog.Error("unable to parse key count interval", "interval", interval, "error", err)
+		return
+	}
+	for {
+		count, err := countKeys()
+		if err != nil {
+			slog.Error("unable to count keys", "error", err)
+		} else {
+			atomic.StoreUint64(&KeyCount, count)
+			atomic.StoreInt64(&KeyCountTime, time.Now().Unix())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(period):
+		}
+	}
+}
+
+// helper function to generate DB metrics in prometheus format
+func promDBMetrics(prefix string, data DBMetrics) string {
+	var out string
+
+	out += fmt.Sprintf("# HELP %s_db_lsm_size_bytes reports size of LSM tree\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_db_lsm_size_bytes gauge\n", prefix)
+	out += fmt.Sprintf("%s_db_lsm_size_bytes %v\n", prefix, data.LSMSize)
+	out += fmt.Sprintf("# HELP %s_db_vlog_size_bytes reports size of value log\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_db_vlog_size_bytes gauge\n", prefix)
+	out += fmt.Sprintf("%s_db_vlog_size_bytes %v\n", prefix, data.VlogSize)
+
+	out += fmt.Sprintf("# HELP %s_db_tables reports total number of tables\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_db_tables gauge\n", prefix)
+	out += fmt.Sprintf("%s_db_tables %v\n", prefix, data.NumTables)
+	out += fmt.Sprintf("# HELP %s_db_level_tables reports number of tables per LSM level\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_db_level_tables gauge\n", prefix)
+	for _, l := range data.Levels {
+		out += fmt.Sprintf("%s_db_level_tables{level=\"%d\"} %v\n", prefix, l.Level, l.NumTables)
+	}
+	out += fmt.Sprintf("# HELP %s_db_level_size_bytes reports size of LSM level\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_db_level_size_bytes gauge\n", prefix)
+	for _, l := range data.Levels {
+		out += fmt.Sprintf("%s_db_level_size_bytes{level=\"%d\"} %v\n", prefix, l.Level, l.Size)
+	}
+
+	out += fmt.Sprintf("# HELP %s_db_pending_writes reports number of pending writes\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_db_pending_writes gauge\n", prefix)
+	out += fmt.Sprintf("%s_db_pending_writes %v\n", prefix, data.PendingWrites)
+	out += fmt.Sprintf("# HELP %s_db_max_version reports max version of DB\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_db_max_version counter\n", prefix)
+	out += fmt.Sprintf("%s_db_max_version %v\n", prefix, data.MaxVersion)
+	out += fmt.Sprintf("# HELP %s_db_keys reports estimated number of keys\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_db_keys gauge\n", prefix)
+	out += fmt.Sprintf("%s_db_keys %v\n", prefix, data.KeyCount)
+
+	caches := []struct {
+		name string
+		m    CacheMetrics
+	}{{"block", data.BlockCache}, {"index", data.IndexCache}}
+	out += fmt.Sprintf("# HELP %s_db_cache_hits reports number of cache hits\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_db_cache_hits counter\n", prefix)
+	for _, c := range caches {
+		out += fmt.Sprintf("%s_db_cache_hits{cache=\"%s\"} %v\n", prefix, c.name, c.m.Hits)
+	}
+	out += fmt.Sprintf("# HELP %s_db_cache_misses reports number of cache misses\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_db_cache_misses counter\n", prefix)
+	for _, c := range caches {
+		out += fmt.Sprintf("%s_db_cache_misses{cache=\"%s\"} %v\n", prefix, c.name, c.m.Misses)
+	}
+	out += fmt.Sprintf("# HELP %s_db_cache_hit_ratio reports cache hit ratio\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_db_cache_hit_ratio gauge\n", prefix)
+	for _, c := range caches {
+		out += fmt.Sprintf("%s_db_cache_hit_ratio{cache=\"%s\"} %v\n", prefix, c.name, c.m.Ratio)
+	}
+	out += fmt.Sprintf("# HELP %s_db_cache_keys_evicted reports number of keys evicted from cache\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_db_cache_keys_evicted counter\n", prefix)
+	for _, c := range caches {
+		out += fmt.Sprintf("%s_db_cache_keys_evicted{cache=\"%s\"} %v\n", prefix, c.name, c.m.KeysEvicted)
+	}
+	return out
+}
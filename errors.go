@@ -0,0 +1,120 @@
+package main
+
+// errors module provides error model of our server
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// error codes of our server, the codes are part of our API and should
+// not be changed
+const (
+	BadRequestCode      = "bad_request"       // malformed request or invalid parameters
+	UnauthorizedCode    = "unauthorized"      // missing or invalid credentials
+	NotFoundCode        = "not_found"         // key or snapshot does not exist
+	ConflictCode        = "conflict"          // conflicting update or resource already exists
+	RequestTooLargeCode = "request_too_large" // request body exceeds allowed size
+	RateLimitedCode     = "rate_limited"      // client exceeded request rate
+	InternalCode        = "internal_error"    // internal server error
+	ReadOnlyCode        = "read_only"         // server does not accept writes
+	UnavailableCode     = "unavailable"       // server is not able to serve the request
+	HistoryGoneCode     = "history_gone"      // requested change history is no longer retained
+)
+
+// errorStatus maps error codes to HTTP status codes
+var errorStatus = map[string]int{
+	BadRequestCode:      http.StatusBadRequest,
+	UnauthorizedCode:    http.StatusUnauthorized,
+	NotFoundCode:        http.StatusNotFound,
+	ConflictCode:        http.StatusConflict,
+	RequestTooLargeCode: http.StatusRequestEntityTooLarge,
+	RateLimitedCode:     http.StatusTooManyRequests,
+	InternalCode:        http.StatusInternalServerError,
+	ReadOnlyCode:        http.StatusServiceUnavailable,
+	UnavailableCode:     http.StatusServiceUnavailable,
+	HistoryGoneCode:     http.StatusGone,
+}
+
+// ServerError represents error of our server with machine-readable code
+type ServerError struct {
+	Code string // error code
+	Err  error  // underlying error
+}
+
+// Error implements error interface
+func (e *ServerError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns underlying error
+func (e *ServerError) Unwrap() error {
+	return e.Err
+}
+
+// Status returns HTTP status code of the error
+func (e *ServerError) Status() int {
+	if status, ok := errorStatus[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// helper function to create new server error with given code
+func newError(code string, err error) error {
+	return &ServerError{Code: code, Err: err}
+}
+
+// helper function to create bad request error
+func badRequest(err error) error {
+	return newError(BadRequestCode, err)
+}
+
+// errReadOnly is returned when server runs in read-only mode
+var errReadOnly = newError(ReadOnlyCode, errors.New("server is in read-only mode"))
+
+// errRateLimited is returned when client exceeds request rate
+var errRateLimited = newError(RateLimitedCode, errors.New("limit exceeded"))
+
+// helper function to convert given error into server error, the errors of
+// badger and standard library are mapped to appropriate codes and all other
+// errors are considered as internal server errors
+func serverError(err error) *ServerError {
+	var serr *ServerError
+	if errors.As(err, &serr) {
+		return serr
+	}
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	code := InternalCode
+	switch {
+	case errors.Is(err, badger.ErrKeyNotFound), errors.Is(err, errNoSnapshot):
+		code = NotFoundCode
+	case errors.Is(err, badger.ErrConflict):
+		code = ConflictCode
+	case errors.As(err, &maxBytesErr):
+		code = RequestTooLargeCode
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		code = BadRequestCode
+	case errors.Is(err, badger.ErrDBClosed), errors.Is(err, badger.ErrBlockedWrites):
+		code = UnavailableCode
+	}
+	return &ServerError{Code: code, Err: err}
+}
+
+// ErrorRecord represents JSON error response of our server
+type ErrorRecord struct {
+	Code      string `json:"code"`       // machine-readable error code
+	Status    int    `json:"status"`     // HTTP status code
+	Message   string `json:"message"`    // description of failed operation
+	Error     string `json:"error"`      // error message
+	RequestID string `json:"request_id"` // request id
+}
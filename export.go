@@ -0,0 +1,319 @@
+package main
+
+// export module provides export and import of DB records in JSON, NDJSON
+// and CSV formats
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3/pb"
+)
+
+// namespaceSeparator separates namespace from the rest of the key, e.g.
+// users:alice key belongs to users namespace
+const namespaceSeparator = ":"
+
+// helper function to construct key prefix from given prefix and namespace
+func keyPrefix(prefix, namespace string) (string, error) {
+	if namespace == "" {
+		return prefix, nil
+	}
+	nsPrefix := namespace + namespaceSeparator
+	// both prefix and namespace are given, the prefix should be within namespace
+	if prefix != "" && !strings.HasPrefix(prefix, nsPrefix) {
+		return "", fmt.Errorf("prefix %s does not belong to namespace %s", prefix, namespace)
+	}
+	if prefix == "" {
+		return nsPrefix, nil
+	}
+	return prefix, nil
+}
+
+// recordWriter writes records in specific format
+type recordWriter interface {
+	Write(rec Record) error
+	Close() error
+}
+
+// helper function to create record writer for given format
+func newRecordWriter(w io.Writer, format string) (recordWriter, error) {
+	switch format {
+	case "", "json":
+		return &jsonRecordWriter{w: w}, nil
+	case "ndjson":
+		return &ndjsonRecordWriter{enc: json.NewEncoder(w)}, nil
+	case "csv":
+		cw := csv.NewWriter(w)
+		err := cw.Write([]string{"key", "value"})
+		return &csvRecordWriter{w: cw}, err
+	}
+	return nil, fmt.Errorf("unsupported format %s", format)
+}
+
+// helper function to return content type of given format
+func formatContentType(format string) string {
+	switch format {
+	case "ndjson":
+		return "application/x-ndjson"
+	case "csv":
+		return "text/csv"
+	}
+	return "application/json"
+}
+
+// jsonRecordWriter writes records as JSON array
+type jsonRecordWriter struct {
+	w     io.Writer
+	count int
+}
+
+// Write implements recordWriter interface
+func (j *jsonRecordWriter) Write(rec Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if j.count == 0 {
+		sep = "[\n"
+	}
+	j.count++
+	if _, err := io.WriteString(j.w, sep); err != nil {
+		return err
+	}
+	_, err = j.w.Write(data)
+	return err
+}
+
+// Close implements recordWriter interface
+func (j *jsonRecordWriter) Close() error {
+	end := "\n]\n"
+	if j.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
+
+// ndjsonRecordWriter writes records as new-line delimited JSON
+type ndjsonRecordWriter struct {
+	enc *json.Encoder
+}
+
+// Write implements recordWriter interface
+func (n *ndjsonRecordWriter) Write(rec Record) error {
+	return n.enc.Encode(rec)
+}
+
+// Close implements recordWriter interface
+func (n *ndjsonRecordWriter) Close() error {
+	return nil
+}
+
+// csvRecordWriter writes records as CSV with key,value header
+type csvRecordWriter struct {
+	w *csv.Writer
+}
+
+// Write implements recordWriter interface
+func (c *csvRecordWriter) Write(rec Record) error {
+	return c.w.Write([]string{rec.Key, rec.Value})
+}
+
+// Close implements recordWriter interface
+func (c *csvRecordWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// helper function to export DB records with given key prefix in given format,
+// if snapshot name is provided records are exported as of that snapshot
+func exportRecords(w io.Writer, format, prefix, snapshot string) (int, error) {
+	rw, err := newRecordWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	if snapshot != "" {
+		err = readSnapshot(snapshot, prefix, func(kv *pb.KV) error {
+			count++
+			return rw.Write(Record{Key: string(kv.Key), Value: string(kv.Value)})
+		})
+		if err != nil {
+			return count, err
+		}
+		return count, rw.Close()
+	}
+	err = listRecords(prefix, "", 0, func(rec Record) error {
+		count++
+		return rw.Write(rec)
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, rw.Close()
+}
+
+// helper function to read records in given format and pass them to given
+// function
+func readRecords(r io.Reader, format string, fn func(rec Record) error) error {
+	switch format {
+	case "", "json":
+		dec := json.NewDecoder(bufio.NewReader(r))
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+			return errors.New("JSON records should be provided as array")
+		}
+		for dec.More() {
+			var rec Record
+			if err := dec.Decode(&rec); err != nil {
+				return err
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+		return err
+	case "ndjson":
+		dec := json.NewDecoder(bufio.NewReader(r))
+		for {
+			var rec Record
+			err := dec.Decode(&rec)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+	case "csv":
+		cr := csv.NewReader(bufio.NewReader(r))
+		cr.FieldsPerRecord = 2
+		for line := 0; ; line++ {
+			row, err := cr.Read()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if line == 0 && row[0] == "key" && row[1] == "value" {
+				continue
+			}
+			if err := fn(Record{Key: row[0], Value: row[1]}); err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("unsupported format %s", format)
+}
+
+// ImportConflict represents imported record which conflicts with existing one
+type ImportConflict struct {
+	Key      string `json:"key"`      // record key
+	Existing string `json:"existing"` // value of existing record
+	Imported string `json:"imported"` // value of imported record
+}
+
+// ImportReport represents results of import
+type ImportReport struct {
+	Total     int              `json:"total"`     // total number of processed records
+	New       int              `json:"new"`       // number of new records
+	Unchanged int              `json:"unchanged"` // number of records which already exist in DB
+	Updated   int              `json:"updated"`   // number of records which overwrite existing ones
+	Skipped   int              `json:"skipped"`   // number of records outside of prefix/namespace
+	Conflicts []ImportConflict `json:"conflicts"` // records with values different from existing ones
+	DryRun    bool             `json:"dryRun"`    // dry-run mode
+}
+
+// number of imported records written to DB in single batch
+const importBatchSize = 1000
+
+// helper function to import records in given format into DB, the records
+// which conflict with existing entries or with previous records of the same
+// import are reported and only written if overwrite flag is set, in dry-run
+// mode nothing is written to DB
+func importRecords(r io.Reader, format, prefix string, dryRun, overwrite bool) (ImportReport, error) {
+	report := ImportReport{DryRun: dryRun, Conflicts: []ImportConflict{}}
+	if err := checkWritable(); err != nil && !dryRun {
+		return report, err
+	}
+	if err := requireStandalone("import"); err != nil {
+		return report, err
+	}
+	var batch []KVEntry
+	// values of keys after previous records of the import, they are not
+	// visible in DB until the batch is written or at all in dry-run mode
+	imported := make(map[string]string)
+	err := readRecords(r, format, func(rec Record) error {
+		report.Total++
+		if !strings.HasPrefix(rec.Key, prefix) {
+			report.Skipped++
+			return nil
+		}
+		if rec.Key == "" || isSystemKey(rec.Key) {
+			return fmt.Errorf("invalid record key '%s'", rec.Key)
+		}
+		val, exists := imported[rec.Key]
+		if !exists {
+			data, err := KV.Get([]byte(rec.Key))
+			if err != nil && err != errKeyNotFound {
+				return err
+			}
+			val, exists = string(data), err == nil
+		}
+		if exists && val == rec.Value {
+			report.Unchanged++
+			imported[rec.Key] = val
+			return nil
+		}
+		if exists {
+			conflict := ImportConflict{Key: rec.Key, Existing: val, Imported: rec.Value}
+			report.Conflicts = append(report.Conflicts, conflict)
+			if !overwrite {
+				imported[rec.Key] = val
+				return nil
+			}
+			report.Updated++
+		} else {
+			report.New++
+		}
+		imported[rec.Key] = rec.Value
+		if dryRun {
+			return nil
+		}
+		batch = append(batch, KVEntry{Key: []byte(rec.Key), Value: []byte(rec.Value)})
+		if len(batch) < importBatchSize {
+			return nil
+		}
+		err := KV.Batch(batch)
+		batch = batch[:0]
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+	if dryRun {
+		return report, nil
+	}
+	if err := KV.Batch(batch); err != nil {
+		return report, err
+	}
+	log.Printf("import total=%d new=%d updated=%d unchanged=%d conflicts=%d",
+		report.Total, report.New, report.Updated, report.Unchanged, len(report.Conflicts))
+	return report, nil
+}
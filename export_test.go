@@ -0,0 +1,112 @@
+package main
+
+// export_test module provides tests of import of records
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"strings"
+	"testing"
+)
+
+// helper function to use memory store as our KV store with given records,
+// the previous store is restored at the end of the test
+func setupMemory(t *testing.T, recs ...Record) {
+	t.Helper()
+	kv := KV
+	KV = newMemoryStore()
+	t.Cleanup(func() {
+		KV.Close()
+		KV = kv
+	})
+	for _, rec := range recs {
+		if err := KV.Set([]byte(rec.Key), []byte(rec.Value), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// records of import tests, k1 exists with different value, k2 with the same
+// value, k3 is new and k4 is imported twice with different values
+const importData = `[
+{"key":"k1","value":"new"},
+{"key":"k2","value":"v2"},
+{"key":"k3","value":"v3"},
+{"key":"k4","value":"first"},
+{"key":"k4","value":"second"},
+{"key":"k4","value":"second"}
+]`
+
+// TestImport checks import reports and records written with and without
+// overwrite and in dry-run mode
+func TestImport(t *testing.T) {
+	cases := []struct {
+		name      string
+		dryRun    bool
+		overwrite bool
+		updated   int
+		values    map[string]string
+	}{
+		{"dry-run", true, false, 0, map[string]string{"k1": "old", "k3": "", "k4": ""}},
+		{"dry-run overwrite", true, true, 2, map[string]string{"k1": "old", "k3": "", "k4": ""}},
+		{"keep", false, false, 0, map[string]string{"k1": "old", "k3": "v3", "k4": "first"}},
+		{"overwrite", false, true, 2, map[string]string{"k1": "new", "k3": "v3", "k4": "second"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setupMemory(t, Record{Key: "k1", Value: "old"}, Record{Key: "k2", Value: "v2"})
+			report, err := importRecords(strings.NewReader(importData), "json", "", c.dryRun, c.overwrite)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Total != 6 || report.New != 2 || report.Updated != c.updated {
+				t.Errorf("expect 6 total, 2 new and %d updated records, got %+v", c.updated, report)
+			}
+			// the last k4 record is unchanged if previous one overwrites
+			// the first one
+			unchanged := 1
+			if c.overwrite {
+				unchanged = 2
+			}
+			if report.Unchanged != unchanged {
+				t.Errorf("expect %d unchanged records, got %d", unchanged, report.Unchanged)
+			}
+			var conflicts []string
+			for _, conflict := range report.Conflicts {
+				conflicts = append(conflicts, conflict.Key+":"+conflict.Existing+"->"+conflict.Imported)
+			}
+			expect := "k1:old->new k4:first->second"
+			if !c.overwrite {
+				expect += " k4:first->second"
+			}
+			if got := strings.Join(conflicts, " "); got != expect {
+				t.Errorf("expect conflicts %s, got %s", expect, got)
+			}
+			for key, value := range c.values {
+				val, err := KV.Get([]byte(key))
+				if value == "" {
+					if err != errKeyNotFound {
+						t.Errorf("expect missing %s, got %q %v", key, val, err)
+					}
+					continue
+				}
+				if err != nil || string(val) != value {
+					t.Errorf("expect %s=%s, got %q %v", key, value, val, err)
+				}
+			}
+		})
+	}
+}
+
+// TestImportFormat checks that JSON import requires array of records
+func TestImportFormat(t *testing.T) {
+	setupMemory(t)
+	for _, data := range []string{`{"key":"k1","value":"v1"}`, `"k1"`} {
+		if _, err := importRecords(strings.NewReader(data), "json", "", false, false); err == nil {
+			t.Errorf("expect error of JSON import %s", data)
+		}
+	}
+	if _, err := KV.Get([]byte("k1")); err != errKeyNotFound {
+		t.Errorf("expect no records after failed import, got %v", err)
+	}
+}
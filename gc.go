@@ -0,0 +1,134 @@
+package main
+
+// gc module provides badger value log garbage collection and compaction
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// TotalGCRuns counts total number of GC runs
+var TotalGCRuns uint64
+
+// TotalGCReclaimedBytes counts total number of bytes reclaimed by GC
+var TotalGCReclaimedBytes uint64
+
+// TotalGCDuration counts total time spent in GC in nanoseconds
+var TotalGCDuration uint64
+
+// LastGCDuration keeps duration of last GC run in nanoseconds
+var LastGCDuration uint64
+
+// gcRunning is set to 1 while GC is running
+var gcRunning int32
+
+// gcMutex prevents concurrent GC runs
+var gcMutex sync.Mutex
+
+// GCResult represents results of GC run
+type GCResult struct {
+	Flatten        bool    `json:"flatten"`        // LSM tree was flattened
+	Rewrites       int     `json:"rewrites"`       // number of rewritten value log files
+	ReclaimedBytes int64   `json:"reclaimedBytes"` // number of reclaimed bytes
+	Duration       float64 `json:"duration"`       // duration of GC run in seconds
+}
+
+// helper function to calculate total size of value log files
+func vlogSize() int64 {
+	var size int64
+	dir := Config.BadgerDB
+	files, err := filepath.Glob(filepath.Join(dir, "*.vlog"))
+	if err != nil {
+		return size
+	}
+	for _, fname := range files {
+		if info, err := os.Stat(fname); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// helper function to run value log GC and optionally flatten LSM tree
+func runGC(discardRatio float64, flatten bool) (GCResult, error) {
+	if err := requireBadger("value log GC"); err != nil {
+		return GCResult{}, err
+	}
+	gcMutex.Lock()
+	defer gcMutex.Unlock()
+	atomic.StoreInt32(&gcRunning, 1)
+	defer atomic.StoreInt32(&gcRunning, 0)
+
+	result := GCResult{Flatten: flatten}
+	time0 := time.Now()
+	size0 := vlogSize()
+	if flatten {
+		if err := DB.Flatten(runtime.NumCPU()); err != nil {
+			return result, err
+		}
+	}
+	// badger recommends to call RunValueLogGC repeatedly until it
+	// does not rewrite any file
+	for {
+		err := DB.RunValueLogGC(discardRatio)
+		if errors.Is(err, badger.ErrNoRewrite) {
+			break
+		} else if err != nil {
+			return result, err
+		}
+		result.Rewrites++
+	}
+	duration := time.Since(time0)
+	if reclaimed := size0 - vlogSize(); reclaimed > 0 {
+		result.ReclaimedBytes = reclaimed
+		atomic.AddUint64(&TotalGCReclaimedBytes, uint64(reclaimed))
+	}
+	result.Duration = duration.Seconds()
+	atomic.AddUint64(&TotalGCRuns, 1)
+	atomic.AddUint64(&TotalGCDuration, uint64(duration))
+	atomic.StoreUint64(&LastGCDuration, uint64(duration))
+	return result, nil
+}
+
+// helper function to periodically run value log GC until given context is
+// cancelled
+func gcScheduler(ctx context.Context, interval string, discardRatio float64) {
+	period, err := time.ParseDuration(interval)
+	if err != nil {
+		slog.Error("unable to parse GC interval", "interval", interval, "error", err)
+		return
+	}
+	log.Printf("GC scheduler interval=%s discard ratio=%v", interval, discardRatio)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		result, err := runGC(discardRatio, false)
+		if err != nil {
+			slog.Error("value log GC failed", "error", err)
+			continue
+		}
+		level := slog.LevelDebug
+		if result.Rewrites > 0 {
+			level = slog.LevelInfo
+		}
+		slog.Log(context.Background(), level, "GC", "rewrites", result.Rewrites,
+			"reclaimed", result.ReclaimedBytes, "duration", result.Duration)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+// grpc module provides gRPC API of our server, it shares store logic, auth,
+// rate limiting and metrics with HTTP API
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/vkuznet/cmskv/cmskvpb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcCodes maps error codes of our server to gRPC codes
+var grpcCodes = map[string]codes.Code{
+	BadRequestCode:      codes.InvalidArgument,
+	UnauthorizedCode:    codes.Unauthenticated,
+	NotFoundCode:        codes.NotFound,
+	ConflictCode:        codes.Aborted,
+	RequestTooLargeCode: codes.ResourceExhausted,
+	RateLimitedCode:     codes.ResourceExhausted,
+	InternalCode:        codes.Internal,
+	ReadOnlyCode:        codes.FailedPrecondition,
+	UnavailableCode:     codes.Unavailable,
+	HistoryGoneCode:     codes.OutOfRange,
+}
+
+// grpcMethod is used as HTTP method label of gRPC calls in our metrics
+const grpcMethod = "GRPC"
+
+// kvServer implements cmskv gRPC service
+type kvServer struct {
+	pb.UnimplementedKVServer
+	limit bool // apply rate limit to every record of bulk calls
+}
+
+// helper function to check rate limit of individual record of bulk call
+func (s *kvServer) limitRecord(ctx context.Context) error {
+	if !s.limit {
+		return nil
+	}
+	return grpcLimit(ctx)
+}
+
+// Store implements KV service Store method
+func (s *kvServer) Store(ctx context.Context, req *pb.StoreRequest) (*pb.StoreResponse, error) {
+	rec := HTTPRecord{Sha: req.GetSha(), Record: Record{Key: req.GetKey(), Value: req.GetValue()}}
+	if err := storeRecord(ctx, &rec); err != nil {
+		return nil, fmt.Errorf("unable to store key-value pair: %w", err)
+	}
+	return &pb.StoreResponse{Key: rec.Key, Value: rec.Value, Sha: rec.Sha}, nil
+}
+
+// helper function to prepare read of clustered node according to read
+// consistency provided in consistency metadata of gRPC call
+func grpcConsistentRead(ctx context.Context) error {
+	return consistentRead(ctx, metadataValue(ctx, "consistency"))
+}
+
+// Fetch implements KV service Fetch method
+func (s *kvServer) Fetch(ctx context.Context, req *pb.FetchRequest) (*pb.Record, error) {
+	if err := grpcConsistentRead(ctx); err != nil {
+		return nil, err
+	}
+	rec, err := fetchRecord(ctx, req.GetKey())
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch key value: %w", err)
+	}
+	return &pb.Record{Key: rec.Key, Value: rec.Value}, nil
+}
+
+// BulkStore implements KV service BulkStore method, every record of the
+// stream is subject to rate limit
+func (s *kvServer) BulkStore(stream pb.KV_BulkStoreServer) error {
+	var count uint64
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&pb.BulkStoreResponse{Count: count})
+		} else if err != nil {
+			return err
+		}
+		if err := s.limitRecord(stream.Context()); err != nil {
+			return err
+		}
+		rec := HTTPRecord{Sha: req.GetSha(), Record: Record{Key: req.GetKey(), Value: req.GetValue()}}
+		if err := storeRecord(stream.Context(), &rec); err != nil {
+			return fmt.Errorf("unable to store key-value pair %d: %w", count+1, err)
+		}
+		count++
+	}
+}
+
+// BulkFetch implements KV service BulkFetch method, every key of the call
+// is subject to rate limit
+func (s *kvServer) BulkFetch(ctx context.Context, req *pb.BulkFetchRequest) (*pb.BulkFetchResponse, error) {
+	if err := grpcConsistentRead(ctx); err != nil {
+		return nil, err
+	}
+	resp := &pb.BulkFetchResponse{}
+	for i, key := range req.GetKeys() {
+		// the call itself is already counted by the interceptor
+		if i > 0 {
+			if err := s.limitRecord(ctx); err != nil {
+				return nil, err
+			}
+		}
+		rec, err := fetchRecord(ctx, key)
+		if errors.Is(err, errKeyNotFound) {
+			resp.Missing = append(resp.Missing, key)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to fetch key value: %w", err)
+		}
+		resp.Records = append(resp.Records, &pb.Record{Key: rec.Key, Value: rec.Value})
+	}
+	return resp, nil
+}
+
+// Delete implements KV service Delete method
+func (s *kvServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.Record, error) {
+	// records are deleted via admin end-point of HTTP API, therefore delete
+	// always requires authentication
+	if !grpcAuthenticated(ctx) {
+		return nil, errUnauthorized
+	}
+	rec, err := deleteRecord(ctx, req.GetKey())
+	if err != nil {
+		return nil, fmt.Errorf("unable to delete key value: %w", err)
+	}
+	return &pb.Record{Key: rec.Key, Value: rec.Value}, nil
+}
+
+// List implements KV service List method
+func (s *kvServer) List(req *pb.ListRequest, stream pb.KV_ListServer) error {
+	// listing exposes all DB records like export end-point, therefore it
+	// always requires authentication
+	if !grpcAuthenticated(stream.Context()) {
+		return errUnauthorized
+	}
+	if err := grpcConsistentRead(stream.Context()); err != nil {
+		return err
+	}
+	prefix, err := keyPrefix(req.GetPrefix(), req.GetNamespace())
+	if err != nil {
+		return badRequest(err)
+	}
+	return listRecords(prefix, req.GetStartAfter(), int(req.GetLimit()), func(rec Record) error {
+		return stream.Send(&pb.Record{Key: rec.Key, Value: rec.Value})
+	})
+}
+
+// Changes implements KV service Changes method
+func (s *kvServer) Changes(req *pb.ChangesRequest, stream pb.KV_ChangesServer) error {
+	// change stream exposes all DB records, therefore it always requires
+	// authentication like admin end-points
+	if !grpcAuthenticated(stream.Context()) {
+		return errUnauthorized
+	}
+	ctx, cancel := streamContext(stream.Context())
+	defer cancel()
+	return streamChanges(ctx, req.GetPrefixes(), req.GetSince(), func(events []ChangeEvent) error {
+		for _, ev := range events {
+			err := stream.Send(&pb.ChangeEvent{
+				Key:       ev.Key,
+				Value:     ev.Value,
+				Version:   ev.Version,
+				ExpiresAt: ev.ExpiresAt,
+				Deleted:   ev.Deleted,
+				Time:      ev.Time,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// helper function to return first value of given metadata key
+func metadataValue(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if vals := md.Get(key); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+// helper function to return peer address of gRPC call
+func grpcPeer(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// helper function to check if gRPC call is authenticated, we accept either
+// verified client certificate or bearer token
+func grpcAuthenticated(ctx context.Context) bool {
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			return true
+		}
+	}
+	token, ok := strings.CutPrefix(metadataValue(ctx, "authorization"), "Bearer ")
+	return ok && validToken(strings.TrimSpace(token))
+}
+
+// helper function to check rate limit of gRPC call, the limit is applied
+// per client IP address
+func grpcLimit(ctx context.Context) error {
+	ip := grpcPeer(ctx)
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	lctx, err := rateLimiter.Get(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if lctx.Reached {
+		return errRateLimited
+	}
+	return nil
+}
+
+// grpcInterceptor applies request ids, tracing, optional middlewares,
+// metrics and access logs to gRPC calls
+type grpcInterceptor struct {
+	middlewares []string
+}
+
+// helper function to handle gRPC call with given method
+func (g grpcInterceptor) handle(ctx context.Context, method string, call func(context.Context) error) error {
+	atomic.AddInt64(&InFlightRequests, 1)
+	defer atomic.AddInt64(&InFlightRequests, -1)
+	start := time.Now()
+
+	rid := metadataValue(ctx, "x-request-id")
+	if !validRequestID(rid) {
+		rid = newRequestID()
+	}
+	ctx = context.WithValue(ctx, requestIDKey{}, rid)
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", rid))
+
+	// gRPC metadata keys are lower-case, therefore we use map carrier
+	carrier := propagation.MapCarrier{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, vals := range md {
+		if len(vals) > 0 {
+			carrier[key] = vals[0]
+		}
+	}
+	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+	ctx, span := tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.method", method),
+			attribute.String("net.peer.addr", grpcPeer(ctx)),
+		))
+
+	var err error
+	for _, name := range g.middlewares {
+		switch name {
+		case "auth":
+			if !grpcAuthenticated(ctx) {
+				err = errUnauthorized
+			}
+		case "limit":
+			err = grpcLimit(ctx)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = call(ctx)
+	}
+
+	code := http.StatusOK
+	if err != nil {
+		serr := serverError(err)
+		code = serr.Status()
+		spanError(span, err)
+		if code >= http.StatusInternalServerError {
+			slog.ErrorContext(ctx, method, "code", serr.Code, "error", err)
+		} else {
+			slog.WarnContext(ctx, method, "code", serr.Code, "error", err)
+		}
+		grpc.SetTrailer(ctx, metadata.Pairs("x-error-code", serr.Code))
+		err = status.Error(grpcCodes[serr.Code], err.Error())
+	}
+	endRequestSpan(span, code)
+	duration := time.Since(start)
+	observeRequest(method, grpcMethod, code, duration)
+	observeRate(method, start)
+	grpcAccessLog(ctx, method, code, duration)
+	return err
+}
+
+// unary implements grpc.UnaryServerInterceptor
+func (g grpcInterceptor) unary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	var resp any
+	err := g.handle(ctx, info.FullMethod, func(ctx context.Context) error {
+		var err error
+		resp, err = handler(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+// grpcStream wraps grpc.ServerStream to provide our context
+type grpcStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context implements grpc.ServerStream interface
+func (s grpcStream) Context() context.Context {
+	return s.ctx
+}
+
+// stream implements grpc.StreamServerInterceptor
+func (g grpcInterceptor) stream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return g.handle(ss.Context(), info.FullMethod, func(ctx context.Context) error {
+		return handler(srv, grpcStream{ServerStream: ss, ctx: ctx})
+	})
+}
+
+// helper function to write access log record of gRPC call
+func grpcAccessLog(ctx context.Context, method string, code int, duration time.Duration) {
+	if Config.LogFormat != "json" {
+		msg := fmt.Sprintf("%v %s %s %v", code, grpcMethod, method, duration)
+		if rid := requestID(ctx); rid != "" {
+			msg += " request_id=" + rid
+		}
+		log.Println(msg)
+		return
+	}
+	// request and trace ids are added by context log handler
+	slog.LogAttrs(ctx, slog.LevelInfo, "request",
+		slog.String("remote_addr", grpcPeer(ctx)),
+		slog.String("method", grpcMethod),
+		slog.String("path", method),
+		slog.String("route", method),
+		slog.Int("status", code),
+		slog.Float64("duration", duration.Seconds()))
+}
+
+// grpcServer wraps grpc.Server to implement stoppable interface
+type grpcServer struct {
+	*grpc.Server
+}
+
+// Shutdown gracefully stops gRPC server within given context
+func (s grpcServer) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops gRPC server immediately
+func (s grpcServer) Close() error {
+	s.Stop()
+	return nil
+}
+
+// helper function to start gRPC server with given listener configuration
+func startGRPC(lc ListenerConfig) (stoppable, error) {
+	if lc.Network == "" {
+		lc.Network = "tcp"
+	}
+	if lc.Middlewares == nil {
+		lc.Middlewares = defaultMiddlewares()
+	}
+	ln, err := listen(lc)
+	if err != nil {
+		return nil, err
+	}
+	interceptor := grpcInterceptor{middlewares: lc.Middlewares}
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(interceptor.unary),
+		grpc.ChainStreamInterceptor(interceptor.stream),
+	}
+	if Config.MaxBodySize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(int(Config.MaxBodySize)))
+	}
+	if lc.ServerCert != "" {
+		tlsConfig, err := lc.tlsConfig()
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	srv := grpc.NewServer(opts...)
+	pb.RegisterKVServer(srv, &kvServer{limit: hasMiddleware(lc.Middlewares, "limit")})
+	go func() {
+		log.Printf("Starting gRPC server on %s", lc)
+		if err := srv.Serve(ln); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return grpcServer{Server: srv}, nil
+}
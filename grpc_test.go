@@ -0,0 +1,111 @@
+package main
+
+// grpc_test module provides tests of gRPC API
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	pb "github.com/vkuznet/cmskv/cmskvpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// helper function to start gRPC server with given middlewares on in-memory
+// listener and return its client
+func setupGRPC(t *testing.T, middlewares []string) pb.KVClient {
+	t.Helper()
+	interceptor := grpcInterceptor{middlewares: middlewares}
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(interceptor.unary),
+		grpc.ChainStreamInterceptor(interceptor.stream))
+	pb.RegisterKVServer(srv, &kvServer{limit: hasMiddleware(middlewares, "limit")})
+	ln := bufconn.Listen(1 << 20)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewKVClient(conn)
+}
+
+// helper function to set auth tokens of the server, the previous tokens
+// are restored at the end of the test
+func setupTokens(t *testing.T, tokens ...string) {
+	t.Helper()
+	prev := authTokens
+	authTokens = tokens
+	t.Cleanup(func() { authTokens = prev })
+}
+
+// helper function to list all records via gRPC client
+func grpcList(ctx context.Context, client pb.KVClient) ([]string, error) {
+	stream, err := client.List(ctx, &pb.ListRequest{})
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for {
+		rec, err := stream.Recv()
+		if err == io.EOF {
+			return keys, nil
+		} else if err != nil {
+			return keys, err
+		}
+		keys = append(keys, rec.GetKey())
+	}
+}
+
+// TestGRPCAuth checks that Delete and List methods require authentication
+// even if listener does not use auth middleware
+func TestGRPCAuth(t *testing.T) {
+	setupMemory(t)
+	setupTokens(t, "secret")
+	client := setupGRPC(t, nil)
+	ctx := context.Background()
+	if _, err := client.Store(ctx, &pb.StoreRequest{Key: "k1", Value: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := client.Fetch(ctx, &pb.FetchRequest{Key: "k1"}); err != nil || rec.GetValue() != "v1" {
+		t.Fatalf("expect fetch of k1 without authentication, got %v %v", rec, err)
+	}
+
+	// unauthenticated and wrong token clients
+	for _, token := range []string{"", "wrong"} {
+		ctx := ctx
+		if token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+		}
+		if _, err := client.Delete(ctx, &pb.DeleteRequest{Key: "k1"}); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("token %q: expect unauthenticated delete, got %v", token, err)
+		}
+		if _, err := grpcList(ctx, client); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("token %q: expect unauthenticated list, got %v", token, err)
+		}
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	if keys, err := grpcList(ctx, client); err != nil || len(keys) != 2 {
+		t.Fatalf("expect list of k1 and its reverse record, got %v %v", keys, err)
+	}
+	if rec, err := client.Delete(ctx, &pb.DeleteRequest{Key: "k1"}); err != nil || rec.GetValue() != "v1" {
+		t.Fatalf("expect delete of k1, got %v %v", rec, err)
+	}
+	if _, err := client.Fetch(ctx, &pb.FetchRequest{Key: "k1"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expect deleted k1, got %v", err)
+	}
+}
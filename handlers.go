@@ -1,19 +1,14 @@
 package main
 
 import (
-	"crypto/sha1"
-	"crypto/sha256"
-	"crypto/sha512"
 	_ "embed"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"hash"
 	"log"
+	"log/slog"
 	"net/http"
-	"strings"
 
-	badger "github.com/dgraph-io/badger/v3"
 	"github.com/gorilla/mux"
 )
 
@@ -29,88 +24,70 @@ type HTTPRecord struct {
 	Record
 }
 
-// helper function to handle http server errors
+// helper function to handle http server errors, client errors are logged
+// as warnings while server errors are logged as errors
 func handleError(w http.ResponseWriter, r *http.Request, msg string, err error) {
-	log.Println(msg, err)
-	rec := make(map[string]string)
-	rec["message"] = msg
-	rec["error"] = fmt.Sprintf("%v", err)
+	if errors.Is(err, errReplicaWrite) {
+		slog.InfoContext(r.Context(), "redirect write request to primary", "primary", Config.Replica.Primary)
+		http.Redirect(w, r, primaryURL(r), http.StatusTemporaryRedirect)
+		return
+	}
+	serr := serverError(err)
+	status := serr.Status()
+	if status >= http.StatusInternalServerError {
+		slog.ErrorContext(r.Context(), msg, "code", serr.Code, "error", err)
+	} else {
+		slog.WarnContext(r.Context(), msg, "code", serr.Code, "error", err)
+	}
+	rec := ErrorRecord{
+		Code:      serr.Code,
+		Status:    status,
+		Message:   msg,
+		Error:     fmt.Sprintf("%v", err),
+		RequestID: requestID(r.Context()),
+	}
 	data, e := json.Marshal(rec)
 	if e != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(data)
 }
 
 // StoreHandler stores given key value pair in DB
 func StoreHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	var rec HTTPRecord
-	err := json.NewDecoder(r.Body).Decode(&rec)
-	if err != nil {
-		msg := "unable to marshal server settings"
-		handleError(w, r, msg, err)
+	if Config.ReadOnly {
+		msg := "unable to store key-value pair"
+		handleError(w, r, msg, errReadOnly)
 		return
 	}
-
-	// create hash value for given key
-	var h hash.Hash
-	sha := strings.ToLower(Config.SHA)
-	if sha == "sha256" || rec.Sha == "sha256" {
-		h = sha256.New()
-		rec.Sha = "sha256"
-	} else if sha == "sha512" || rec.Sha == "sha512" {
-		h = sha512.New()
-		rec.Sha = "sha512"
-	} else {
-		h = sha1.New()
-		rec.Sha = "sha1"
-	}
-	h.Write([]byte(rec.Key))
-	// if record value is not provided we'll create a hash for it
-	// this will allow to anonimise the data
-	if rec.Value == "" {
-		rec.Value = hex.EncodeToString(h.Sum(nil))
-	}
-
-	// commit new key-value records into our store
-	txn := DB.NewTransaction(true)
-	defer txn.Discard()
-	err = txn.Set([]byte(rec.Key), []byte(rec.Value))
-	if err != nil {
-		msg := "unable to set new key-value pair"
-		handleError(w, r, msg, err)
-	}
-	err = txn.Commit()
-	if err != nil {
-		msg := "unable to commit new key-value pair"
-		handleError(w, r, msg, err)
-	}
-	if Config.Verbose > 0 {
-		log.Printf("record key=%s value=%s", rec.Key, rec.Value)
+	if forwardToLeader(w, r) {
+		return
 	}
-
-	txn = DB.NewTransaction(true)
-	defer txn.Discard()
-	err = txn.Set([]byte(rec.Value), []byte(rec.Key))
+	var rec HTTPRecord
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "decode")
+	err := json.NewDecoder(r.Body).Decode(&rec)
+	spanError(span, err)
+	span.End()
 	if err != nil {
-		msg := "unable to set new key-value pair"
+		msg := "unable to decode record"
 		handleError(w, r, msg, err)
+		return
 	}
-	err = txn.Commit()
-	if err != nil {
-		msg := "unable to commit new key-value pair"
+	if err := storeRecord(ctx, &rec); err != nil {
+		msg := "unable to store key-value pair"
 		handleError(w, r, msg, err)
-	}
-	if Config.Verbose > 0 {
-		log.Printf("record key=%s value=%s", rec.Value, rec.Key)
+		return
 	}
 	data, err := json.Marshal(rec)
 	if err != nil {
 		msg := "unable to marshal record"
 		handleError(w, r, msg, err)
+		return
 	}
 	w.Write(data)
 }
@@ -129,26 +106,43 @@ func InfoHandler(w http.ResponseWriter, r *http.Request) {
 
 // FetchHandler fetches key-value pair from DB
 func FetchHandler(w http.ResponseWriter, r *http.Request) {
+	if clusterRead(w, r) {
+		return
+	}
 	vars := mux.Vars(r)
-	err := DB.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(vars["key"]))
-		if err != nil {
-			return err
-		}
-		val, _ := item.ValueCopy(nil)
-		rec := Record{Key: vars["key"], Value: string(val)}
-		data, err := json.Marshal(rec)
-		if err != nil {
-			return err
-		}
-		w.Write(data)
-		return nil
-	})
+	rec, err := fetchRecord(r.Context(), vars["key"])
 	if err != nil {
 		msg := "unable to fetch key value"
 		handleError(w, r, msg, err)
 		return
 	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		msg := "unable to marshal record"
+		handleError(w, r, msg, err)
+		return
+	}
+	w.Write(data)
+}
+
+// MetricsHandler provides server metrics in prometheus format
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(promMetrics()))
+}
+
+// StatusHandler provides server metrics in JSON format
+func StatusHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(metrics())
+	if err != nil {
+		msg := "unable to marshal metrics"
+		handleError(w, r, msg, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
 }
 
 var (
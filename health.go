@@ -0,0 +1,200 @@
+package main
+
+// health module provides liveness and readiness checks of our server
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shirou/gopsutil/disk"
+)
+
+// canaryKey defines reserved key used by readiness read/write check
+const canaryKey = systemPrefix + "canary"
+
+// status values of health checks
+const (
+	statusOK       = "ok"
+	statusDegraded = "degraded"
+	statusFail     = "fail"
+)
+
+// HealthCheck represents result of individual health check
+type HealthCheck struct {
+	Name     string  `json:"name"`              // check name
+	Status   string  `json:"status"`            // check status: ok, degraded or fail
+	Message  string  `json:"message,omitempty"` // check details
+	Duration float64 `json:"duration"`          // check duration in seconds
+}
+
+// HealthStatus represents overall health status of the server
+type HealthStatus struct {
+	Status string        `json:"status"`           // overall status: ok, degraded or fail
+	Uptime float64       `json:"uptime"`           // server uptime in seconds
+	Checks []HealthCheck `json:"checks,omitempty"` // individual checks
+}
+
+// helper function to perform given check and measure its duration
+func runCheck(name string, check func() (string, string)) HealthCheck {
+	time0 := time.Now()
+	status, msg := check()
+	return HealthCheck{Name: name, Status: status, Message: msg, Duration: time.Since(time0).Seconds()}
+}
+
+// helper function to check that DB is open
+func checkDB() (string, string) {
+	if KV == nil || (DB != nil && DB.IsClosed()) {
+		return statusFail, "DB is closed"
+	}
+	if Config.ReadOnly {
+		return statusDegraded, "DB is in read-only mode"
+	}
+	return statusOK, ""
+}
+
+// canaryInterval defines how often canary key is written, readiness probes
+// within the interval report result of the last write
+const canaryInterval = 30 * time.Second
+
+// canaryResult holds result of the last canary write
+var canaryResult struct {
+	sync.Mutex
+	time   time.Time
+	status string
+	msg    string
+}
+
+// helper function to perform read/write canary check, in read-only mode
+// only read check is performed, the write check is performed at most once
+// per canaryInterval to not produce new key versions on every probe
+func checkCanary() (string, string) {
+	if KV == nil || (DB != nil && DB.IsClosed()) {
+		return statusFail, "DB is closed"
+	}
+	if Config.ReadOnly {
+		_, err := KV.Get([]byte(canaryKey))
+		if err != nil && !errors.Is(err, errKeyNotFound) {
+			return statusFail, fmt.Sprintf("unable to read canary key: %v", err)
+		}
+		return statusOK, "read check only"
+	}
+	canaryResult.Lock()
+	defer canaryResult.Unlock()
+	if time.Since(canaryResult.time) < canaryInterval {
+		return canaryResult.status, canaryResult.msg
+	}
+	status, msg := writeCanary()
+	canaryResult.time = time.Now()
+	canaryResult.status, canaryResult.msg = status, msg
+	return status, msg
+}
+
+// helper function to write canary key and read it back
+func writeCanary() (string, string) {
+	val := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	if err := KV.Set([]byte(canaryKey), val, 0); err != nil {
+		return statusFail, fmt.Sprintf("unable to write canary key: %v", err)
+	}
+	data, err := KV.Get([]byte(canaryKey))
+	if err != nil {
+		return statusFail, fmt.Sprintf("unable to read canary key: %v", err)
+	}
+	if string(data) != string(val) {
+		return statusFail, "canary value mismatch"
+	}
+	return statusOK, ""
+}
+
+// helper function to check free disk space of DB area
+func checkDisk() (string, string) {
+	if Config.Engine == "memory" {
+		return statusOK, "memory engine does not use disk"
+	}
+	usage, err := disk.Usage(Config.BadgerDB)
+	if err != nil {
+		return statusFail, fmt.Sprintf("unable to get disk usage: %v", err)
+	}
+	msg := fmt.Sprintf("free %d bytes (%.1f%% used)", usage.Free, usage.UsedPercent)
+	// zero min_disk_free disables the check
+	if usage.Free < Config.MinDiskFree {
+		return statusFail, msg
+	}
+	return statusOK, msg
+}
+
+// helper function to check if value log GC is running
+func checkGC() (string, string) {
+	if atomic.LoadInt32(&gcRunning) == 1 {
+		return statusDegraded, "value log GC is running"
+	}
+	return statusOK, ""
+}
+
+// helper function to check if server is shutting down
+func checkShutdown() (string, string) {
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		return statusFail, "server is shutting down"
+	}
+	return statusOK, ""
+}
+
+// helper function to write health status, the failed status is reported
+// with 503 HTTP code
+func writeHealth(w http.ResponseWriter, health HealthStatus) {
+	code := http.StatusOK
+	if health.Status == statusFail {
+		code = http.StatusServiceUnavailable
+	}
+	data, err := json.Marshal(health)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// HealthzHandler reports that server process is alive
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	health := HealthStatus{Status: statusOK, Uptime: time.Since(StartTime).Seconds()}
+	writeHealth(w, health)
+}
+
+// ReadyzHandler reports if server is ready to serve requests
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	health := HealthStatus{Status: statusOK, Uptime: time.Since(StartTime).Seconds()}
+	health.Checks = []HealthCheck{
+		runCheck("db", checkDB),
+		runCheck("canary", checkCanary),
+		runCheck("disk", checkDisk),
+		runCheck("gc", checkGC),
+		runCheck("shutdown", checkShutdown),
+	}
+	if isReplica() {
+		health.Checks = append(health.Checks, runCheck("replication", checkReplication))
+	}
+	if isClustered() {
+		health.Checks = append(health.Checks, runCheck("cluster", checkCluster))
+	}
+	if isRouter() {
+		health.Checks = append(health.Checks, runCheck("shards", checkShards))
+	}
+	for _, check := range health.Checks {
+		if check.Status == statusFail {
+			health.Status = statusFail
+			break
+		}
+		if check.Status == statusDegraded {
+			health.Status = statusDegraded
+		}
+	}
+	writeHealth(w, health)
+}
@@ -0,0 +1,171 @@
+package main
+
+// httpmetrics module provides HTTP request metrics: latency histograms per
+// route, counters per method and status code and in-flight requests gauge
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// latencyBuckets defines upper bounds (in seconds) of latency histogram buckets
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// InFlightRequests represents number of requests currently served by the server
+var InFlightRequests int64
+
+// routeHistograms keeps latency histogram per route template
+var routeHistograms sync.Map
+
+// requestCounters keeps request counter per method and status code
+var requestCounters sync.Map
+
+// histogram represents latency histogram, all fields are updated atomically
+type histogram struct {
+	buckets []uint64 // non-cumulative counts per bucket, last one is +Inf bucket
+	count   uint64   // total number of observations
+	sum     uint64   // sum of observations in nanoseconds
+}
+
+// helper function to create new histogram
+func newHistogram() *histogram {
+	return &histogram{buckets: make([]uint64, len(latencyBuckets)+1)}
+}
+
+// observe adds given duration to histogram
+func (h *histogram) observe(d time.Duration) {
+	idx := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+	atomic.AddUint64(&h.buckets[idx], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+// requestKey represents key of request counters
+type requestKey struct {
+	Method string
+	Status int
+}
+
+// RequestCounter represents number of requests with given method and status code
+type RequestCounter struct {
+	Method string `json:"method"` // HTTP method
+	Status int    `json:"status"` // HTTP status code
+	Count  uint64 `json:"count"`  // number of requests
+}
+
+// RouteLatency represents latency histogram of given route
+type RouteLatency struct {
+	Route   string    `json:"route"`   // route template
+	Buckets []float64 `json:"buckets"` // upper bounds of histogram buckets in seconds
+	Counts  []uint64  `json:"counts"`  // cumulative counts of histogram buckets
+	Count   uint64    `json:"count"`   // total number of requests
+	Sum     float64   `json:"sum"`     // total latency in seconds
+}
+
+// helper function to get route template of given HTTP request
+func routeName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "other"
+}
+
+// helper function to record metrics of HTTP request
+func observeRequest(route, method string, status int, d time.Duration) {
+	val, ok := routeHistograms.Load(route)
+	if !ok {
+		val, _ = routeHistograms.LoadOrStore(route, newHistogram())
+	}
+	val.(*histogram).observe(d)
+
+	key := requestKey{Method: method, Status: status}
+	cnt, ok := requestCounters.Load(key)
+	if !ok {
+		var zero uint64
+		cnt, _ = requestCounters.LoadOrStore(key, &zero)
+	}
+	atomic.AddUint64(cnt.(*uint64), 1)
+}
+
+// helper function to get request counters sorted by method and status code
+func requestCounts() []RequestCounter {
+	var out []RequestCounter
+	requestCounters.Range(func(k, v interface{}) bool {
+		key := k.(requestKey)
+		cnt := atomic.LoadUint64(v.(*uint64))
+		out = append(out, RequestCounter{Method: key.Method, Status: key.Status, Count: cnt})
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Method == out[j].Method {
+			return out[i].Status < out[j].Status
+		}
+		return out[i].Method < out[j].Method
+	})
+	return out
+}
+
+// helper function to get latency histograms sorted by route
+func routeLatencies() []RouteLatency {
+	var out []RouteLatency
+	routeHistograms.Range(func(k, v interface{}) bool {
+		h := v.(*histogram)
+		rec := RouteLatency{Route: k.(string), Buckets: latencyBuckets}
+		var total uint64
+		for i := range latencyBuckets {
+			total += atomic.LoadUint64(&h.buckets[i])
+			rec.Counts = append(rec.Counts, total)
+		}
+		rec.Count = atomic.LoadUint64(&h.count)
+		rec.Sum = time.Duration(atomic.LoadUint64(&h.sum)).Seconds()
+		out = append(out, rec)
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Route < out[j].Route
+	})
+	return out
+}
+
+// labelEscaper escapes prometheus label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// helper function to generate HTTP metrics in prometheus format
+func promHTTPMetrics(prefix string, data Metrics) string {
+	var out string
+
+	out += fmt.Sprintf("# HELP %s_http_requests_total reports total number of HTTP requests by method and status code\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_http_requests_total counter\n", prefix)
+	for _, rec := range data.Requests {
+		out += fmt.Sprintf("%s_http_requests_total{method=\"%s\",code=\"%d\"} %v\n", prefix, rec.Method, rec.Status, rec.Count)
+	}
+
+	out += fmt.Sprintf("# HELP %s_http_requests_in_flight reports number of HTTP requests currently served\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_http_requests_in_flight gauge\n", prefix)
+	out += fmt.Sprintf("%s_http_requests_in_flight %v\n", prefix, data.InFlight)
+
+	name := fmt.Sprintf("%s_http_request_duration_seconds", prefix)
+	out += fmt.Sprintf("# HELP %s reports latency of HTTP requests per route\n", name)
+	out += fmt.Sprintf("# TYPE %s histogram\n", name)
+	for _, rec := range data.Latency {
+		route := labelEscaper.Replace(rec.Route)
+		for i, le := range rec.Buckets {
+			out += fmt.Sprintf("%s_bucket{route=\"%s\",le=\"%v\"} %v\n", name, route, le, rec.Counts[i])
+		}
+		out += fmt.Sprintf("%s_bucket{route=\"%s\",le=\"+Inf\"} %v\n", name, route, rec.Count)
+		out += fmt.Sprintf("%s_sum{route=\"%s\"} %v\n", name, route, rec.Sum)
+		out += fmt.Sprintf("%s_count{route=\"%s\"} %v\n", name, route, rec.Count)
+	}
+	return out
+}
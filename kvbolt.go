@@ -0,0 +1,246 @@
+package main
+
+// kvbolt module provides bbolt implementation of key-value store, the data
+// is kept in single file within DB directory
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// name of bbolt file within DB directory and bucket of our records
+const (
+	boltFile   = "cmskv.bolt"
+	boltBucket = "kv"
+)
+
+// bbolt does not support expiration of keys, therefore every value is
+// prefixed with its expiration time (unix nanoseconds, zero means no
+// expiration) and expired keys are skipped and purged on startup
+
+// helper function to encode value with given ttl
+func boltValue(value []byte, ttl time.Duration) []byte {
+	buf := make([]byte, 8+len(value))
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(buf, uint64(time.Now().Add(ttl).UnixNano()))
+	}
+	copy(buf[8:], value)
+	return buf
+}
+
+// helper function to decode stored value, it returns false if value is
+// expired or malformed
+func boltDecode(data []byte, now time.Time) ([]byte, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+	if exp := binary.BigEndian.Uint64(data); exp > 0 && now.UnixNano() > int64(exp) {
+		return nil, false
+	}
+	return bytes.Clone(data[8:]), true
+}
+
+// boltStore implements KVStore interface using bbolt DB
+type boltStore struct {
+	db *bolt.DB
+}
+
+// helper function to open bbolt store in given directory, in read-only
+// mode the store file should already exist
+func openBoltStore(dir string) (*boltStore, error) {
+	if !Config.ReadOnly {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	fname := filepath.Join(dir, boltFile)
+	opts := &bolt.Options{Timeout: 5 * time.Second, ReadOnly: Config.ReadOnly}
+	db, err := bolt.Open(fname, 0600, opts)
+	if err != nil {
+		return nil, err
+	}
+	s := &boltStore{db: db}
+	if Config.ReadOnly {
+		return s, nil
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(boltBucket))
+		return err
+	})
+	if err == nil {
+		err = s.purgeExpired()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	log.Printf("bbolt DB %s", fname)
+	return s, nil
+}
+
+// helper function to remove expired keys
+func (s *boltStore) purgeExpired() error {
+	var purged int
+	now := time.Now()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(boltBucket))
+		var expired [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			if _, ok := boltDecode(v, now); !ok {
+				expired = append(expired, bytes.Clone(k))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		purged = len(expired)
+		return nil
+	})
+	if purged > 0 {
+		log.Printf("bbolt DB purged %d expired keys", purged)
+	}
+	return err
+}
+
+// helper function to map bbolt errors to errors of our store
+func boltError(err error) error {
+	if errors.Is(err, bolt.ErrDatabaseNotOpen) {
+		return errStoreClosed
+	}
+	return err
+}
+
+// boltTxn implements KVTxn interface using bbolt transaction
+type boltTxn struct {
+	bucket *bolt.Bucket
+	update bool
+}
+
+// Get implements KVTxn interface
+func (t boltTxn) Get(key []byte) ([]byte, error) {
+	if t.bucket == nil {
+		return nil, errKeyNotFound
+	}
+	val, ok := boltDecode(t.bucket.Get(key), time.Now())
+	if !ok {
+		return nil, errKeyNotFound
+	}
+	return val, nil
+}
+
+// Set implements KVTxn interface
+func (t boltTxn) Set(key, value []byte, ttl time.Duration) error {
+	if !t.update {
+		return errReadOnlyTxn
+	}
+	return t.bucket.Put(key, boltValue(value, ttl))
+}
+
+// Delete implements KVTxn interface
+func (t boltTxn) Delete(key []byte) error {
+	if !t.update {
+		return errReadOnlyTxn
+	}
+	return t.bucket.Delete(key)
+}
+
+// Get implements KVStore interface
+func (s *boltStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.Txn(false, func(txn KVTxn) error {
+		var err error
+		val, err = txn.Get(key)
+		return err
+	})
+	return val, err
+}
+
+// Set implements KVStore interface
+func (s *boltStore) Set(key, value []byte, ttl time.Duration) error {
+	return s.Txn(true, func(txn KVTxn) error {
+		return txn.Set(key, value, ttl)
+	})
+}
+
+// Delete implements KVStore interface
+func (s *boltStore) Delete(key []byte) error {
+	return s.Txn(true, func(txn KVTxn) error {
+		return txn.Delete(key)
+	})
+}
+
+// Batch implements KVStore interface, bbolt batch is atomic
+func (s *boltStore) Batch(entries []KVEntry) error {
+	return s.Txn(true, func(txn KVTxn) error {
+		for _, e := range entries {
+			var err error
+			if e.Delete {
+				err = txn.Delete(e.Key)
+			} else {
+				err = txn.Set(e.Key, e.Value, e.TTL)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Iterate implements KVStore interface
+func (s *boltStore) Iterate(prefix, after []byte, fn func(key, value []byte) error) error {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(boltBucket))
+		if bucket == nil {
+			return nil
+		}
+		now := time.Now()
+		c := bucket.Cursor()
+		for k, v := c.Seek(iterationStart(prefix, after)); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if len(after) > 0 && bytes.Equal(k, after) {
+				continue
+			}
+			val, ok := boltDecode(v, now)
+			if !ok {
+				continue
+			}
+			if err := fn(bytes.Clone(k), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errStopIteration) {
+		return nil
+	}
+	return boltError(err)
+}
+
+// Txn implements KVStore interface
+func (s *boltStore) Txn(update bool, fn func(txn KVTxn) error) error {
+	if update {
+		return boltError(s.db.Update(func(tx *bolt.Tx) error {
+			return fn(boltTxn{bucket: tx.Bucket([]byte(boltBucket)), update: true})
+		}))
+	}
+	return boltError(s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTxn{bucket: tx.Bucket([]byte(boltBucket))})
+	}))
+}
+
+// Close implements KVStore interface
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,228 @@
+package main
+
+// kvmemory module provides in-memory implementation of key-value store, it
+// is used by tests and ephemeral deployments, the data is lost on restart
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryEntry represents value of in-memory store
+type memoryEntry struct {
+	value   []byte    // entry value
+	expires time.Time // expiration time, zero means no expiration
+}
+
+// helper function to check if entry is expired
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// memoryStore implements KVStore interface using Go map
+type memoryStore struct {
+	mu     sync.RWMutex
+	data   map[string]memoryEntry
+	closed bool
+	writes int // number of update transactions since last purge
+}
+
+// number of update transactions between purges of expired entries
+const memoryPurgeInterval = 1000
+
+// helper function to create new in-memory store
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: make(map[string]memoryEntry)}
+}
+
+// memoryTxn implements KVTxn interface, the changes are kept in pending
+// map and applied to the store on commit
+type memoryTxn struct {
+	store   *memoryStore
+	update  bool
+	pending map[string]*memoryEntry // nil entry means deleted key
+}
+
+// Get implements KVTxn interface
+func (t *memoryTxn) Get(key []byte) ([]byte, error) {
+	if e, ok := t.pending[string(key)]; ok {
+		if e == nil {
+			return nil, errKeyNotFound
+		}
+		return bytes.Clone(e.value), nil
+	}
+	e, ok := t.store.data[string(key)]
+	if !ok || e.expired(time.Now()) {
+		return nil, errKeyNotFound
+	}
+	return bytes.Clone(e.value), nil
+}
+
+// Set implements KVTxn interface
+func (t *memoryTxn) Set(key, value []byte, ttl time.Duration) error {
+	if !t.update {
+		return errReadOnlyTxn
+	}
+	if len(key) == 0 {
+		return errors.New("key cannot be empty")
+	}
+	e := &memoryEntry{value: bytes.Clone(value)}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	t.pending[string(key)] = e
+	return nil
+}
+
+// Delete implements KVTxn interface
+func (t *memoryTxn) Delete(key []byte) error {
+	if !t.update {
+		return errReadOnlyTxn
+	}
+	t.pending[string(key)] = nil
+	return nil
+}
+
+// helper function to apply pending changes of the transaction
+func (t *memoryTxn) commit() {
+	for key, e := range t.pending {
+		if e == nil {
+			delete(t.store.data, key)
+		} else {
+			t.store.data[key] = *e
+		}
+	}
+}
+
+// Get implements KVStore interface
+func (s *memoryStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.Txn(false, func(txn KVTxn) error {
+		var err error
+		val, err = txn.Get(key)
+		return err
+	})
+	return val, err
+}
+
+// Set implements KVStore interface
+func (s *memoryStore) Set(key, value []byte, ttl time.Duration) error {
+	return s.Txn(true, func(txn KVTxn) error {
+		return txn.Set(key, value, ttl)
+	})
+}
+
+// Delete implements KVStore interface
+func (s *memoryStore) Delete(key []byte) error {
+	return s.Txn(true, func(txn KVTxn) error {
+		return txn.Delete(key)
+	})
+}
+
+// Batch implements KVStore interface, in-memory batch is atomic
+func (s *memoryStore) Batch(entries []KVEntry) error {
+	return s.Txn(true, func(txn KVTxn) error {
+		for _, e := range entries {
+			var err error
+			if e.Delete {
+				err = txn.Delete(e.Key)
+			} else {
+				err = txn.Set(e.Key, e.Value, e.TTL)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Iterate implements KVStore interface, the matching entries are copied
+// before iteration, i.e. iteration sees the store as of its start
+func (s *memoryStore) Iterate(prefix, after []byte, fn func(key, value []byte) error) error {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return errStoreClosed
+	}
+	now := time.Now()
+	var keys []string
+	for key, e := range s.data {
+		if !strings.HasPrefix(key, string(prefix)) || e.expired(now) {
+			continue
+		}
+		if len(after) > 0 && key <= string(after) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = bytes.Clone(s.data[key].value)
+	}
+	s.mu.RUnlock()
+
+	for i, key := range keys {
+		if err := fn([]byte(key), values[i]); err != nil {
+			if errors.Is(err, errStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Txn implements KVStore interface, update transactions are serialized
+func (s *memoryStore) Txn(update bool, fn func(txn KVTxn) error) error {
+	if update {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	} else {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	}
+	if s.closed {
+		return errStoreClosed
+	}
+	txn := &memoryTxn{store: s, update: update, pending: make(map[string]*memoryEntry)}
+	if err := fn(txn); err != nil {
+		return err
+	}
+	txn.commit()
+	if update {
+		s.writes++
+		if s.writes >= memoryPurgeInterval {
+			s.purgeExpired()
+		}
+	}
+	return nil
+}
+
+// helper function to remove expired entries, it should be called with
+// write lock held
+func (s *memoryStore) purgeExpired() {
+	now := time.Now()
+	for key, e := range s.data {
+		if e.expired(now) {
+			delete(s.data, key)
+		}
+	}
+	s.writes = 0
+}
+
+// Close implements KVStore interface
+func (s *memoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.data = nil
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+// kvstore module provides key-value store interface of our server and its
+// badger implementation, the storage engine is chosen via configuration
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// errKeyNotFound is returned by all engines when key does not exist, we use
+// badger error to keep error mapping of our APIs independent of the engine
+var errKeyNotFound = badger.ErrKeyNotFound
+
+// errStoreClosed is returned by all engines when store is closed
+var errStoreClosed = badger.ErrDBClosed
+
+// errReadOnlyTxn is returned when read-only transaction attempts to write
+var errReadOnlyTxn = errors.New("transaction is read-only")
+
+// errStopIteration can be returned by iteration function to stop iteration
+// without an error
+var errStopIteration = errors.New("stop iteration")
+
+// KVEntry represents single write operation of a batch
+type KVEntry struct {
+	Key    []byte        // entry key
+	Value  []byte        // entry value
+	TTL    time.Duration // expiration of the entry, zero means no expiration
+	Delete bool          // delete the key instead of setting it
+}
+
+// KVTxn represents transaction of key-value store
+type KVTxn interface {
+	Get(key []byte) ([]byte, error)
+	Set(key, value []byte, ttl time.Duration) error
+	Delete(key []byte) error
+}
+
+// KVStore represents key-value store used by our server, all engines
+// should return errKeyNotFound for missing keys and skip expired keys
+type KVStore interface {
+	// Get returns value of given key
+	Get(key []byte) ([]byte, error)
+	// Set sets value of given key, non-zero ttl defines its expiration
+	Set(key, value []byte, ttl time.Duration) error
+	// Delete deletes given key
+	Delete(key []byte) error
+	// Batch writes given entries, unlike transaction the batch is not
+	// atomic and large batches can be committed in several chunks
+	Batch(entries []KVEntry) error
+	// Iterate calls given function for keys with given prefix in
+	// ascending order starting after given key, the function should not
+	// modify the store
+	Iterate(prefix, after []byte, fn func(key, value []byte) error) error
+	// Txn executes given function within read-only or update transaction,
+	// the update transaction is committed if function returns no error
+	Txn(update bool, fn func(txn KVTxn) error) error
+	// Close closes the store
+	Close() error
+}
+
+// KV represents key-value store of our server
+var KV KVStore
+
+// helper function to open key-value store of configured engine at given
+// path, for badger engine we also set global DB which is used by badger
+// specific features such as backups, snapshots and value log GC
+func openStore(path string) (KVStore, error) {
+	switch Config.Engine {
+	case "", "badger":
+		db, err := openDB(path)
+		if err != nil {
+			return nil, err
+		}
+		DB = db
+		return badgerStore{db: db}, nil
+	case "memory", "bbolt":
+		key, err := encryptionKey()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) > 0 {
+			return nil, fmt.Errorf("encryption is not supported by %s engine", Config.Engine)
+		}
+		if Config.Engine == "memory" {
+			return newMemoryStore(), nil
+		}
+		return openBoltStore(path)
+	}
+	return nil, fmt.Errorf("unsupported storage engine %s", Config.Engine)
+}
+
+// helper function to check that badger engine is used, backups, snapshots
+// and value log GC are provided only by badger
+func requireBadger(feature string) error {
+	if DB == nil {
+		return newError(UnavailableCode, fmt.Errorf("%s is not supported by %s engine", feature, Config.Engine))
+	}
+	return nil
+}
+
+// helper function to return iteration start key for given prefix and
+// after key
+func iterationStart(prefix, after []byte) []byte {
+	if len(after) > 0 && bytes.Compare(after, prefix) > 0 {
+		return after
+	}
+	return prefix
+}
+
+// badgerStore implements KVStore interface using badger DB
+type badgerStore struct {
+	db *badger.DB
+}
+
+// badgerTxn implements KVTxn interface using badger transaction
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+// Get implements KVTxn interface
+func (t badgerTxn) Get(key []byte) ([]byte, error) {
+	item, err := t.txn.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+// Set implements KVTxn interface
+func (t badgerTxn) Set(key, value []byte, ttl time.Duration) error {
+	entry := badger.NewEntry(key, value)
+	if ttl > 0 {
+		entry = entry.WithTTL(ttl)
+	}
+	return badgerTxnError(t.txn.SetEntry(entry))
+}
+
+// Delete implements KVTxn interface, the deletes of non-system keys leave
+// markers for change stream, see changes module
+func (t badgerTxn) Delete(key []byte) error {
+	if err := t.txn.Delete(key); err != nil {
+		return badgerTxnError(err)
+	}
+	if isSystemKey(string(key)) {
+		return nil
+	}
+	return badgerTxnError(t.txn.Set(deletedMarker(key), deletedMarkerValue()))
+}
+
+// helper function to map badger transaction errors to errors of our store
+func badgerTxnError(err error) error {
+	if errors.Is(err, badger.ErrReadOnlyTxn) {
+		return errReadOnlyTxn
+	}
+	return err
+}
+
+// Get implements KVStore interface
+func (s badgerStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.Txn(false, func(txn KVTxn) error {
+		var err error
+		val, err = txn.Get(key)
+		return err
+	})
+	return val, err
+}
+
+// Set implements KVStore interface
+func (s badgerStore) Set(key, value []byte, ttl time.Duration) error {
+	return s.Txn(true, func(txn KVTxn) error {
+		return txn.Set(key, value, ttl)
+	})
+}
+
+// Delete implements KVStore interface
+func (s badgerStore) Delete(key []byte) error {
+	return s.Txn(true, func(txn KVTxn) error {
+		return txn.Delete(key)
+	})
+}
+
+// Batch implements KVStore interface
+func (s badgerStore) Batch(entries []KVEntry) error {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, e := range entries {
+		var err error
+		if e.Delete {
+			err = wb.Delete(e.Key)
+			if err == nil && !isSystemKey(string(e.Key)) {
+				err = wb.Set(deletedMarker(e.Key), deletedMarkerValue())
+			}
+		} else {
+			entry := badger.NewEntry(e.Key, e.Value)
+			if e.TTL > 0 {
+				entry = entry.WithTTL(e.TTL)
+			}
+			err = wb.SetEntry(entry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// Iterate implements KVStore interface
+func (s badgerStore) Iterate(prefix, after []byte, fn func(key, value []byte) error) error {
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(iterationStart(prefix, after)); it.Valid(); it.Next() {
+			item := it.Item()
+			if len(after) > 0 && bytes.Equal(item.Key(), after) {
+				continue
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(item.KeyCopy(nil), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errStopIteration) {
+		return nil
+	}
+	return err
+}
+
+// Txn implements KVStore interface
+func (s badgerStore) Txn(update bool, fn func(txn KVTxn) error) error {
+	f := func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn: txn})
+	}
+	if update {
+		return s.db.Update(f)
+	}
+	return s.db.View(f)
+}
+
+// Close implements KVStore interface
+func (s badgerStore) Close() error {
+	return s.db.Close()
+}
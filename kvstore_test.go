@@ -0,0 +1,291 @@
+package main
+
+// kvstore_test module provides conformance tests of KV store engines
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// kvEngines lists constructors of all KV store engines we support
+var kvEngines = []struct {
+	name string
+	open func(t *testing.T) KVStore
+}{
+	{"memory", func(t *testing.T) KVStore {
+		return newMemoryStore()
+	}},
+	{"bbolt", func(t *testing.T) KVStore {
+		store, err := openBoltStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+	{"badger", func(t *testing.T) KVStore {
+		db, err := openDB(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return badgerStore{db: db}
+	}},
+}
+
+// kvConformance lists checks which every KV store engine should pass
+var kvConformance = []struct {
+	name string
+	test func(t *testing.T, store KVStore)
+}{
+	{"GetSetDelete", testGetSetDelete},
+	{"Batch", testBatch},
+	{"Iterate", testIterate},
+	{"StopIteration", testStopIteration},
+	{"Txn", testTxn},
+	{"TTL", testTTL},
+}
+
+// TestKVStore runs conformance checks against all KV store engines
+func TestKVStore(t *testing.T) {
+	for _, engine := range kvEngines {
+		engine := engine
+		t.Run(engine.name, func(t *testing.T) {
+			t.Parallel()
+			for _, check := range kvConformance {
+				t.Run(check.name, func(t *testing.T) {
+					store := engine.open(t)
+					defer store.Close()
+					check.test(t, store)
+				})
+			}
+		})
+	}
+}
+
+// helper function to check value of given key
+func expectValue(t *testing.T, store KVStore, key, value string) {
+	t.Helper()
+	val, err := store.Get([]byte(key))
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	if string(val) != value {
+		t.Fatalf("get %s: expect %q, got %q", key, value, val)
+	}
+}
+
+// helper function to check that given key does not exist
+func expectMissing(t *testing.T, store KVStore, key string) {
+	t.Helper()
+	if _, err := store.Get([]byte(key)); !errors.Is(err, errKeyNotFound) {
+		t.Fatalf("get %s: expect errKeyNotFound, got %v", key, err)
+	}
+}
+
+// helper function to collect keys of iteration
+func iterKeys(t *testing.T, store KVStore, prefix, after string) []string {
+	t.Helper()
+	var keys []string
+	var afterKey []byte
+	if after != "" {
+		afterKey = []byte(after)
+	}
+	err := store.Iterate([]byte(prefix), afterKey, func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("iterate %s after %s: %v", prefix, after, err)
+	}
+	return keys
+}
+
+func testGetSetDelete(t *testing.T, store KVStore) {
+	expectMissing(t, store, "a")
+	if err := store.Set([]byte("a"), []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, store, "a", "1")
+	if err := store.Set([]byte("a"), []byte("2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, store, "a", "2")
+	if err := store.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	expectMissing(t, store, "a")
+	if err := store.Delete([]byte("a")); err != nil {
+		t.Fatalf("delete of missing key: %v", err)
+	}
+}
+
+func testBatch(t *testing.T, store KVStore) {
+	if err := store.Set([]byte("old"), []byte("x"), 0); err != nil {
+		t.Fatal(err)
+	}
+	entries := []KVEntry{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+		{Key: []byte("old"), Delete: true},
+	}
+	if err := store.Batch(entries); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, store, "a", "1")
+	expectValue(t, store, "b", "2")
+	expectMissing(t, store, "old")
+}
+
+func testIterate(t *testing.T, store KVStore) {
+	var entries []KVEntry
+	for _, key := range []string{"p/c", "p/a", "q/a", "p/b", "o/z"} {
+		entries = append(entries, KVEntry{Key: []byte(key), Value: []byte("v" + key)})
+	}
+	if err := store.Batch(entries); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		prefix, after string
+		keys          string
+	}{
+		{"", "", "[o/z p/a p/b p/c q/a]"},
+		{"p/", "", "[p/a p/b p/c]"},
+		{"p/", "p/a", "[p/b p/c]"},
+		{"p/", "p/aa", "[p/b p/c]"},
+		{"p/", "p/c", "[]"},
+		{"", "p/c", "[q/a]"},
+		{"x/", "", "[]"},
+	}
+	for _, c := range cases {
+		keys := fmt.Sprintf("%v", iterKeys(t, store, c.prefix, c.after))
+		if keys != c.keys {
+			t.Errorf("iterate %q after %q: expect %s, got %s", c.prefix, c.after, c.keys, keys)
+		}
+	}
+	err := store.Iterate([]byte("p/a"), nil, func(key, value []byte) error {
+		if !bytes.Equal(value, []byte("vp/a")) {
+			return fmt.Errorf("unexpected value %q of key %s", value, key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testStopIteration(t *testing.T, store KVStore) {
+	for i := 0; i < 10; i++ {
+		if err := store.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var count int
+	err := store.Iterate([]byte("k"), nil, func(key, value []byte) error {
+		count++
+		if count == 3 {
+			return errStopIteration
+		}
+		return nil
+	})
+	if err != nil || count != 3 {
+		t.Fatalf("stop iteration: expect 3 keys and no error, got %d keys and %v", count, err)
+	}
+	failure := errors.New("failure")
+	err = store.Iterate([]byte("k"), nil, func(key, value []byte) error {
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("iteration error: expect %v, got %v", failure, err)
+	}
+}
+
+func testTxn(t *testing.T, store KVStore) {
+	if err := store.Set([]byte("c"), []byte("old"), 0); err != nil {
+		t.Fatal(err)
+	}
+	err := store.Txn(true, func(txn KVTxn) error {
+		if err := txn.Set([]byte("a"), []byte("1"), 0); err != nil {
+			return err
+		}
+		val, err := txn.Get([]byte("a"))
+		if err != nil || string(val) != "1" {
+			return fmt.Errorf("transaction should see its own write, got %q %v", val, err)
+		}
+		return txn.Delete([]byte("c"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, store, "a", "1")
+	expectMissing(t, store, "c")
+
+	// failed transaction should not apply its changes
+	failure := errors.New("failure")
+	err = store.Txn(true, func(txn KVTxn) error {
+		if err := txn.Set([]byte("a"), []byte("2"), 0); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("b"), []byte("2"), 0); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("failed transaction: expect %v, got %v", failure, err)
+	}
+	expectValue(t, store, "a", "1")
+	expectMissing(t, store, "b")
+
+	// read-only transaction should reject writes
+	err = store.Txn(false, func(txn KVTxn) error {
+		if _, err := txn.Get([]byte("missing")); !errors.Is(err, errKeyNotFound) {
+			return fmt.Errorf("expect errKeyNotFound, got %v", err)
+		}
+		if err := txn.Set([]byte("a"), []byte("3"), 0); !errors.Is(err, errReadOnlyTxn) {
+			return fmt.Errorf("set: expect errReadOnlyTxn, got %v", err)
+		}
+		if err := txn.Delete([]byte("a")); !errors.Is(err, errReadOnlyTxn) {
+			return fmt.Errorf("delete: expect errReadOnlyTxn, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, store, "a", "1")
+}
+
+func testTTL(t *testing.T, store KVStore) {
+	if err := store.Set([]byte("t/set"), []byte("v"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	entries := []KVEntry{
+		{Key: []byte("t/batch"), Value: []byte("v"), TTL: time.Second},
+		{Key: []byte("t/keep"), Value: []byte("v")},
+	}
+	if err := store.Batch(entries); err != nil {
+		t.Fatal(err)
+	}
+	err := store.Txn(true, func(txn KVTxn) error {
+		return txn.Set([]byte("t/txn"), []byte("v"), time.Second)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := fmt.Sprintf("%v", iterKeys(t, store, "t/", "")); keys != "[t/batch t/keep t/set t/txn]" {
+		t.Fatalf("iterate before expiration: got %s", keys)
+	}
+	// badger expiration has one second resolution
+	time.Sleep(2100 * time.Millisecond)
+	for _, key := range []string{"t/set", "t/batch", "t/txn"} {
+		expectMissing(t, store, key)
+	}
+	expectValue(t, store, "t/keep", "v")
+	if keys := fmt.Sprintf("%v", iterKeys(t, store, "t/", "")); keys != "[t/keep]" {
+		t.Fatalf("iterate after expiration: got %s", keys)
+	}
+}
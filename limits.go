@@ -0,0 +1,85 @@
+package main
+
+// limits module provides HTTP server timeouts, request size and connection
+// limits
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// helper function to parse duration of given configuration option, empty
+// value means no timeout
+func parseTimeout(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse %s '%s': %v", name, value, err)
+	}
+	return d, nil
+}
+
+// helper function to create HTTP server with configured timeouts
+func newServer(addr string, handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{Addr: addr, Handler: handler, MaxHeaderBytes: Config.MaxHeaderBytes}
+	var err error
+	if srv.ReadTimeout, err = parseTimeout("read_timeout", Config.ReadTimeout); err != nil {
+		return nil, err
+	}
+	if srv.ReadHeaderTimeout, err = parseTimeout("read_header_timeout", Config.ReadHeaderTimeout); err != nil {
+		return nil, err
+	}
+	if srv.WriteTimeout, err = parseTimeout("write_timeout", Config.WriteTimeout); err != nil {
+		return nil, err
+	}
+	if srv.IdleTimeout, err = parseTimeout("idle_timeout", Config.IdleTimeout); err != nil {
+		return nil, err
+	}
+	log.Printf("HTTP server read=%v header=%v write=%v idle=%v max header bytes=%d",
+		srv.ReadTimeout, srv.ReadHeaderTimeout, srv.WriteTimeout, srv.IdleTimeout, srv.MaxHeaderBytes)
+	return srv, nil
+}
+
+// helper function to return max body size of given route, the route
+// templates in configuration do not include base path
+func maxBodySize(route string) int64 {
+	route = strings.TrimPrefix(route, strings.TrimSuffix(Config.Base, "/"))
+	if size, ok := Config.MaxBodySizes[route]; ok {
+		return size
+	}
+	return Config.MaxBodySize
+}
+
+// body limit middleware limits size of request body, requests which
+// exceed the limit are rejected with 413 HTTP code
+func bodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := maxBodySize(routeName(r))
+		if limit > 0 {
+			if r.ContentLength > limit {
+				err := &http.MaxBytesError{Limit: limit}
+				handleError(w, r, "request body is too large", err)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// helper function to disable write deadline of streaming responses, e.g.
+// backups, which may take longer than configured write timeout
+func disableWriteTimeout(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		slog.WarnContext(r.Context(), "unable to disable write timeout", "error", err)
+	}
+}
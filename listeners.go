@@ -0,0 +1,244 @@
+package main
+
+// listeners module provides TCP, TLS and Unix socket listeners of our server
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/netutil"
+)
+
+// ListenerConfig represents configuration of server listener
+type ListenerConfig struct {
+	Network     string   `json:"network"`      // tcp (default) or unix
+	Address     string   `json:"address"`      // listen address, e.g. :9212 or /var/run/cmskv.sock
+	ServerCert  string   `json:"server_cert"`  // server certificate file, enables TLS
+	ServerKey   string   `json:"server_key"`   // server key file
+	ClientCA    string   `json:"client_ca"`    // CA file to verify client certificates
+	SocketMode  string   `json:"socket_mode"`  // file mode of unix socket, e.g. 0660
+	SocketOwner string   `json:"socket_owner"` // owner of unix socket
+	SocketGroup string   `json:"socket_group"` // group of unix socket
+	Middlewares []string `json:"middlewares"`  // optional middlewares, e.g. ["limit", "auth"]
+}
+
+// String returns string representation of listener configuration
+func (lc ListenerConfig) String() string {
+	scheme := lc.Network
+	if lc.ServerCert != "" {
+		scheme += "+tls"
+	}
+	return fmt.Sprintf("%s://%s middlewares=%v", scheme, lc.Address, lc.Middlewares)
+}
+
+// optionalMiddlewares represents middlewares which can be enabled per
+// listener, request id, logging and body limit middlewares are always used
+var optionalMiddlewares = map[string]func(http.Handler) http.Handler{
+	"limit": limitMiddleware,
+	"auth":  authMiddleware,
+}
+
+// helper function to return middlewares of default listener, only rate
+// limiter is used since admin end-points authenticate requests themselves
+// while health, readiness and metrics end-points should stay accessible
+func defaultMiddlewares() []string {
+	return []string{"limit"}
+}
+
+// helper function to check if given middleware is enabled
+func hasMiddleware(middlewares []string, name string) bool {
+	for _, m := range middlewares {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to return listeners of our server, if listeners are not
+// configured we use single TCP listener on configured port
+func listeners() []ListenerConfig {
+	if len(Config.Listeners) == 0 {
+		lc := ListenerConfig{Network: "tcp", Address: fmt.Sprintf(":%d", Config.Port), Middlewares: defaultMiddlewares()}
+		return []ListenerConfig{lc}
+	}
+	var out []ListenerConfig
+	for _, lc := range Config.Listeners {
+		if lc.Network == "" {
+			lc.Network = "tcp"
+		}
+		out = append(out, lc)
+	}
+	return out
+}
+
+// helper function to validate listener configuration
+func (lc ListenerConfig) validate() error {
+	if lc.Network != "tcp" && lc.Network != "unix" {
+		return fmt.Errorf("unsupported network %s of listener %s", lc.Network, lc.Address)
+	}
+	if lc.Address == "" {
+		return errors.New("listener address is not provided")
+	}
+	if (lc.ServerCert == "") != (lc.ServerKey == "") {
+		return fmt.Errorf("listener %s requires both server_cert and server_key", lc.Address)
+	}
+	if lc.ClientCA != "" && lc.ServerCert == "" {
+		return fmt.Errorf("listener %s requires TLS to verify client certificates", lc.Address)
+	}
+	for _, name := range lc.Middlewares {
+		if _, ok := optionalMiddlewares[name]; !ok {
+			return fmt.Errorf("unsupported middleware %s of listener %s", name, lc.Address)
+		}
+		if name == "auth" && Config.AuthTokenFile == "" && lc.ClientCA == "" {
+			return fmt.Errorf("auth middleware of listener %s requires auth_token_file or client_ca", lc.Address)
+		}
+	}
+	return nil
+}
+
+// helper function to create plain TCP or unix socket listener for given
+// configuration
+func listen(lc ListenerConfig) (net.Listener, error) {
+	if err := lc.validate(); err != nil {
+		return nil, err
+	}
+	if lc.Network == "unix" {
+		return newUnixListener(lc)
+	}
+	ln, err := net.Listen("tcp", lc.Address)
+	if err != nil {
+		return nil, err
+	}
+	if Config.MaxConnections > 0 {
+		log.Printf("limit %s listener to %d connections", lc.Address, Config.MaxConnections)
+		ln = netutil.LimitListener(ln, Config.MaxConnections)
+	}
+	return ln, nil
+}
+
+// helper function to create listener for given configuration, the TLS
+// is used if listener has server certificate
+func newListener(lc ListenerConfig) (net.Listener, error) {
+	ln, err := listen(lc)
+	if err != nil {
+		return nil, err
+	}
+	if lc.ServerCert == "" {
+		return ln, nil
+	}
+	tlsConfig, err := lc.tlsConfig()
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
+// helper function to create TLS configuration of the listener
+func (lc ListenerConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(lc.ServerCert, lc.ServerKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if lc.ClientCA != "" {
+		data, err := os.ReadFile(lc.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("unable to load certificates from %s", lc.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// helper function to create unix socket listener, the stale socket file
+// left by previous server is removed and socket file mode and ownership
+// are adjusted according to configuration
+func newUnixListener(lc ListenerConfig) (net.Listener, error) {
+	if info, err := os.Stat(lc.Address); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and it is not a socket", lc.Address)
+		}
+		os.Remove(lc.Address)
+	}
+	ln, err := net.Listen("unix", lc.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err := lc.setSocketPermissions(); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// helper function to set unix socket file mode and ownership
+func (lc ListenerConfig) setSocketPermissions() error {
+	if lc.SocketMode != "" {
+		mode, err := strconv.ParseUint(lc.SocketMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid socket mode %s: %v", lc.SocketMode, err)
+		}
+		if err := os.Chmod(lc.Address, os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+	if lc.SocketOwner == "" && lc.SocketGroup == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if lc.SocketOwner != "" {
+		u, err := user.Lookup(lc.SocketOwner)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+	}
+	if lc.SocketGroup != "" {
+		g, err := user.LookupGroup(lc.SocketGroup)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+	return os.Chown(lc.Address, uid, gid)
+}
+
+// helper function to create HTTP handler of given listener, every listener
+// has its own router with its middleware chain, the debug end-points
+// (pprof and expvar) are served by default HTTP mux
+func listenerHandler(lc ListenerConfig) http.Handler {
+	base := Config.Base
+	if !strings.HasSuffix(base, "/") {
+		base = fmt.Sprintf("%s/", Config.Base)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/", http.DefaultServeMux)
+	mux.Handle(base, handlers(lc.Middlewares))
+	return mux
+}
@@ -0,0 +1,206 @@
+package main
+
+// logger module provides text and JSON loggers of our server
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
+)
+
+// helper function to parse log level from configuration, if log level is
+// not provided we use debug level for verbose mode and info level otherwise
+func logLevel() (slog.Level, error) {
+	var level slog.Level
+	if Config.LogLevel == "" {
+		if Config.Verbose > 0 {
+			return slog.LevelDebug, nil
+		}
+		return slog.LevelInfo, nil
+	}
+	err := level.UnmarshalText([]byte(Config.LogLevel))
+	return level, err
+}
+
+// helper function to initialize server logger, by default we use text
+// format where every line is prefixed with time stamp, the JSON format
+// provides structured records suitable for log pipelines
+func initLogger() error {
+	level, err := logLevel()
+	if err != nil {
+		return err
+	}
+	var rl *rotatelogs.RotateLogs
+	if Config.LogFile != "" {
+		rl, err = rotatelogs.New(Config.LogFile + "-%Y%m%d")
+		if err != nil {
+			return err
+		}
+	}
+	var handler slog.Handler
+	switch Config.LogFormat {
+	case "", "text":
+		var out io.Writer = new(logWriter)
+		if rl != nil {
+			out = rotateLogWriter{RotateLogs: rl}
+		}
+		handler = &textLogHandler{w: out, level: level, mu: &sync.Mutex{}}
+	case "json":
+		var out io.Writer = os.Stdout
+		if rl != nil {
+			out = rl
+		}
+		opts := &slog.HandlerOptions{
+			Level:     level,
+			AddSource: level <= slog.LevelDebug,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.TimeKey && Config.UTC && len(groups) == 0 {
+					a.Value = slog.TimeValue(a.Value.Time().UTC())
+				}
+				return a
+			},
+		}
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("unsupported log format %s", Config.LogFormat)
+	}
+	// setting default slog logger redirects standard log package to it
+	slog.SetDefault(slog.New(contextLogHandler{Handler: handler}))
+	return nil
+}
+
+// textLogHandler implements slog.Handler interface and writes records in
+// plain text format, non-info records are prefixed with their level
+type textLogHandler struct {
+	w     io.Writer
+	level slog.Level
+	attrs []slog.Attr
+	mu    *sync.Mutex
+}
+
+// Enabled implements slog.Handler interface
+func (h *textLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+// Handle implements slog.Handler interface
+func (h *textLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var b strings.Builder
+	if r.Level != slog.LevelInfo {
+		b.WriteString(r.Level.String())
+		b.WriteString(": ")
+	}
+	if h.level <= slog.LevelDebug && r.PC != 0 {
+		frames := runtime.CallersFrames([]uintptr{r.PC})
+		frame, _ := frames.Next()
+		b.WriteString(fmt.Sprintf("%s:%d: ", filepath.Base(frame.File), frame.Line))
+	}
+	b.WriteString(r.Message)
+	for _, a := range h.attrs {
+		b.WriteString(fmt.Sprintf(" %s=%v", a.Key, a.Value))
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		b.WriteString(fmt.Sprintf(" %s=%v", a.Key, a.Value))
+		return true
+	})
+	b.WriteString("\n")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write([]byte(b.String()))
+	return err
+}
+
+// WithAttrs implements slog.Handler interface
+func (h *textLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &nh
+}
+
+// WithGroup implements slog.Handler interface, groups are not used by our
+// text logger and attributes are written without group prefix
+func (h *textLogHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+// helper function to return client identity of given HTTP request, we use
+// either subject of client certificate or login provided by CMS front-ends
+func clientIdentity(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.String()
+	}
+	return r.Header.Get("Cms-Authn-Login")
+}
+
+// helper function to write access log record of HTTP request
+func accessLog(r *http.Request, route string, status, size int, duration time.Duration) {
+	if Config.LogFormat != "json" {
+		msg := fmt.Sprintf("%v %s %s %v", status, r.Method, r.URL.EscapedPath(), duration)
+		if rid := requestID(r.Context()); rid != "" {
+			msg += " request_id=" + rid
+		}
+		if tid := traceID(r.Context()); tid != "" {
+			msg += " trace=" + tid
+		}
+		log.Println(msg)
+		return
+	}
+	// request and trace ids are added by context log handler
+	attrs := []slog.Attr{
+		slog.String("remote_addr", r.RemoteAddr),
+		slog.String("client", clientIdentity(r)),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.EscapedPath()),
+		slog.String("route", route),
+		slog.Int("status", status),
+		slog.Float64("duration", duration.Seconds()),
+		slog.Int("bytes", size),
+	}
+	slog.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+}
+
+// badgerLogger implements badger.Logger interface and passes badger
+// messages to our logger
+type badgerLogger struct{}
+
+// helper function to log badger message with given level
+func (l badgerLogger) log(level slog.Level, format string, args ...interface{}) {
+	msg := strings.TrimSpace(fmt.Sprintf(format, args...))
+	if msg == "" {
+		return
+	}
+	slog.Log(context.Background(), level, msg, "component", "badger")
+}
+
+// Errorf implements badger.Logger interface
+func (l badgerLogger) Errorf(format string, args ...interface{}) {
+	l.log(slog.LevelError, format, args...)
+}
+
+// Warningf implements badger.Logger interface
+func (l badgerLogger) Warningf(format string, args ...interface{}) {
+	l.log(slog.LevelWarn, format, args...)
+}
+
+// Infof implements badger.Logger interface
+func (l badgerLogger) Infof(format string, args ...interface{}) {
+	l.log(slog.LevelInfo, format, args...)
+}
+
+// Debugf implements badger.Logger interface
+func (l badgerLogger) Debugf(format string, args ...interface{}) {
+	l.log(slog.LevelDebug, format, args...)
+}
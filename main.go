@@ -11,8 +11,6 @@ import (
 	"log"
 	"os"
 	"time"
-
-	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
 )
 
 func main() {
@@ -20,6 +18,11 @@ func main() {
 	flag.StringVar(&config, "config", "config.json", "server config file")
 	var version bool
 	flag.BoolVar(&version, "version", false, "Show version")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [command]\n", os.Args[0])
+		flag.PrintDefaults()
+		commandsUsage()
+	}
 	flag.Parse()
 	if version {
 		fmt.Println(Info())
@@ -31,19 +34,16 @@ func main() {
 		log.Fatalf("Unable to parse config file %s, error: %v", config, err)
 	}
 	log.SetFlags(0)
-	if Config.Verbose > 0 {
+	if Config.Verbose > 0 || Config.LogLevel == "debug" {
 		log.SetFlags(log.Lshortfile)
 	}
-	log.SetOutput(new(logWriter))
-	if Config.LogFile != "" {
-		rl, err := rotatelogs.New(Config.LogFile + "-%Y%m%d")
-		if err == nil {
-			rotlogs := rotateLogWriter{RotateLogs: rl}
-			log.SetOutput(rotlogs)
-		}
-	}
+	err = initLogger()
 	if err != nil {
-		log.Printf("Unable to parse, time: %v, config: %v\n", time.Now(), config)
+		log.Fatalf("Unable to initialize logger, time: %v, config: %v, error: %v", time.Now(), config, err)
+	}
+	if flag.NArg() > 0 {
+		runCommand(flag.Args())
+		return
 	}
 	log.Println("Configuration:", Config.String())
 	server()
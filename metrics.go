@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"sync/atomic"
 	"time"
 
 	"github.com/shirou/gopsutil/cpu"
@@ -17,30 +18,9 @@ import (
 	"github.com/shirou/gopsutil/process"
 )
 
-// TotalGetRequests counts total number of GET requests received by the server
-var TotalGetRequests uint64
-
-// TotalPostRequests counts total number of POST requests received by the server
-var TotalPostRequests uint64
-
 // MetricsLastUpdateTime keeps track of last update time of the metrics
 var MetricsLastUpdateTime time.Time
 
-// RPS represents requests per second for a given server
-var RPS float64
-
-// RPSPhysical represents requests per second for a given server times number of physical CPU cores
-var RPSPhysical float64
-
-// RPSLogical represents requests per second for a given server times number of logical CPU cores
-var RPSLogical float64
-
-// NumPhysicalCores represents number of cores in our node
-var NumPhysicalCores int
-
-// NumLogicalCores represents number of cores in our node
-var NumLogicalCores int
-
 // Memory structure keeps track of server memory
 type Memory struct {
 	Total       uint64  `json:"total"`
@@ -68,11 +48,21 @@ type Metrics struct {
 	PostX509Requests  uint64                  `json:"x509PostRequests"`  // total number of post X509 requests
 	GetOAuthRequests  uint64                  `json:"oAuthGetRequests"`  // total number of get requests form OAuth server
 	PostOAuthRequests uint64                  `json:"oAuthPostRequests"` // total number of post requests from OAuth server
-	GetRequests       uint64                  `json:"getRequests"`       // total number of get requests across all services
-	PostRequests      uint64                  `json:"postRequests"`      // total number of post requests across all services
-	RPS               float64                 `json:"rps"`               // throughput req/sec
-	RPSPhysical       float64                 `json:"rpsPhysical"`       // throughput req/sec using physical cpu
-	RPSLogical        float64                 `json:"rpsLogical"`        // throughput req/sec using logical cpu
+	TotalRequests     uint64                  `json:"totalRequests"`     // total number of requests
+	Requests          []RequestCounter        `json:"requests"`          // number of requests by method and status code
+	Latency           []RouteLatency          `json:"latency"`           // latency histograms per route
+	InFlight          int64                   `json:"inFlight"`          // number of requests currently served
+	Rate              RouteRate               `json:"rate"`              // throughput req/sec of all requests
+	Rates             []RouteRate             `json:"rates"`             // throughput req/sec per route
+	GCRuns            uint64                  `json:"gcRuns"`            // total number of value log GC runs
+	GCReclaimedBytes  uint64                  `json:"gcReclaimedBytes"`  // total number of bytes reclaimed by GC
+	GCDuration        float64                 `json:"gcDuration"`        // total time spent in GC in seconds
+	GCLastDuration    float64                 `json:"gcLastDuration"`    // duration of last GC run in seconds
+	DB                DBMetrics               `json:"db"`                // badger DB metrics
+	Replication       *ReplicationMetrics     `json:"replication"`       // replication metrics of read-only replica
+	Webhooks          *WebhookMetrics         `json:"webhooks"`          // webhook notification metrics
+	Cluster           *ClusterMetrics         `json:"cluster"`           // raft metrics of clustered node
+	Shards            []ShardMetrics          `json:"shards,omitempty"`  // backend shard metrics of router
 }
 
 func metrics() Metrics {
@@ -90,7 +80,9 @@ func metrics() Metrics {
 	virt := Memory{Total: m.Total, Free: m.Free, Used: m.Used, UsedPercent: m.UsedPercent}
 	swap := Memory{Total: s.Total, Free: s.Free, Used: s.Used, UsedPercent: s.UsedPercent}
 	metrics.Memory = Mem{Virtual: virt, Swap: swap}
-	metrics.Load = *l
+	if l != nil {
+		metrics.Load = *l
+	}
 	metrics.CPU = c
 	if perr == nil { // if we got process info
 		conn, err := process.Connections()
@@ -103,17 +95,34 @@ func metrics() Metrics {
 		}
 	}
 	metrics.Uptime = time.Since(StartTime).Seconds()
-	metrics.GetRequests = TotalGetRequests
-	metrics.PostRequests = TotalPostRequests
-	if (metrics.GetRequests + metrics.PostRequests) > 0 {
-		metrics.RPS = RPS / float64(metrics.GetRequests+metrics.PostRequests)
-	}
-	if metrics.GetRequests+metrics.PostRequests > 0 {
-		metrics.RPSPhysical = RPSPhysical / float64(metrics.GetRequests+metrics.PostRequests)
-	}
-	if metrics.GetRequests+metrics.PostRequests > 0 {
-		metrics.RPSLogical = RPSLogical / float64(metrics.GetRequests+metrics.PostRequests)
+	metrics.Requests = requestCounts()
+	metrics.Latency = routeLatencies()
+	metrics.InFlight = atomic.LoadInt64(&InFlightRequests)
+	for _, rec := range metrics.Requests {
+		metrics.TotalRequests += rec.Count
 	}
+	metrics.Rate, metrics.Rates = requestRates()
+
+	// GC metrics
+	metrics.GCRuns = atomic.LoadUint64(&TotalGCRuns)
+	metrics.GCReclaimedBytes = atomic.LoadUint64(&TotalGCReclaimedBytes)
+	metrics.GCDuration = time.Duration(atomic.LoadUint64(&TotalGCDuration)).Seconds()
+	metrics.GCLastDuration = time.Duration(atomic.LoadUint64(&LastGCDuration)).Seconds()
+
+	// DB metrics
+	metrics.DB = dbMetrics()
+
+	// replication metrics
+	metrics.Replication = replicationMetrics()
+
+	// webhook metrics
+	metrics.Webhooks = webhookMetrics()
+
+	// cluster metrics
+	metrics.Cluster = clusterMetrics()
+
+	// router metrics
+	metrics.Shards = shardMetrics()
 
 	// update time stamp
 	MetricsLastUpdateTime = time.Now()
@@ -125,7 +134,7 @@ func metrics() Metrics {
 func promMetrics() string {
 	var out string
 	data := metrics()
-	prefix := "proxy_server"
+	prefix := Config.MetricsPrefix
 
 	// cpu info
 	out += fmt.Sprintf("# HELP %s_cpu percentage of cpu used per CPU\n", prefix)
@@ -226,33 +235,48 @@ func promMetrics() string {
 	out += fmt.Sprintf("# TYPE %s_post_oauth_requests counter\n", prefix)
 	out += fmt.Sprintf("%s_post_oauth_requests %v\n", prefix, data.PostOAuthRequests)
 
-	// total requests
-	out += fmt.Sprintf("# HELP %s_get_requests reports total number of HTTP GET requests\n", prefix)
-	out += fmt.Sprintf("# TYPE %s_get_requests counter\n", prefix)
-	out += fmt.Sprintf("%s_get_requests %v\n", prefix, data.GetRequests)
-	out += fmt.Sprintf("# HELP %s_post_requests reports total number of HTTP POST requests\n", prefix)
-	out += fmt.Sprintf("# TYPE %s_post_requests counter\n", prefix)
-	out += fmt.Sprintf("%s_post_requests %v\n", prefix, data.PostRequests)
+	// HTTP requests
+	out += promHTTPMetrics(prefix, data)
+
+	// throughput
+	out += promRateMetrics(prefix, data.Rate, data.Rates)
+
+	// value log GC
+	out += fmt.Sprintf("# HELP %s_gc_runs reports total number of value log GC runs\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_gc_runs counter\n", prefix)
+	out += fmt.Sprintf("%s_gc_runs %v\n", prefix, data.GCRuns)
+	out += fmt.Sprintf("# HELP %s_gc_reclaimed_bytes reports total number of bytes reclaimed by value log GC\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_gc_reclaimed_bytes counter\n", prefix)
+	out += fmt.Sprintf("%s_gc_reclaimed_bytes %v\n", prefix, data.GCReclaimedBytes)
+	out += fmt.Sprintf("# HELP %s_gc_duration_seconds reports total time spent in value log GC\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_gc_duration_seconds counter\n", prefix)
+	out += fmt.Sprintf("%s_gc_duration_seconds %v\n", prefix, data.GCDuration)
+	out += fmt.Sprintf("# HELP %s_gc_last_duration_seconds reports duration of last value log GC run\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_gc_last_duration_seconds gauge\n", prefix)
+	out += fmt.Sprintf("%s_gc_last_duration_seconds %v\n", prefix, data.GCLastDuration)
+
+	// badger DB
+	out += promDBMetrics(prefix, data.DB)
+
+	// replication
+	if data.Replication != nil {
+		out += promReplicationMetrics(prefix, data.Replication)
+	}
 
-	// throughput, rps, rps physical cpu, rps logical cpu
-	out += fmt.Sprintf("# HELP %s_rps reports request per second average\n", prefix)
-	out += fmt.Sprintf("# TYPE %s_rps gauge\n", prefix)
-	out += fmt.Sprintf("%s_rps %v\n", prefix, data.RPS)
+	// webhooks
+	if data.Webhooks != nil {
+		out += promWebhookMetrics(prefix, data.Webhooks)
+	}
 
-	out += fmt.Sprintf("# HELP %s_rps_physical_cpu reports request per second average weighted by physical CPU cores\n", prefix)
-	out += fmt.Sprintf("# TYPE %s_rps_physical_cpu gauge\n", prefix)
-	out += fmt.Sprintf("%s_rps_physical_cpu %v\n", prefix, data.RPSPhysical)
+	// cluster
+	if data.Cluster != nil {
+		out += promClusterMetrics(prefix, data.Cluster)
+	}
 
-	out += fmt.Sprintf("# HELP %s_rps_logical_cpu reports request per second average weighted by logical CPU cures\n", prefix)
-	out += fmt.Sprintf("# TYPE %s_rps_logical_cpu gauge\n", prefix)
-	out += fmt.Sprintf("%s_rps_logical_cpu %v\n", prefix, data.RPSLogical)
+	// router
+	if len(data.Shards) > 0 {
+		out += promShardMetrics(prefix, data.Shards)
+	}
 
 	return out
 }
-
-// helper function that calculates request per second metrics
-func getRPS(time0 time.Time) {
-	RPS += 1. / time.Since(time0).Seconds()
-	RPSLogical += float64(NumLogicalCores) / time.Since(time0).Seconds()
-	RPSPhysical += float64(NumPhysicalCores) / time.Since(time0).Seconds()
-}
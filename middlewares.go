@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"runtime/debug"
 	"sync/atomic"
@@ -17,6 +18,9 @@ import (
 // limiter middleware pointer
 var limiterMiddleware *stdlib.Middleware
 
+// rateLimiter is shared by limiter middleware and non-HTTP front-ends
+var rateLimiter *limiter.Limiter
+
 // initialize Limiter middleware pointer
 func initLimiter(period string) {
 	log.Printf("limiter rate='%s'", period)
@@ -27,7 +31,14 @@ func initLimiter(period string) {
 	}
 	store := memory.NewStore()
 	instance := limiter.New(store, rate)
-	limiterMiddleware = stdlib.NewMiddleware(instance)
+	rateLimiter = instance
+	limiterMiddleware = stdlib.NewMiddleware(instance,
+		stdlib.WithLimitReachedHandler(func(w http.ResponseWriter, r *http.Request) {
+			handleError(w, r, "too many requests", errRateLimited)
+		}),
+		stdlib.WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+			handleError(w, r, "unable to check request rate", err)
+		}))
 }
 
 // limit middleware limits incoming requests
@@ -42,6 +53,7 @@ func limitMiddleware(next http.Handler) http.Handler {
 type responseWriter struct {
 	http.ResponseWriter
 	status      int
+	size        int
 	wroteHeader bool
 }
 
@@ -65,30 +77,44 @@ func (rw *responseWriter) WriteHeader(code int) {
 	return
 }
 
+// Unwrap returns original http.ResponseWriter, it is used by
+// http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *responseWriter) Write(data []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(data)
+	rw.size += n
+	return n, err
+}
+
 // LoggingMiddleware logs the incoming HTTP request & its duration.
 // https://blog.questionable.services/article/guide-logging-middleware-go/
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				log.Printf("error %v\nstack %v\n", err, string(debug.Stack()))
+				slog.ErrorContext(r.Context(), "panic", "error", err, "stack", string(debug.Stack()))
+				handleError(w, r, "internal server error", fmt.Errorf("%v", err))
 			}
 		}()
-		if r.Method == "POST" {
-			atomic.AddUint64(&TotalPostRequests, 1)
-		} else if r.Method == "GET" {
-			atomic.AddUint64(&TotalGetRequests, 1)
-		}
+		atomic.AddInt64(&InFlightRequests, 1)
+		defer atomic.AddInt64(&InFlightRequests, -1)
 
 		start := time.Now()
+		route := routeName(r)
+		r, span := startRequestSpan(r, route)
 		wrapped := wrapResponseWriter(w)
 		next.ServeHTTP(wrapped, r)
 		status := wrapped.status
 		if status == 0 {
 			status = 200
 		}
-		log.Printf("%v %s %s %v", status, r.Method, r.URL.EscapedPath(), time.Since(start))
+		endRequestSpan(span, status)
+		observeRequest(route, r.Method, status, time.Since(start))
+		observeRate(route, start)
+		accessLog(r, route, status, wrapped.size, time.Since(start))
 	})
 }
 
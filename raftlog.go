@@ -0,0 +1,178 @@
+package main
+
+// raftlog module provides badger implementation of raft log and stable
+// stores used in clustered mode
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+// key prefixes of raft log entries and stable store values
+var (
+	raftLogPrefix    = []byte("l/")
+	raftStablePrefix = []byte("s/")
+)
+
+// raftLogStore implements raft LogStore and StableStore interfaces using
+// dedicated badger DB, the writes are synced to disk as raft requires
+type raftLogStore struct {
+	db *badger.DB
+}
+
+// helper function to open raft log store in given directory
+func openRaftLog(dir string) (*raftLogStore, error) {
+	key, err := encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	opts, err := dbOptions(dir, key)
+	if err != nil {
+		return nil, err
+	}
+	db, err := badger.Open(opts.WithSyncWrites(true))
+	if err != nil {
+		return nil, err
+	}
+	return &raftLogStore{db: db}, nil
+}
+
+// helper function to construct key of log entry with given index
+func raftLogKey(index uint64) []byte {
+	key := make([]byte, len(raftLogPrefix)+8)
+	copy(key, raftLogPrefix)
+	binary.BigEndian.PutUint64(key[len(raftLogPrefix):], index)
+	return key
+}
+
+// helper function to return index of first or last log entry
+func (s *raftLogStore) edgeIndex(reverse bool) (uint64, error) {
+	var index uint64
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = raftLogPrefix
+		opts.Reverse = reverse
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		start := raftLogPrefix
+		if reverse {
+			start = append(bytes.Clone(raftLogPrefix), bytes.Repeat([]byte{0xff}, 8)...)
+		}
+		it.Seek(start)
+		if it.Valid() {
+			index = binary.BigEndian.Uint64(it.Item().Key()[len(raftLogPrefix):])
+		}
+		return nil
+	})
+	return index, err
+}
+
+// FirstIndex implements raft LogStore interface
+func (s *raftLogStore) FirstIndex() (uint64, error) {
+	return s.edgeIndex(false)
+}
+
+// LastIndex implements raft LogStore interface
+func (s *raftLogStore) LastIndex() (uint64, error) {
+	return s.edgeIndex(true)
+}
+
+// GetLog implements raft LogStore interface
+func (s *raftLogStore) GetLog(index uint64, entry *raft.Log) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(raftLogKey(index))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return raft.ErrLogNotFound
+		} else if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, entry)
+		})
+	})
+}
+
+// StoreLog implements raft LogStore interface
+func (s *raftLogStore) StoreLog(entry *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{entry})
+}
+
+// StoreLogs implements raft LogStore interface
+func (s *raftLogStore) StoreLogs(entries []*raft.Log) error {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := wb.Set(raftLogKey(entry.Index), data); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// DeleteRange implements raft LogStore interface
+func (s *raftLogStore) DeleteRange(min, max uint64) error {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for index := min; index <= max && index >= min; index++ {
+		if err := wb.Delete(raftLogKey(index)); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// Set implements raft StableStore interface
+func (s *raftLogStore) Set(key, val []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(append(bytes.Clone(raftStablePrefix), key...), val)
+	})
+}
+
+// Get implements raft StableStore interface
+func (s *raftLogStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(bytes.Clone(raftStablePrefix), key...))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		val, err = item.ValueCopy(nil)
+		return err
+	})
+	return val, err
+}
+
+// SetUint64 implements raft StableStore interface
+func (s *raftLogStore) SetUint64(key []byte, val uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, val)
+	return s.Set(key, buf)
+}
+
+// GetUint64 implements raft StableStore interface
+func (s *raftLogStore) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if err != nil || len(val) != 8 {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+// Close closes underlying DB of raft log store
+func (s *raftLogStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,122 @@
+package main
+
+// rate module provides lock-free sliding window estimator of request rates
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateWindowSize defines number of one second slots of rate window, i.e.
+// the longest window we can report (15 minutes)
+const rateWindowSize = 900
+
+// rateWindows defines windows (in seconds) of reported rates
+var rateWindows = []int64{60, 300, 900}
+
+// totalRate keeps rate window of all requests
+var totalRate = &rateWindow{}
+
+// routeRates keeps rate window per route template
+var routeRates sync.Map
+
+// rateWindow represents ring buffer of per second counters. Each slot packs
+// unix time (seconds) in upper 32 bits and number of events in lower 32 bits
+// such that a slot can be updated by single compare-and-swap operation.
+type rateWindow struct {
+	slots [rateWindowSize]uint64
+}
+
+// add registers new event at given unix time
+func (w *rateWindow) add(now int64) {
+	slot := &w.slots[now%rateWindowSize]
+	sec := uint64(now) << 32
+	for {
+		old := atomic.LoadUint64(slot)
+		val := sec | 1
+		if old&^0xffffffff == sec {
+			val = old + 1
+		}
+		if atomic.CompareAndSwapUint64(slot, old, val) {
+			return
+		}
+	}
+}
+
+// rate returns average number of events per second over given window of
+// completed seconds before given unix time
+func (w *rateWindow) rate(now, window int64) float64 {
+	var total uint64
+	for i := int64(1); i <= window; i++ {
+		sec := now - i
+		val := atomic.LoadUint64(&w.slots[sec%rateWindowSize])
+		if int64(val>>32) == sec {
+			total += val & 0xffffffff
+		}
+	}
+	return float64(total) / float64(window)
+}
+
+// RouteRate represents request rates (req/sec) of given route over
+// 1, 5 and 15 minutes windows
+type RouteRate struct {
+	Route   string  `json:"route"`   // route template
+	Rate1m  float64 `json:"rate1m"`  // request rate over last minute
+	Rate5m  float64 `json:"rate5m"`  // request rate over last 5 minutes
+	Rate15m float64 `json:"rate15m"` // request rate over last 15 minutes
+}
+
+// helper function to register request of given route
+func observeRate(route string, tstamp time.Time) {
+	now := tstamp.Unix()
+	totalRate.add(now)
+	val, ok := routeRates.Load(route)
+	if !ok {
+		val, _ = routeRates.LoadOrStore(route, &rateWindow{})
+	}
+	val.(*rateWindow).add(now)
+}
+
+// helper function to get rates of given rate window
+func windowRate(route string, w *rateWindow, now int64) RouteRate {
+	return RouteRate{
+		Route:   route,
+		Rate1m:  w.rate(now, rateWindows[0]),
+		Rate5m:  w.rate(now, rateWindows[1]),
+		Rate15m: w.rate(now, rateWindows[2]),
+	}
+}
+
+// helper function to get request rates of all requests and per route
+func requestRates() (RouteRate, []RouteRate) {
+	now := time.Now().Unix()
+	var out []RouteRate
+	routeRates.Range(func(k, v interface{}) bool {
+		out = append(out, windowRate(k.(string), v.(*rateWindow), now))
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Route < out[j].Route
+	})
+	return windowRate("all", totalRate, now), out
+}
+
+// helper function to generate request rates in prometheus format
+func promRateMetrics(prefix string, total RouteRate, rates []RouteRate) string {
+	var out string
+	name := fmt.Sprintf("%s_http_request_rate", prefix)
+	out += fmt.Sprintf("# HELP %s reports HTTP request rate (req/sec) over 1m, 5m and 15m windows\n", name)
+	out += fmt.Sprintf("# TYPE %s gauge\n", name)
+	for _, rec := range append([]RouteRate{total}, rates...) {
+		route := labelEscaper.Replace(rec.Route)
+		out += fmt.Sprintf("%s{route=\"%s\",window=\"1m\"} %v\n", name, route, rec.Rate1m)
+		out += fmt.Sprintf("%s{route=\"%s\",window=\"5m\"} %v\n", name, route, rec.Rate5m)
+		out += fmt.Sprintf("%s{route=\"%s\",window=\"15m\"} %v\n", name, route, rec.Rate15m)
+	}
+	return out
+}
@@ -0,0 +1,417 @@
+package main
+
+// replica module provides read-only replica mode of our server, the replica
+// bootstraps from primary backup and follows primary change stream
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ReplicaConfig represents configuration of read-only replica
+type ReplicaConfig struct {
+	Primary           string   `json:"primary"`            // primary server URL, e.g. http://primary:9212, enables replica mode
+	Prefixes          []string `json:"prefixes"`           // replicated key prefixes, all keys by default
+	TokenFile         string   `json:"token_file"`         // file with bearer token to access primary
+	CACert            string   `json:"ca_cert"`            // CA file to verify primary certificate
+	ReconnectInterval string   `json:"reconnect_interval"` // interval between reconnects to primary, default 5s
+	MaxLag            string   `json:"max_lag"`            // replication lag which degrades readiness, default 30s
+}
+
+// replicaStateKey holds primary version to start change stream from
+const replicaStateKey = systemPrefix + "replica/since"
+
+// errReplicaWrite is returned when client attempts to write to replica
+var errReplicaWrite = errors.New("replica does not accept writes")
+
+// replication state, it is reported in metrics
+var (
+	replicaConnected  int32  // 1 if replica follows primary change stream
+	replicaVersion    uint64 // primary version of last applied change
+	replicaSynced     int64  // local time of last primary heartbeat in nanoseconds since epoch
+	replicaEvents     uint64 // total number of applied changes
+	replicaReconnects uint64 // total number of reconnects to primary
+)
+
+// ReplicationMetrics represents metrics of read-only replica
+type ReplicationMetrics struct {
+	Primary    string  `json:"primary"`    // primary server URL
+	Connected  bool    `json:"connected"`  // replica follows primary change stream
+	Version    uint64  `json:"version"`    // primary version of last applied change
+	LagSeconds float64 `json:"lagSeconds"` // time since replica was in sync with primary
+	Events     uint64  `json:"events"`     // total number of applied changes
+	Reconnects uint64  `json:"reconnects"` // total number of reconnects to primary
+}
+
+// helper function to check if server runs in replica mode
+func isReplica() bool {
+	return Config.Replica.Primary != ""
+}
+
+// helper function to create error returned to clients which attempt to
+// write to replica
+func replicaWriteError() error {
+	return newError(ReadOnlyCode, fmt.Errorf("%w, use primary %s", errReplicaWrite, Config.Replica.Primary))
+}
+
+// helper function to return URL of the primary for given request
+func primaryURL(r *http.Request) string {
+	return strings.TrimSuffix(Config.Replica.Primary, "/") + r.URL.RequestURI()
+}
+
+// helper function to return replication lag, i.e. time since replica
+// received last heartbeat of primary, the heartbeat means that all changes
+// up to its version are applied, we use local time of the replica to not
+// report clock skew of the servers as lag
+func replicaLag() time.Duration {
+	tstamp := atomic.LoadInt64(&replicaSynced)
+	if tstamp == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, tstamp))
+}
+
+// helper function to collect replication metrics
+func replicationMetrics() *ReplicationMetrics {
+	if !isReplica() {
+		return nil
+	}
+	return &ReplicationMetrics{
+		Primary:    Config.Replica.Primary,
+		Connected:  atomic.LoadInt32(&replicaConnected) == 1,
+		Version:    atomic.LoadUint64(&replicaVersion),
+		LagSeconds: replicaLag().Seconds(),
+		Events:     atomic.LoadUint64(&replicaEvents),
+		Reconnects: atomic.LoadUint64(&replicaReconnects),
+	}
+}
+
+// helper function to generate replication metrics in prometheus format
+func promReplicationMetrics(prefix string, data *ReplicationMetrics) string {
+	var out string
+	connected := 0
+	if data.Connected {
+		connected = 1
+	}
+	out += fmt.Sprintf("# HELP %s_replication_connected reports if replica follows primary change stream\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_replication_connected gauge\n", prefix)
+	out += fmt.Sprintf("%s_replication_connected %v\n", prefix, connected)
+	out += fmt.Sprintf("# HELP %s_replication_lag_seconds reports time since replica was in sync with primary\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_replication_lag_seconds gauge\n", prefix)
+	out += fmt.Sprintf("%s_replication_lag_seconds %v\n", prefix, data.LagSeconds)
+	out += fmt.Sprintf("# HELP %s_replication_version reports primary version of last applied change\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_replication_version gauge\n", prefix)
+	out += fmt.Sprintf("%s_replication_version %v\n", prefix, data.Version)
+	out += fmt.Sprintf("# HELP %s_replication_events reports total number of applied changes\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_replication_events counter\n", prefix)
+	out += fmt.Sprintf("%s_replication_events %v\n", prefix, data.Events)
+	out += fmt.Sprintf("# HELP %s_replication_reconnects reports total number of reconnects to primary\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_replication_reconnects counter\n", prefix)
+	out += fmt.Sprintf("%s_replication_reconnects %v\n", prefix, data.Reconnects)
+	return out
+}
+
+// helper function to check replication status
+func checkReplication() (string, string) {
+	if atomic.LoadInt64(&replicaSynced) == 0 {
+		return statusFail, "replica has not received primary heartbeat yet"
+	}
+	maxLag, err := time.ParseDuration(Config.Replica.MaxLag)
+	if err != nil {
+		return statusFail, fmt.Sprintf("unable to parse max lag: %v", err)
+	}
+	lag := replicaLag()
+	msg := fmt.Sprintf("lag %v", lag.Round(time.Millisecond))
+	if atomic.LoadInt32(&replicaConnected) == 0 {
+		return statusDegraded, "replica is disconnected from primary, " + msg
+	}
+	if lag > maxLag {
+		return statusDegraded, msg
+	}
+	return statusOK, msg
+}
+
+// replicaClient represents HTTP client of the primary
+type replicaClient struct {
+	client *http.Client
+	token  string
+}
+
+// helper function to create HTTP client which verifies server certificates
+// with given CA file (system CAs are used if it is not provided)
+func newHTTPClient(caCert string) (*http.Client, error) {
+	client := &http.Client{}
+	if caCert == "" {
+		return client, nil
+	}
+	data, err := os.ReadFile(caCert)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("unable to load certificates from %s", caCert)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	client.Transport = transport
+	return client, nil
+}
+
+// helper function to read bearer token from given file
+func readToken(fname string) (string, error) {
+	if fname == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// helper function to create HTTP client of the primary
+func newReplicaClient() (*replicaClient, error) {
+	client, err := newHTTPClient(Config.Replica.CACert)
+	if err != nil {
+		return nil, err
+	}
+	token, err := readToken(Config.Replica.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return &replicaClient{client: client, token: token}, nil
+}
+
+// helper function to send GET request to given primary end-point
+func (rc *replicaClient) get(ctx context.Context, path string, params url.Values) (*http.Response, error) {
+	rurl := strings.TrimSuffix(Config.Replica.Primary, "/") + strings.TrimSuffix(Config.Base, "/") + path
+	if len(params) > 0 {
+		rurl += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", rurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rc.token != "" {
+		req.Header.Set("Authorization", "Bearer "+rc.token)
+	}
+	if rid := requestID(ctx); rid != "" {
+		req.Header.Set("X-Request-ID", rid)
+	}
+	resp, err := rc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			return nil, fmt.Errorf("primary %s: %w", path, errHistoryGone)
+		}
+		var rec ErrorRecord
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err := json.Unmarshal(data, &rec); err == nil && rec.Error != "" {
+			return nil, fmt.Errorf("primary %s responded with %d: %s", path, resp.StatusCode, rec.Error)
+		}
+		return nil, fmt.Errorf("primary %s responded with %d", path, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// helper function to read version to start change stream from
+func replicaSince() (uint64, error) {
+	val, err := KV.Get([]byte(replicaStateKey))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(val), 10, 64)
+}
+
+// helper function to store version to start change stream from
+func setReplicaSince(since uint64) error {
+	return KV.Set([]byte(replicaStateKey), []byte(strconv.FormatUint(since, 10)), 0)
+}
+
+// helper function to check if key belongs to replica, i.e. it is not system
+// key of the primary and it matches replicated prefixes
+func replicaKey(key []byte) bool {
+	if isSystemKey(string(key)) {
+		return false
+	}
+	if len(Config.Replica.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range Config.Replica.Prefixes {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to bootstrap replica from primary backup, it returns
+// version to start change stream from
+func bootstrapReplica(ctx context.Context, rc *replicaClient) (uint64, error) {
+	var count int
+	err := KV.Iterate(nil, nil, func(key, value []byte) error {
+		if !isSystemKey(string(key)) {
+			count++
+			return errStopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		return 0, errors.New("replica DB is not empty and has no replication state")
+	}
+	log.Printf("replica: bootstrap from %s backup", Config.Replica.Primary)
+	time0 := time.Now()
+	resp, err := rc.get(ctx, "/admin/backup", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// only replicated keys are loaded from the backup, i.e. system keys of
+	// the primary (snapshots, canary) and keys of other prefixes are skipped
+	err = loadBackup(resp.Body, replicaKey)
+	var since uint64
+	if err == nil {
+		// backup version is sent in trailer which is available after the body
+		io.Copy(io.Discard, resp.Body)
+		since, err = strconv.ParseUint(resp.Trailer.Get("X-Backup-Version"), 10, 64)
+	}
+	if err != nil {
+		// drop partially loaded backup to be able to bootstrap again
+		if e := DB.DropAll(); e != nil {
+			slog.Error("replica: unable to drop partially loaded backup", "error", e)
+		}
+		return 0, fmt.Errorf("unable to load primary backup: %w", err)
+	}
+
+	if err := setReplicaSince(since); err != nil {
+		return 0, err
+	}
+	log.Printf("replica: bootstrap completed in %v, next version %d", time.Since(time0), since)
+	return since, nil
+}
+
+// helper function to apply change event to replica DB
+func applyChange(ev ChangeEvent) error {
+	var ttl time.Duration
+	if ev.ExpiresAt > 0 {
+		ttl = time.Until(time.Unix(int64(ev.ExpiresAt), 0))
+	}
+	return KV.Txn(true, func(txn KVTxn) error {
+		if ev.Deleted || (ev.ExpiresAt > 0 && ttl <= 0) {
+			return txn.Delete(ev.Key)
+		}
+		return txn.Set(ev.Key, ev.Value, ttl)
+	})
+}
+
+// helper function to follow primary change stream starting from given
+// version, the version is updated on every heartbeat of the primary
+func followPrimary(ctx context.Context, rc *replicaClient, since *uint64) error {
+	params := url.Values{}
+	params.Set("since", strconv.FormatUint(*since, 10))
+	for _, prefix := range Config.Replica.Prefixes {
+		params.Add("prefix", prefix)
+	}
+	resp, err := rc.get(ctx, "/admin/changes", params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	log.Printf("replica: follow %s changes since version %d", Config.Replica.Primary, *since)
+	atomic.StoreInt32(&replicaConnected, 1)
+	defer atomic.StoreInt32(&replicaConnected, 0)
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev ChangeEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return errors.New("primary closed change stream")
+			}
+			return err
+		}
+		if ev.heartbeat() {
+			if ev.Version+1 > *since {
+				if err := setReplicaSince(ev.Version + 1); err != nil {
+					return err
+				}
+				*since = ev.Version + 1
+			}
+			atomic.StoreInt64(&replicaSynced, time.Now().UnixNano())
+			continue
+		}
+		if err := applyChange(ev); err != nil {
+			return err
+		}
+		atomic.StoreUint64(&replicaVersion, ev.Version)
+		atomic.AddUint64(&replicaEvents, 1)
+	}
+}
+
+// helper function to replicate primary DB until given context is cancelled,
+// the replica bootstraps from primary backup if it has no replication state
+// and reconnects to the primary change stream on failures
+func replicate(ctx context.Context) {
+	interval, err := time.ParseDuration(Config.Replica.ReconnectInterval)
+	if err != nil {
+		slog.Error("unable to parse replica reconnect interval", "interval", Config.Replica.ReconnectInterval, "error", err)
+		return
+	}
+	rc, err := newReplicaClient()
+	if err != nil {
+		slog.Error("unable to create replica client", "error", err)
+		return
+	}
+	ctx = context.WithValue(ctx, requestIDKey{}, newRequestID())
+	for {
+		since, err := replicaSince()
+		if errors.Is(err, errKeyNotFound) {
+			since, err = bootstrapReplica(ctx, rc)
+		}
+		if err == nil {
+			err = followPrimary(ctx, rc, &since)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errHistoryGone) {
+			// primary no longer has deletes made since our version,
+			// therefore we drop replica DB and bootstrap it again
+			slog.Warn("replica: primary history is pruned, bootstrap replica again", "since", since, "error", err)
+			if err = DB.DropAll(); err == nil {
+				continue
+			}
+		}
+		slog.Error("replica: unable to follow primary", "primary", Config.Replica.Primary, "error", err)
+		atomic.AddUint64(&replicaReconnects, 1)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+// requestid module provides request ids which correlate HTTP requests,
+// responses and log records
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+// requestIDHeader represents HTTP header used to pass request id
+const requestIDHeader = "X-Request-ID"
+
+// maximum length of request id accepted from clients
+const maxRequestIDLength = 128
+
+// requestIDKey represents context key of request id
+type requestIDKey struct{}
+
+// helper function to generate new random request id
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// helper function to check request id provided by client, we only accept
+// printable ASCII characters to keep our logs and headers safe
+func validRequestID(rid string) bool {
+	if rid == "" || len(rid) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range rid {
+		if c <= ' ' || c > '~' || c == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// helper function to return request id of given context
+func requestID(ctx context.Context) string {
+	if rid, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return rid
+	}
+	return ""
+}
+
+// request id middleware accepts request id from client or generates a new
+// one, puts it into request context and response headers
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rid := r.Header.Get(requestIDHeader)
+		if !validRequestID(rid) {
+			rid = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, rid)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, rid)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// contextLogHandler implements slog.Handler interface and adds request and
+// trace ids of record context to every log record
+type contextLogHandler struct {
+	slog.Handler
+}
+
+// Handle implements slog.Handler interface
+func (h contextLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if rid := requestID(ctx); rid != "" {
+			r.AddAttrs(slog.String("request_id", rid))
+		}
+		if tid := traceID(ctx); tid != "" {
+			r.AddAttrs(slog.String("trace_id", tid))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler interface
+func (h contextLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextLogHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup implements slog.Handler interface
+func (h contextLogHandler) WithGroup(name string) slog.Handler {
+	return contextLogHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,684 @@
+package main
+
+// resp module provides Redis RESP protocol front-end of our server, it
+// allows tools which talk to Redis to use cmskv as persistent backend
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// limits of RESP commands, the inline commands and commands of clients
+// which are not authenticated yet are limited to respMaxInline bytes, other
+// commands are limited by max_body_size or by respMaxCommand if it is not
+// set (the same limits are used by Redis)
+const (
+	respMaxArgs    = 1 << 20   // max number of arguments of the command
+	respMaxInline  = 64 << 10  // max size of inline command or line
+	respMaxCommand = 512 << 20 // max size of the command
+)
+
+// max number of SCAN cursors kept per connection
+const respMaxCursors = 16
+
+// respMethod is used as HTTP method label of RESP commands in our metrics
+const respMethod = "RESP"
+
+// errRespSyntax is returned for malformed commands
+var errRespSyntax = badRequest(errors.New("syntax error"))
+
+// respCommand represents RESP command handler
+type respCommand struct {
+	arity int  // minimal number of arguments including command name
+	write bool // command modifies DB
+	admin bool // command always requires authentication like admin end-points
+	run   func(c *respConn, args []string) error
+}
+
+// respCommands represents supported RESP commands
+var respCommands map[string]respCommand
+
+func init() {
+	respCommands = map[string]respCommand{
+		"PING":    {1, false, false, respPing},
+		"ECHO":    {2, false, false, respEcho},
+		"QUIT":    {1, false, false, respQuit},
+		"AUTH":    {2, false, false, respAuth},
+		"COMMAND": {1, false, false, respCommandInfo},
+		"GET":     {2, false, false, respGet},
+		"MGET":    {2, false, false, respMGet},
+		"EXISTS":  {2, false, false, respExists},
+		"SCAN":    {2, false, true, respScan},
+		"SET":     {3, true, false, respSet},
+		"MSET":    {3, true, false, respMSet},
+		"DEL":     {2, true, true, respDel},
+		"ANON":    {2, true, false, respAnon},
+	}
+}
+
+// respConn represents client connection of RESP server
+type respConn struct {
+	conn          net.Conn
+	r             *bufio.Reader
+	w             *bufio.Writer
+	ctx           context.Context // context of current command
+	authenticated bool
+	quit          bool
+	cursors       map[uint64]string // SCAN cursors and their last keys
+	cursorSeq     uint64            // id of last SCAN cursor
+}
+
+// helper function to read line terminated by CRLF, the line size is
+// limited by size of connection reader buffer, i.e. respMaxInline
+func (c *respConn) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", badRequest(errors.New("too big inline request"))
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// helper function to read RESP command of given max size, we support both
+// RESP arrays of bulk strings and inline commands
+func (c *respConn) readCommand(limit int64) ([]string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	num, err := strconv.Atoi(line[1:])
+	if err != nil || num < 0 || num > respMaxArgs {
+		return nil, errRespSyntax
+	}
+	// the number of arguments is not trusted until they are read
+	args := make([]string, 0, min(num, 1024))
+	total := int64(len(line))
+	for i := 0; i < num; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errRespSyntax
+		}
+		size, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil || size < 0 {
+			return nil, errRespSyntax
+		}
+		total += size
+		if total > limit {
+			return nil, &http.MaxBytesError{Limit: limit}
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// helper function to write RESP simple string
+func (c *respConn) writeSimple(s string) {
+	fmt.Fprintf(c.w, "+%s\r\n", s)
+}
+
+// helper function to write RESP error
+func (c *respConn) writeError(s string) {
+	fmt.Fprintf(c.w, "-%s\r\n", strings.ReplaceAll(s, "\r\n", " "))
+}
+
+// helper function to write RESP integer
+func (c *respConn) writeInt(n int) {
+	fmt.Fprintf(c.w, ":%d\r\n", n)
+}
+
+// helper function to write RESP bulk string, nil value is written as null
+// bulk string
+func (c *respConn) writeBulk(s *string) {
+	if s == nil {
+		c.w.WriteString("$-1\r\n")
+		return
+	}
+	fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(*s), *s)
+}
+
+// helper function to write RESP array header
+func (c *respConn) writeArray(n int) {
+	fmt.Fprintf(c.w, "*%d\r\n", n)
+}
+
+// helper function to write RESP error reply of given error, the error
+// prefixes follow Redis conventions
+func (c *respConn) writeServerError(serr *ServerError) {
+	switch serr.Code {
+	case UnauthorizedCode:
+		c.writeError("NOAUTH Authentication required.")
+	case ReadOnlyCode:
+		c.writeError("READONLY " + serr.Error())
+	default:
+		c.writeError("ERR " + serr.Error())
+	}
+}
+
+// PING command
+func respPing(c *respConn, args []string) error {
+	if len(args) > 1 {
+		c.writeBulk(&args[1])
+		return nil
+	}
+	c.writeSimple("PONG")
+	return nil
+}
+
+// ECHO command
+func respEcho(c *respConn, args []string) error {
+	c.writeBulk(&args[1])
+	return nil
+}
+
+// QUIT command
+func respQuit(c *respConn, args []string) error {
+	c.quit = true
+	c.writeSimple("OK")
+	return nil
+}
+
+// AUTH command, we accept either AUTH token or AUTH user token
+func respAuth(c *respConn, args []string) error {
+	if !validToken(args[len(args)-1]) {
+		c.writeError("WRONGPASS invalid username-password pair or user is disabled.")
+		return nil
+	}
+	c.authenticated = true
+	c.writeSimple("OK")
+	return nil
+}
+
+// COMMAND command, clients use it to discover commands, we reply with
+// empty list
+func respCommandInfo(c *respConn, args []string) error {
+	c.writeArray(0)
+	return nil
+}
+
+// GET command, the reads of clustered node use default read consistency of
+// the cluster in all read commands
+func respGet(c *respConn, args []string) error {
+	if err := consistentRead(c.ctx, ""); err != nil {
+		return err
+	}
+	rec, err := fetchRecord(c.ctx, args[1])
+	if errors.Is(err, errKeyNotFound) {
+		c.writeBulk(nil)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	c.writeBulk(&rec.Value)
+	return nil
+}
+
+// MGET command
+func respMGet(c *respConn, args []string) error {
+	if err := consistentRead(c.ctx, ""); err != nil {
+		return err
+	}
+	var values []*string
+	for _, key := range args[1:] {
+		rec, err := fetchRecord(c.ctx, key)
+		if errors.Is(err, errKeyNotFound) {
+			values = append(values, nil)
+			continue
+		} else if err != nil {
+			return err
+		}
+		values = append(values, &rec.Value)
+	}
+	c.writeArray(len(values))
+	for _, val := range values {
+		c.writeBulk(val)
+	}
+	return nil
+}
+
+// EXISTS command
+func respExists(c *respConn, args []string) error {
+	if err := consistentRead(c.ctx, ""); err != nil {
+		return err
+	}
+	var count int
+	for _, key := range args[1:] {
+		_, err := fetchRecord(c.ctx, key)
+		if errors.Is(err, errKeyNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		count++
+	}
+	c.writeInt(count)
+	return nil
+}
+
+// SET command, we support EX and PX options
+func respSet(c *respConn, args []string) error {
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		if (opt != "EX" && opt != "PX") || i+1 >= len(args) {
+			return errRespSyntax
+		}
+		val, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || val <= 0 {
+			return badRequest(errors.New("invalid expire time in 'set' command"))
+		}
+		ttl = time.Duration(val) * time.Second
+		if opt == "PX" {
+			ttl = time.Duration(val) * time.Millisecond
+		}
+		i++
+	}
+	if err := setRecords(c.ctx, []Record{{Key: args[1], Value: args[2]}}, ttl); err != nil {
+		return err
+	}
+	c.writeSimple("OK")
+	return nil
+}
+
+// MSET command
+func respMSet(c *respConn, args []string) error {
+	if len(args)%2 != 1 {
+		return badRequest(errors.New("wrong number of arguments for 'mset' command"))
+	}
+	var recs []Record
+	for i := 1; i < len(args); i += 2 {
+		recs = append(recs, Record{Key: args[i], Value: args[i+1]})
+	}
+	if err := setRecords(c.ctx, recs, 0); err != nil {
+		return err
+	}
+	c.writeSimple("OK")
+	return nil
+}
+
+// DEL command, reverse look-up records are deleted as well
+func respDel(c *respConn, args []string) error {
+	var count int
+	for _, key := range args[1:] {
+		_, err := deleteRecord(c.ctx, key)
+		if errors.Is(err, errKeyNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		count++
+	}
+	c.writeInt(count)
+	return nil
+}
+
+// ANON command anonymises given key in the same way as store API, i.e.
+// ANON key [sha1|sha256|sha512] stores hash of the key and its reverse
+// look-up record and returns the hash
+func respAnon(c *respConn, args []string) error {
+	rec := HTTPRecord{Record: Record{Key: args[1]}}
+	if len(args) > 2 {
+		rec.Sha = strings.ToLower(args[2])
+	}
+	if err := storeRecord(c.ctx, &rec); err != nil {
+		return err
+	}
+	c.writeBulk(&rec.Value)
+	return nil
+}
+
+// SCAN command, the cursor refers to the last key returned by previous SCAN
+// call of the connection, we support MATCH and COUNT options
+func respScan(c *respConn, args []string) error {
+	if err := consistentRead(c.ctx, ""); err != nil {
+		return err
+	}
+	var after string
+	if args[1] != "0" {
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		key, ok := c.cursors[id]
+		if err != nil || !ok {
+			return badRequest(errors.New("invalid cursor"))
+		}
+		after = key
+	}
+	pattern, count := "", 10
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errRespSyntax
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			var err error
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count <= 0 {
+				return errRespSyntax
+			}
+		default:
+			return errRespSyntax
+		}
+	}
+	// literal part of the pattern limits keys we iterate over
+	prefix := pattern
+	if idx := strings.IndexAny(pattern, `*?[\`); idx >= 0 {
+		prefix = pattern[:idx]
+	}
+	var keys []string
+	var last string
+	var scanned int
+	err := listRecords(prefix, after, count, func(rec Record) error {
+		scanned++
+		last = rec.Key
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, rec.Key); !ok {
+				return nil
+			}
+		}
+		keys = append(keys, rec.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	next := "0"
+	if scanned == count {
+		// there may be more keys, we keep the last key under new cursor
+		c.cursorSeq++
+		c.cursors[c.cursorSeq] = last
+		delete(c.cursors, c.cursorSeq-respMaxCursors)
+		next = strconv.FormatUint(c.cursorSeq, 10)
+	}
+	c.writeArray(2)
+	c.writeBulk(&next)
+	c.writeArray(len(keys))
+	for i := range keys {
+		c.writeBulk(&keys[i])
+	}
+	return nil
+}
+
+// respServer represents RESP server
+type respServer struct {
+	ln          net.Listener
+	middlewares []string
+	closing     int32
+	mu          sync.Mutex
+	conns       map[net.Conn]bool // connections and their busy status
+	wg          sync.WaitGroup
+}
+
+// helper function to check if server uses given middleware
+func (s *respServer) uses(name string) bool {
+	return hasMiddleware(s.middlewares, name)
+}
+
+// helper function to return max size of the next command of given
+// connection, clients which are not authenticated yet can only send small
+// commands, e.g. AUTH
+func (s *respServer) commandLimit(c *respConn) int64 {
+	if s.uses("auth") && !c.authenticated {
+		return respMaxInline
+	}
+	if Config.MaxBodySize > 0 {
+		return Config.MaxBodySize
+	}
+	return respMaxCommand
+}
+
+// helper function to execute RESP command
+func (s *respServer) execute(c *respConn, args []string) {
+	start := time.Now()
+	name := strings.ToUpper(args[0])
+	route := "resp:" + name
+	cmd, ok := respCommands[name]
+	if !ok {
+		route = "resp:other"
+	}
+	atomic.AddInt64(&InFlightRequests, 1)
+	defer atomic.AddInt64(&InFlightRequests, -1)
+	ctx := context.WithValue(context.Background(), requestIDKey{}, newRequestID())
+	ctx, span := tracer.Start(ctx, route)
+	c.ctx = ctx
+
+	var err error
+	switch {
+	case !ok:
+		err = badRequest(fmt.Errorf("unknown command '%s'", args[0]))
+	case len(args) < cmd.arity:
+		err = badRequest(fmt.Errorf("wrong number of arguments for '%s' command", strings.ToLower(name)))
+	case s.uses("auth") && !c.authenticated && name != "AUTH" && name != "PING" && name != "QUIT":
+		err = errUnauthorized
+	case cmd.admin && !c.authenticated:
+		// SCAN and DEL expose and delete all records like export and
+		// delete admin end-points, therefore they require authentication
+		err = errUnauthorized
+	case cmd.write && Config.ReadOnly:
+		err = errReadOnly
+	}
+	if err == nil && s.uses("limit") {
+		err = respLimit(ctx, c.conn.RemoteAddr())
+	}
+	if err == nil {
+		err = cmd.run(c, args)
+	}
+	code := http.StatusOK
+	if err != nil {
+		serr := serverError(err)
+		code = serr.Status()
+		spanError(span, err)
+		if code >= http.StatusInternalServerError {
+			slog.ErrorContext(ctx, route, "code", serr.Code, "error", err)
+		} else {
+			slog.WarnContext(ctx, route, "code", serr.Code, "error", err)
+		}
+		c.writeServerError(serr)
+	}
+	endRequestSpan(span, code)
+	duration := time.Since(start)
+	observeRequest(route, respMethod, code, duration)
+	observeRate(route, start)
+	respAccessLog(ctx, c.conn.RemoteAddr(), route, code, duration)
+}
+
+// helper function to write access log record of RESP command
+func respAccessLog(ctx context.Context, addr net.Addr, route string, code int, duration time.Duration) {
+	if Config.LogFormat != "json" {
+		msg := fmt.Sprintf("%v %s %s %v", code, respMethod, route, duration)
+		if rid := requestID(ctx); rid != "" {
+			msg += " request_id=" + rid
+		}
+		log.Println(msg)
+	} else {
+		// request and trace ids are added by context log handler
+		slog.LogAttrs(ctx, slog.LevelInfo, "request",
+			slog.String("remote_addr", addr.String()),
+			slog.String("method", respMethod),
+			slog.String("route", route),
+			slog.Int("status", code),
+			slog.Float64("duration", duration.Seconds()))
+	}
+}
+
+// helper function to check rate limit of RESP command, the limit is
+// applied per client IP address
+func respLimit(ctx context.Context, addr net.Addr) error {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	lctx, err := rateLimiter.Get(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if lctx.Reached {
+		return errRateLimited
+	}
+	return nil
+}
+
+// helper function to set busy status of given connection
+func (s *respServer) setBusy(conn net.Conn, busy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = busy
+}
+
+// helper function to serve client connection
+func (s *respServer) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	c := &respConn{
+		conn:    conn,
+		r:       bufio.NewReaderSize(conn, respMaxInline),
+		w:       bufio.NewWriter(conn),
+		ctx:     context.Background(),
+		cursors: make(map[uint64]string),
+	}
+	// clients with verified certificates are authenticated
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			slog.Warn("unable to perform TLS handshake of RESP connection", "error", err)
+			return
+		}
+		c.authenticated = len(tc.ConnectionState().VerifiedChains) > 0
+	}
+	idle, _ := time.ParseDuration(Config.IdleTimeout)
+	for !c.quit && atomic.LoadInt32(&s.closing) == 0 {
+		if idle > 0 {
+			conn.SetReadDeadline(time.Now().Add(idle))
+		}
+		args, err := c.readCommand(s.commandLimit(c))
+		if err != nil {
+			var serr *ServerError
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &serr) || errors.As(err, &maxErr) {
+				// protocol errors, we report them and close the connection
+				c.writeServerError(serverError(err))
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		s.setBusy(conn, true)
+		s.execute(c, args)
+		// flush replies only when client does not pipeline more commands
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+		s.setBusy(conn, false)
+	}
+	c.w.Flush()
+}
+
+// helper function to accept client connections
+func (s *respServer) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&s.closing) == 0 {
+				slog.Error("unable to accept RESP connection", "error", err)
+			}
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = false
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// Shutdown stops accepting new connections, closes idle connections and
+// waits for busy ones to finish their commands
+func (s *respServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.closing, 1)
+	s.ln.Close()
+	s.mu.Lock()
+	for conn, busy := range s.conns {
+		if busy {
+			// unblock next read of busy connection after current command
+			conn.SetReadDeadline(time.Now())
+		} else {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes listener and all client connections
+func (s *respServer) Close() error {
+	atomic.StoreInt32(&s.closing, 1)
+	err := s.ln.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// helper function to start RESP server with given listener configuration
+func startRESP(lc ListenerConfig) (stoppable, error) {
+	if lc.Network == "" {
+		lc.Network = "tcp"
+	}
+	if lc.Middlewares == nil {
+		lc.Middlewares = defaultMiddlewares()
+	}
+	ln, err := newListener(lc)
+	if err != nil {
+		return nil, err
+	}
+	srv := &respServer{ln: ln, middlewares: lc.Middlewares, conns: make(map[net.Conn]bool)}
+	log.Printf("Starting RESP server on %s", lc)
+	go srv.accept()
+	return srv, nil
+}
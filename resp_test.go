@@ -0,0 +1,263 @@
+package main
+
+// resp_test module provides tests of Redis RESP protocol front-end
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRespClient represents RESP client of our tests
+type testRespClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// helper function to start RESP server with given middlewares and connect
+// to it
+func setupRESP(t *testing.T, middlewares []string) *testRespClient {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &respServer{ln: ln, middlewares: middlewares, conns: make(map[net.Conn]bool)}
+	go srv.accept()
+	t.Cleanup(func() { srv.Close() })
+	return dialRESP(t, ln.Addr().String())
+}
+
+// helper function to connect to RESP server of given address
+func dialRESP(t *testing.T, addr string) *testRespClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	return &testRespClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// helper function to send raw data to the server
+func (c *testRespClient) send(data string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// helper function to read reply of the server, simple strings and errors
+// are returned with their prefix, bulk strings as is (nil as "(nil)") and
+// arrays as space separated list in brackets
+func (c *testRespClient) reply() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("unable to read reply: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		return string(buf[:size])
+	case '*':
+		num, _ := strconv.Atoi(line[1:])
+		var items []string
+		for i := 0; i < num; i++ {
+			items = append(items, c.reply())
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	return line
+}
+
+// helper function to send command as RESP array and return its reply
+func (c *testRespClient) do(args ...string) string {
+	c.t.Helper()
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.send(cmd)
+	return c.reply()
+}
+
+// helper function to check reply of given command
+func (c *testRespClient) expect(reply string, args ...string) {
+	c.t.Helper()
+	if got := c.do(args...); got != reply {
+		c.t.Fatalf("%v: expect %q, got %q", args, reply, got)
+	}
+}
+
+// helper function to check that connection is closed by the server
+func (c *testRespClient) expectClosed() {
+	c.t.Helper()
+	// the connection may be reset if server did not read all our data
+	if b, err := c.r.ReadByte(); err == nil {
+		c.t.Fatalf("expect closed connection, got %q", b)
+	}
+}
+
+// TestRespParser checks inline and array commands and protocol errors
+func TestRespParser(t *testing.T) {
+	setupMemory(t)
+	c := setupRESP(t, nil)
+	c.send("PING\r\n")
+	if reply := c.reply(); reply != "+PONG" {
+		t.Fatalf("inline PING: expect +PONG, got %q", reply)
+	}
+	c.send("ECHO hello\n")
+	if reply := c.reply(); reply != "hello" {
+		t.Fatalf("inline ECHO: expect hello, got %q", reply)
+	}
+	// bulk strings may contain CRLF
+	c.expect("+OK", "SET", "k1", "a\r\nb")
+	c.expect("a\r\nb", "GET", "k1")
+	c.expect("(nil)", "GET", "missing")
+	c.expect("[a\r\nb (nil)]", "MGET", "k1", "missing")
+	c.expect(":1", "EXISTS", "k1", "missing")
+	c.expect("-ERR unknown command 'FOO'", "FOO")
+	c.expect("-ERR wrong number of arguments for 'get' command", "GET")
+	c.expect("-ERR syntax error", "SET", "k1", "v", "EX")
+	// pipelined commands are replied in order
+	c.send("*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$2\r\nk1\r\n")
+	if r1, r2 := c.reply(), c.reply(); r1 != "+PONG" || r2 != "a\r\nb" {
+		t.Fatalf("pipeline: got %q %q", r1, r2)
+	}
+	// malformed array closes connection
+	c.send("*x\r\n")
+	if reply := c.reply(); reply != "-ERR syntax error" {
+		t.Fatalf("malformed command: expect syntax error, got %q", reply)
+	}
+	c.expectClosed()
+
+	// too big inline command closes connection
+	c = setupRESP(t, nil)
+	c.send("ECHO " + strings.Repeat("x", respMaxInline) + "\r\n")
+	if reply := c.reply(); !strings.HasPrefix(reply, "-ERR too big inline request") {
+		t.Fatalf("big inline command: got %q", reply)
+	}
+	c.expectClosed()
+}
+
+// TestRespAuth checks authentication flow with auth middleware and
+// authentication of admin commands without it
+func TestRespAuth(t *testing.T) {
+	setupMemory(t)
+	setupTokens(t, "secret")
+
+	c := setupRESP(t, []string{"auth"})
+	c.expect("+PONG", "PING")
+	c.expect("-NOAUTH Authentication required.", "GET", "k1")
+	c.expect("-NOAUTH Authentication required.", "SET", "k1", "v1")
+	c.expect("-WRONGPASS invalid username-password pair or user is disabled.", "AUTH", "wrong")
+	// commands of unauthenticated clients are limited to respMaxInline
+	c.send(fmt.Sprintf("*2\r\n$4\r\nAUTH\r\n$%d\r\n", respMaxInline+1))
+	if reply := c.reply(); !strings.HasPrefix(reply, "-ERR") {
+		t.Fatalf("big command before AUTH: expect error, got %q", reply)
+	}
+	c.expectClosed()
+
+	c = setupRESP(t, []string{"auth"})
+	c.expect("+OK", "AUTH", "default", "secret")
+	c.expect("+OK", "SET", "k1", "v1")
+	c.expect("v1", "GET", "k1")
+	c.expect(":1", "DEL", "k1")
+
+	// admin commands require authentication without auth middleware
+	c = setupRESP(t, nil)
+	c.expect("+OK", "SET", "k1", "v1")
+	c.expect("v1", "GET", "k1")
+	c.expect("-NOAUTH Authentication required.", "SCAN", "0")
+	c.expect("-NOAUTH Authentication required.", "DEL", "k1")
+	c.expect("+OK", "AUTH", "secret")
+	c.expect("[0 [k1]]", "SCAN", "0")
+	c.expect(":1", "DEL", "k1")
+	c.expect("(nil)", "GET", "k1")
+}
+
+// TestRespScan checks SCAN cursors and options
+func TestRespScan(t *testing.T) {
+	setupMemory(t)
+	setupTokens(t, "secret")
+	c := setupRESP(t, nil)
+	c.expect("+OK", "AUTH", "secret")
+	var expect []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		c.expect("+OK", "SET", key, "v")
+		expect = append(expect, key)
+	}
+	c.expect("+OK", "SET", "other", "v")
+
+	var keys []string
+	cursor := "0"
+	for i := 0; ; i++ {
+		reply := c.do("SCAN", cursor, "MATCH", "k*", "COUNT", "10")
+		if _, err := fmt.Sscanf(reply, "[%s", &cursor); err != nil {
+			t.Fatalf("unexpected SCAN reply %q", reply)
+		}
+		items := strings.TrimSuffix(strings.TrimPrefix(reply, "["+cursor+" ["), "]]")
+		keys = append(keys, strings.Fields(items)...)
+		if cursor == "0" {
+			break
+		}
+		if i > 3 {
+			t.Fatal("SCAN does not finish")
+		}
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, " ") != strings.Join(expect, " ") {
+		t.Fatalf("SCAN: expect %v, got %v", expect, keys)
+	}
+	c.expect("[0 [k01 k11 k21]]", "SCAN", "0", "MATCH", "k?1", "COUNT", "100")
+	c.expect("-ERR invalid cursor", "SCAN", "12345")
+	c.expect("-ERR syntax error", "SCAN", "0", "COUNT")
+	c.expect("-ERR syntax error", "SCAN", "0", "COUNT", "0")
+}
+
+// TestRespSetReverse checks that SET and MSET do not modify keys which
+// have reverse look-up records
+func TestRespSetReverse(t *testing.T) {
+	setupMemory(t)
+	c := setupRESP(t, nil)
+	hash := c.do("ANON", "alice")
+	if len(hash) != 40 {
+		t.Fatalf("ANON: expect sha1 hash, got %q", hash)
+	}
+	c.expect("alice", "GET", hash)
+	for _, key := range []string{"alice", hash} {
+		if reply := c.do("SET", key, "x"); !strings.HasPrefix(reply, "-ERR") {
+			t.Fatalf("SET %s: expect error, got %q", key, reply)
+		}
+		if reply := c.do("MSET", "k1", "v1", key, "x"); !strings.HasPrefix(reply, "-ERR") {
+			t.Fatalf("MSET %s: expect error, got %q", key, reply)
+		}
+	}
+	// failed MSET does not set any key
+	c.expect("(nil)", "GET", "k1")
+	c.expect(hash, "GET", "alice")
+	c.expect("alice", "GET", hash)
+	c.expect("+OK", "MSET", "k1", "v1", "k2", "v2")
+	c.expect("+OK", "SET", "k1", "v3")
+	c.expect("[v3 v2]", "MGET", "k1", "k2")
+}
@@ -0,0 +1,540 @@
+package main
+
+// router module provides router mode of our server, the records are
+// distributed across backend cmskv shards using consistent hashing of their
+// keys and values
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RouterConfig represents configuration of router mode
+type RouterConfig struct {
+	Shards         []ShardConfig `json:"shards"`          // backend shards, enables router mode
+	PreviousShards []ShardConfig `json:"previous_shards"` // shards of previous configuration which are used until rebalance is completed
+	VirtualNodes   int           `json:"virtual_nodes"`   // number of points of every shard on hash ring, default 128
+	TokenFile      string        `json:"token_file"`      // file with bearer token to access shards
+	CACert         string        `json:"ca_cert"`         // CA file to verify shard certificates
+	Timeout        string        `json:"timeout"`         // timeout of shard requests, default 10s
+}
+
+// ShardConfig represents backend shard
+type ShardConfig struct {
+	Name string `json:"name"` // shard name, it defines placement of records and should never change
+	URL  string `json:"url"`  // shard URL, e.g. http://shard1:9212
+}
+
+// shard represents backend shard along with its metrics
+type shard struct {
+	ShardConfig
+	requests uint64 // total number of requests sent to the shard
+	errors   uint64 // total number of failed requests
+}
+
+// hashRing represents consistent hash ring of shards, every shard has
+// multiple points on the ring and record belongs to the shard of the first
+// point which follows hash of its key
+type hashRing struct {
+	points []uint64
+	shards []*shard
+}
+
+// router state
+var (
+	ring         *hashRing // hash ring of current shards
+	prevRing     *hashRing // hash ring of previous shards, nil if they are not configured
+	routerShards []*shard  // current and previous shards
+	routerClient *http.Client
+	routerToken  string
+)
+
+// errRouterList is returned by operations which require scan of all records
+var errRouterList = newError(UnavailableCode, errors.New("listing of records is not supported in router mode"))
+
+// helper function to check if server runs in router mode
+func isRouter() bool {
+	return len(Config.Router.Shards) > 0
+}
+
+// helper function to hash given string into position on hash ring
+func ringHash(s string) uint64 {
+	h := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+// helper function to create hash ring of given shards
+func newHashRing(shards []*shard, vnodes int) *hashRing {
+	type point struct {
+		hash  uint64
+		shard *shard
+	}
+	var points []point
+	for _, s := range shards {
+		for i := 0; i < vnodes; i++ {
+			points = append(points, point{ringHash(fmt.Sprintf("%s#%d", s.Name, i)), s})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	r := &hashRing{}
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.shards = append(r.shards, p.shard)
+	}
+	return r
+}
+
+// helper function to find shard of given key
+func (r *hashRing) shard(key string) *shard {
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.shards[i]
+}
+
+// helper function to find shards of given record, the record and its
+// reverse look-up record are kept on shards of both key and value
+func (r *hashRing) owners(rec Record) []*shard {
+	ks := r.shard(rec.Key)
+	if vs := r.shard(rec.Value); vs != ks {
+		return []*shard{ks, vs}
+	}
+	return []*shard{ks}
+}
+
+// helper function to find shards of given key in current and previous hash
+// rings, the shard of current ring comes first
+func routeShards(key string) []*shard {
+	s := ring.shard(key)
+	if prevRing == nil {
+		return []*shard{s}
+	}
+	if ps := prevRing.shard(key); ps != s {
+		return []*shard{s, ps}
+	}
+	return []*shard{s}
+}
+
+// helper function to create shards of given configuration, the shards which
+// are already known by name are reused
+func routerShardList(configs []ShardConfig, known map[string]*shard) ([]*shard, error) {
+	var shards []*shard
+	names := make(map[string]bool)
+	for _, sc := range configs {
+		if sc.Name == "" || sc.URL == "" {
+			return nil, errors.New("shard name and URL are required")
+		}
+		if names[sc.Name] {
+			return nil, fmt.Errorf("duplicate shard name %s", sc.Name)
+		}
+		names[sc.Name] = true
+		s, ok := known[sc.Name]
+		if !ok {
+			s = &shard{ShardConfig: sc}
+			known[sc.Name] = s
+			routerShards = append(routerShards, s)
+		} else if s.URL != sc.URL {
+			return nil, fmt.Errorf("shard %s has different URLs in current and previous shards", sc.Name)
+		}
+		shards = append(shards, s)
+	}
+	return shards, nil
+}
+
+// helper function to initialize router mode
+func initRouter() error {
+	rc := Config.Router
+	if !isRouter() {
+		return nil
+	}
+	if isReplica() || isClustered() {
+		return errors.New("router mode can not be used in replica or clustered modes")
+	}
+	// the records are stored by shards, therefore webhooks should be
+	// configured on shards
+	if len(Config.Webhooks) > 0 {
+		return errors.New("webhooks are not supported in router mode, configure them on shards")
+	}
+	routerShards = nil
+	known := make(map[string]*shard)
+	shards, err := routerShardList(rc.Shards, known)
+	if err != nil {
+		return err
+	}
+	var prevShards []*shard
+	if len(rc.PreviousShards) > 0 {
+		prevShards, err = routerShardList(rc.PreviousShards, known)
+		if err != nil {
+			return err
+		}
+	}
+	timeout, err := time.ParseDuration(rc.Timeout)
+	if err != nil {
+		return fmt.Errorf("unable to parse shard timeout: %w", err)
+	}
+	routerClient, err = newHTTPClient(rc.CACert)
+	if err != nil {
+		return err
+	}
+	routerClient.Timeout = timeout
+	routerToken, err = readToken(rc.TokenFile)
+	if err != nil {
+		return err
+	}
+	ring = newHashRing(shards, rc.VirtualNodes)
+	prevRing = nil
+	if len(prevShards) > 0 {
+		prevRing = newHashRing(prevShards, rc.VirtualNodes)
+	}
+	for _, s := range shards {
+		log.Printf("router: shard %s url=%s", s.Name, s.URL)
+	}
+	for _, s := range prevShards {
+		log.Printf("router: previous shard %s url=%s", s.Name, s.URL)
+	}
+	return nil
+}
+
+// helper function to convert error response of the shard into our error
+func shardError(s *shard, resp *http.Response) error {
+	var rec ErrorRecord
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err := json.Unmarshal(data, &rec); err != nil || rec.Code == "" {
+		return newError(UnavailableCode, fmt.Errorf("shard %s responded with %d", s.Name, resp.StatusCode))
+	}
+	if rec.Code == NotFoundCode {
+		return errKeyNotFound
+	}
+	return newError(rec.Code, fmt.Errorf("shard %s: %s", s.Name, rec.Error))
+}
+
+// number of attempts of shard request which is rejected by shard rate limiter
+const shardRateLimitAttempts = 5
+
+// helper function to check if shard rejected request due to its rate limit
+func isRateLimited(err error) bool {
+	var serr *ServerError
+	return errors.As(err, &serr) && serr.Code == RateLimitedCode
+}
+
+// helper function to send request to the shard and decode its response
+// into given object, the request is retried if shard rate limit is exceeded
+func (s *shard) do(ctx context.Context, method, path string, body any, out any) error {
+	var err error
+	for attempt := 1; attempt <= shardRateLimitAttempts; attempt++ {
+		atomic.AddUint64(&s.requests, 1)
+		err = s.request(ctx, method, path, body, out)
+		if !isRateLimited(err) || attempt == shardRateLimitAttempts {
+			break
+		}
+		// shard rate limits are defined per second, see LimiterPeriod
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * 200 * time.Millisecond):
+		}
+	}
+	if err != nil && err != errKeyNotFound {
+		atomic.AddUint64(&s.errors, 1)
+	}
+	return err
+}
+
+// helper function to perform HTTP request to the shard
+func (s *shard) request(ctx context.Context, method, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	rurl := strings.TrimSuffix(s.URL, "/") + strings.TrimSuffix(Config.Base, "/") + path
+	req, err := http.NewRequestWithContext(ctx, method, rurl, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if routerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+routerToken)
+	}
+	if rid := requestID(ctx); rid != "" {
+		req.Header.Set("X-Request-ID", rid)
+	}
+	resp, err := routerClient.Do(req)
+	if err != nil {
+		return newError(UnavailableCode, fmt.Errorf("shard %s: %w", s.Name, err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return shardError(s, resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// helper function to store record on the shard
+func (s *shard) store(ctx context.Context, rec Record) error {
+	return s.do(ctx, "POST", "/store", rec, nil)
+}
+
+// helper function to fetch record from the shard
+func (s *shard) fetch(ctx context.Context, key string) (Record, error) {
+	var rec Record
+	err := s.do(ctx, "GET", "/fetch/"+url.PathEscape(key), nil, &rec)
+	return rec, err
+}
+
+// helper function to delete record from the shard
+func (s *shard) delete(ctx context.Context, key string) (Record, error) {
+	var rec Record
+	err := s.do(ctx, "DELETE", "/admin/records/"+url.PathEscape(key), nil, &rec)
+	return rec, err
+}
+
+// helper function to store record on shards of its key and value, the
+// records are stored only on shards of current hash ring
+func routeStore(ctx context.Context, rec Record) error {
+	_, span := tracer.Start(ctx, "router.store")
+	defer span.End()
+	var stored []string
+	for _, s := range ring.owners(rec) {
+		if err := s.store(ctx, rec); err != nil {
+			slog.ErrorContext(ctx, "router: unable to store record", "key", rec.Key, "shard", s.Name, "stored", stored, "error", err)
+			spanError(span, err)
+			return err
+		}
+		stored = append(stored, s.Name)
+	}
+	return nil
+}
+
+// helper function to fetch record from shard of its key, the shard of
+// previous hash ring is used if record is not moved yet
+func routeFetch(ctx context.Context, key string) (Record, error) {
+	_, span := tracer.Start(ctx, "router.fetch")
+	defer span.End()
+	var rec Record
+	var err error
+	for _, s := range routeShards(key) {
+		rec, err = s.fetch(ctx, key)
+		if err != errKeyNotFound {
+			break
+		}
+	}
+	if err != errKeyNotFound {
+		spanError(span, err)
+	}
+	return rec, err
+}
+
+// helper function to delete record from shards of its key and value in
+// current and previous hash rings
+func routeDelete(ctx context.Context, key string) (Record, error) {
+	_, span := tracer.Start(ctx, "router.delete")
+	defer span.End()
+	rec := Record{Key: key}
+	found := false
+	keyShards := routeShards(key)
+	for _, s := range keyShards {
+		r, err := s.delete(ctx, key)
+		if err == errKeyNotFound {
+			continue
+		} else if err != nil {
+			spanError(span, err)
+			return r, err
+		}
+		if !found {
+			rec, found = r, true
+		}
+	}
+	if !found {
+		return rec, errKeyNotFound
+	}
+	for _, vs := range routeShards(rec.Value) {
+		if vs == keyShards[0] || (len(keyShards) > 1 && vs == keyShards[1]) {
+			continue
+		}
+		if _, err := vs.delete(ctx, key); err != nil && err != errKeyNotFound {
+			spanError(span, err)
+			return rec, err
+		}
+	}
+	return rec, nil
+}
+
+// ShardMetrics represents metrics of backend shard
+type ShardMetrics struct {
+	Name     string `json:"name"`     // shard name
+	URL      string `json:"url"`      // shard URL
+	Requests uint64 `json:"requests"` // total number of requests sent to the shard
+	Errors   uint64 `json:"errors"`   // total number of failed requests
+}
+
+// helper function to collect shard metrics
+func shardMetrics() []ShardMetrics {
+	var out []ShardMetrics
+	for _, s := range routerShards {
+		out = append(out, ShardMetrics{
+			Name:     s.Name,
+			URL:      s.URL,
+			Requests: atomic.LoadUint64(&s.requests),
+			Errors:   atomic.LoadUint64(&s.errors),
+		})
+	}
+	return out
+}
+
+// helper function to generate shard metrics in prometheus format
+func promShardMetrics(prefix string, data []ShardMetrics) string {
+	var out string
+	out += fmt.Sprintf("# HELP %s_shard_requests reports total number of requests sent to shard\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_shard_requests counter\n", prefix)
+	for _, s := range data {
+		out += fmt.Sprintf("%s_shard_requests{shard=\"%s\"} %v\n", prefix, s.Name, s.Requests)
+	}
+	out += fmt.Sprintf("# HELP %s_shard_errors reports total number of failed shard requests\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_shard_errors counter\n", prefix)
+	for _, s := range data {
+		out += fmt.Sprintf("%s_shard_errors{shard=\"%s\"} %v\n", prefix, s.Name, s.Errors)
+	}
+	return out
+}
+
+// helper function to check health of shards
+func checkShards() (string, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	var failed []string
+	var wg sync.WaitGroup
+	for _, s := range routerShards {
+		wg.Add(1)
+		go func(s *shard) {
+			defer wg.Done()
+			if err := s.request(ctx, "GET", "/healthz", nil, nil); err != nil {
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("%s: %v", s.Name, err))
+				mu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+	if len(failed) == 0 {
+		return statusOK, fmt.Sprintf("%d shards", len(routerShards))
+	}
+	sort.Strings(failed)
+	msg := strings.Join(failed, "; ")
+	if len(failed) == len(routerShards) {
+		return statusFail, msg
+	}
+	return statusDegraded, msg
+}
+
+// RebalanceReport represents results of shards rebalancing
+type RebalanceReport struct {
+	DryRun  bool `json:"dryRun"`  // rebalance is performed without changes of shards
+	Scanned int  `json:"scanned"` // number of scanned records
+	Copied  int  `json:"copied"`  // number of records copied to their shards
+	Deleted int  `json:"deleted"` // number of records deleted from shards they do not belong to
+}
+
+// helper function to move records of every shard to shards they belong to
+// according to current hash ring, e.g. after new shards are added, the
+// rebalance is idempotent and can be repeated if it is interrupted
+func rebalanceShards(ctx context.Context, dryRun bool) (RebalanceReport, error) {
+	report := RebalanceReport{DryRun: dryRun}
+	for _, s := range routerShards {
+		log.Printf("rebalance: shard %s", s.Name)
+		err := s.rebalance(ctx, dryRun, &report)
+		if err != nil {
+			return report, fmt.Errorf("unable to rebalance shard %s: %w", s.Name, err)
+		}
+	}
+	return report, nil
+}
+
+// helper function to move records of the shard, every record is copied to
+// shards of its key and value unless they already have it and deleted from
+// the shard if it does not belong to it. The record which owner has
+// different value is not copied since the owner has newer value written via
+// current hash ring.
+func (s *shard) rebalance(ctx context.Context, dryRun bool, report *RebalanceReport) error {
+	rurl := strings.TrimSuffix(s.URL, "/") + strings.TrimSuffix(Config.Base, "/") + "/admin/export?format=ndjson"
+	req, err := http.NewRequestWithContext(ctx, "GET", rurl, nil)
+	if err != nil {
+		return err
+	}
+	if routerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+routerToken)
+	}
+	// export of the shard may take longer than timeout of regular requests
+	client := *routerClient
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return shardError(s, resp)
+	}
+	return readRecords(resp.Body, "ndjson", func(rec Record) error {
+		report.Scanned++
+		owners := ring.owners(rec)
+		var owned bool
+		for _, o := range owners {
+			if o == s {
+				owned = true
+				continue
+			}
+			if _, err := o.fetch(ctx, rec.Key); err == nil {
+				continue
+			} else if err != errKeyNotFound {
+				return err
+			}
+			report.Copied++
+			if dryRun {
+				continue
+			}
+			if err := o.store(ctx, rec); err != nil {
+				return err
+			}
+		}
+		if owned {
+			return nil
+		}
+		report.Deleted++
+		if dryRun {
+			return nil
+		}
+		if _, err := s.delete(ctx, rec.Key); err != nil && err != errKeyNotFound {
+			return err
+		}
+		return nil
+	})
+}
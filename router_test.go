@@ -0,0 +1,266 @@
+package main
+
+// router_test module provides tests of router mode with in-memory shards
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testShard represents shard which keeps records in memory, like real
+// shard it stores every record along with its reverse look-up record
+type testShard struct {
+	sync.Mutex
+	records map[string]string
+}
+
+// ServeHTTP implements http.Handler interface
+func (s *testShard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/store":
+		var rec Record
+		if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.records[rec.Key] = rec.Value
+		s.records[rec.Value] = rec.Key
+		return
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/fetch/"):
+		key := strings.TrimPrefix(r.URL.Path, "/fetch/")
+		if val, ok := s.records[key]; ok {
+			json.NewEncoder(w).Encode(Record{Key: key, Value: val})
+			return
+		}
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/admin/records/"):
+		key := strings.TrimPrefix(r.URL.Path, "/admin/records/")
+		if val, ok := s.records[key]; ok {
+			delete(s.records, key)
+			if s.records[val] == key {
+				delete(s.records, val)
+			}
+			json.NewEncoder(w).Encode(Record{Key: key, Value: val})
+			return
+		}
+	case r.Method == "GET" && r.URL.Path == "/admin/export" && r.FormValue("format") == "ndjson":
+		keys := make([]string, 0, len(s.records))
+		for key := range s.records {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		enc := json.NewEncoder(w)
+		for _, key := range keys {
+			enc.Encode(Record{Key: key, Value: s.records[key]})
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(ErrorRecord{Code: NotFoundCode, Status: http.StatusNotFound})
+}
+
+// helper function to check if shard has record of given key
+func (s *testShard) has(key string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.records[key]
+	return ok
+}
+
+// helper function to return copy of shard records
+func (s *testShard) dump() map[string]string {
+	s.Lock()
+	defer s.Unlock()
+	out := make(map[string]string, len(s.records))
+	for key, val := range s.records {
+		out[key] = val
+	}
+	return out
+}
+
+// helper function to set up router with given number of current shards and
+// given number of previous shards, the previous configuration is restored at
+// the end of the test
+func setupRouter(t *testing.T, current, previous int) map[string]*testShard {
+	t.Helper()
+	config := Config
+	t.Cleanup(func() {
+		Config = config
+		ring, prevRing, routerShards = nil, nil, nil
+	})
+	shards := make(map[string]*testShard)
+	var configs []ShardConfig
+	for i := 0; i < max(current, previous); i++ {
+		ts := &testShard{records: make(map[string]string)}
+		srv := httptest.NewServer(ts)
+		t.Cleanup(srv.Close)
+		name := fmt.Sprintf("s%d", i)
+		shards[name] = ts
+		configs = append(configs, ShardConfig{Name: name, URL: srv.URL})
+	}
+	Config.Base = ""
+	Config.Webhooks = nil
+	Config.Router = RouterConfig{Shards: configs[:current], VirtualNodes: 128, Timeout: "10s"}
+	if previous > 0 {
+		Config.Router.PreviousShards = configs[:previous]
+	}
+	if err := initRouter(); err != nil {
+		t.Fatal(err)
+	}
+	return shards
+}
+
+// TestRouterPreviousShards checks that records which are not moved to
+// new shards yet are found and deleted via previous hash ring
+func TestRouterPreviousShards(t *testing.T) {
+	ctx := context.Background()
+	shards := setupRouter(t, 3, 2)
+
+	// find key which owner is changed by new shard
+	var key string
+	for i := 0; key == ""; i++ {
+		k := fmt.Sprintf("k%d", i)
+		if ring.shard(k) != prevRing.shard(k) {
+			key = k
+		}
+	}
+	old := prevRing.shard(key)
+	if err := old.store(ctx, Record{Key: key, Value: "v"}); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := routeFetch(ctx, key)
+	if err != nil || rec.Value != "v" {
+		t.Fatalf("expect record from previous shard, got %+v %v", rec, err)
+	}
+
+	// records written via new configuration take precedence
+	if err := routeStore(ctx, Record{Key: key, Value: "v2"}); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := routeFetch(ctx, key); err != nil || rec.Value != "v2" {
+		t.Fatalf("expect record from current shard, got %+v %v", rec, err)
+	}
+	if _, err := routeDelete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	for name, ts := range shards {
+		if ts.has(key) {
+			t.Errorf("expect record %s to be deleted from shard %s", key, name)
+		}
+	}
+	if _, err := routeFetch(ctx, key); !errors.Is(err, errKeyNotFound) {
+		t.Fatalf("expect errKeyNotFound after delete, got %v", err)
+	}
+}
+
+// TestRouterWebhooks checks that router mode rejects webhooks
+func TestRouterWebhooks(t *testing.T) {
+	setupRouter(t, 1, 0)
+	Config.Webhooks = []WebhookConfig{{Name: "test", URL: "http://localhost"}}
+	if err := initRouter(); err == nil {
+		t.Fatal("expect router mode to reject webhooks")
+	}
+}
+
+// TestRebalance checks that rebalance moves records written with previous
+// shards to shards of new hash ring and removes them from other shards
+func TestRebalance(t *testing.T) {
+	ctx := context.Background()
+	shards := setupRouter(t, 3, 2)
+
+	// records written by routers with previous configuration
+	var recs []Record
+	for i := 0; i < 100; i++ {
+		rec := Record{Key: fmt.Sprintf("k%d", i), Value: fmt.Sprintf("v%d", i)}
+		for _, s := range prevRing.owners(rec) {
+			if err := s.store(ctx, rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		recs = append(recs, rec)
+	}
+	dump := func() map[string]map[string]string {
+		out := make(map[string]map[string]string)
+		for name, ts := range shards {
+			out[name] = ts.dump()
+		}
+		return out
+	}
+	before := dump()
+	if len(before["s2"]) != 0 {
+		t.Fatalf("expect empty new shard, got %d records", len(before["s2"]))
+	}
+
+	// dry-run reports records to move without moving them
+	dryRun, err := rebalanceShards(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dryRun.Copied == 0 || dryRun.Deleted == 0 {
+		t.Fatalf("expect records to move, got %+v", dryRun)
+	}
+	if !reflect.DeepEqual(before, dump()) {
+		t.Fatal("dry-run modified shards")
+	}
+
+	report, err := rebalanceShards(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// dry-run counts copies of record from every shard which holds it
+	if report.Copied == 0 || report.Copied > dryRun.Copied || report.Deleted != dryRun.Deleted {
+		t.Fatalf("expect rebalance to match dry-run %+v, got %+v", dryRun, report)
+	}
+	if len(dump()["s2"]) == 0 {
+		t.Fatal("expect records on new shard")
+	}
+
+	// every shard holds only records of its keys and values
+	for name, ts := range shards {
+		for key, val := range ts.dump() {
+			var owned bool
+			for _, o := range ring.owners(Record{Key: key, Value: val}) {
+				owned = owned || o.Name == name
+			}
+			if !owned {
+				t.Errorf("shard %s holds record %s=%s of other shards", name, key, val)
+			}
+		}
+	}
+
+	// records and their reverse records are resolvable without previous
+	// shards
+	Config.Router.PreviousShards = nil
+	if err := initRouter(); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if r, err := routeFetch(ctx, rec.Key); err != nil || r.Value != rec.Value {
+			t.Errorf("fetch %s: expect %s, got %+v %v", rec.Key, rec.Value, r, err)
+		}
+		if r, err := routeFetch(ctx, rec.Value); err != nil || r.Value != rec.Key {
+			t.Errorf("reverse fetch %s: expect %s, got %+v %v", rec.Value, rec.Key, r, err)
+		}
+	}
+
+	// rebalance is idempotent
+	report, err = rebalanceShards(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 0 || report.Deleted != 0 {
+		t.Fatalf("expect nothing to move after rebalance, got %+v", report)
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "expvar"         // to be used for monitoring, see https://github.com/divan/expvarmon
@@ -27,20 +31,57 @@ var version string
 // Info function returns version string of the server
 func Info() string {
 	goVersion := runtime.Version()
-	tstamp := time.Now().Format("2006-02-01")
+	tstamp := time.Now().Format("2006-01-02")
 	return fmt.Sprintf("git=%s go=%s date=%s", version, goVersion, tstamp)
 }
 
-// helper function which provides all handler routes
-func handlers() *mux.Router {
+// helper function which registers our routes in given router
+func addRoutes(router *mux.Router) {
+	router.HandleFunc("/info", InfoHandler).Methods("GET")
+	router.HandleFunc("/metrics", MetricsHandler).Methods("GET")
+	router.HandleFunc("/status", StatusHandler).Methods("GET")
+	router.HandleFunc("/healthz", HealthzHandler).Methods("GET")
+	router.HandleFunc("/readyz", ReadyzHandler).Methods("GET")
+	router.HandleFunc("/store", StoreHandler).Methods("POST")
+	router.HandleFunc("/fetch/{key:.*}", FetchHandler).Methods("GET")
+	// watch stream exposes all DB records like admin routes, therefore it
+	// always requires authentication
+	router.Handle("/watch", authMiddleware(http.HandlerFunc(WatchHandler))).Methods("GET")
+	router.HandleFunc("/", IndexHandler).Methods("GET")
+
+	// cluster membership and forwarding routes are authenticated by
+	// cluster token in their handlers, therefore they are registered before
+	// admin routes
+	router.HandleFunc("/admin/cluster/join", JoinClusterHandler).Methods("POST")
+	router.HandleFunc("/admin/cluster/nodes/{id}", RemoveClusterNodeHandler).Methods("DELETE")
+	router.HandleFunc("/admin/cluster/apply", ApplyClusterHandler).Methods("POST")
+	router.HandleFunc("/admin/cluster/read-index", ReadIndexHandler).Methods("GET")
+
+	// admin routes expose all DB records, therefore they always require
+	// authentication regardless of listener middlewares
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(authMiddleware)
+	admin.HandleFunc("/backup", BackupHandler).Methods("GET")
+	admin.HandleFunc("/changes", ChangesHandler).Methods("GET")
+	admin.HandleFunc("/cluster", ClusterHandler).Methods("GET")
+	admin.HandleFunc("/export", ExportHandler).Methods("GET")
+	admin.HandleFunc("/gc", GCHandler).Methods("POST")
+	admin.HandleFunc("/records/{key:.*}", DeleteRecordHandler).Methods("DELETE")
+	admin.HandleFunc("/snapshots", SnapshotsHandler).Methods("GET")
+	admin.HandleFunc("/snapshots", CreateSnapshotHandler).Methods("POST")
+	admin.HandleFunc("/snapshots/{name}", ExportSnapshotHandler).Methods("GET")
+	admin.HandleFunc("/snapshots/{name}", DeleteSnapshotHandler).Methods("DELETE")
+	admin.HandleFunc("/snapshots/{name}/restore", RestoreSnapshotHandler).Methods("POST")
+}
+
+// helper function which provides all handler routes with given optional
+// middlewares
+func handlers(middlewares []string) *mux.Router {
 	router := mux.NewRouter()
 	router.StrictSlash(true) // to allow /route and /route/ end-points
 	// visible routes
 	if Config.Base == "" {
-		router.HandleFunc("/info", InfoHandler).Methods("GET")
-		router.HandleFunc("/store", StoreHandler).Methods("POST")
-		router.HandleFunc("/fetch/{key:.*}", FetchHandler).Methods("GET")
-		router.HandleFunc("/", IndexHandler).Methods("GET")
+		addRoutes(router)
 	} else {
 		base := Config.Base
 		if !strings.HasSuffix(base, "/") {
@@ -48,16 +89,16 @@ func handlers() *mux.Router {
 		}
 		subrouter := router.PathPrefix(base).Subrouter()
 		//         subrouter.StrictSlash(true) // to allow /route and /route/ end-points
-		subrouter.HandleFunc("/info", InfoHandler).Methods("GET")
-		subrouter.HandleFunc("/store", StoreHandler).Methods("POST")
-		subrouter.HandleFunc("/fetch/{key:.*}", FetchHandler).Methods("GET")
-		subrouter.HandleFunc("/", IndexHandler).Methods("GET")
-
+		addRoutes(subrouter)
 	}
 
 	// use various middlewares
-	router.Use(limitMiddleware)
+	router.Use(requestIDMiddleware)
 	router.Use(loggingMiddleware)
+	router.Use(bodyLimitMiddleware)
+	for _, name := range middlewares {
+		router.Use(optionalMiddlewares[name])
+	}
 	return router
 }
 
@@ -65,30 +106,134 @@ func handlers() *mux.Router {
 func server() {
 	StartTime = time.Now()
 
+	// initialize tracing
+	shutdownTracing, err := initTracing()
+	if err != nil {
+		log.Fatal("unable to initialize tracing", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	// initialize limiter
 	initLimiter(Config.LimiterPeriod)
 
-	// start badger DB
-	var err error
-	DB, err = badger.Open(badger.DefaultOptions(Config.BadgerDB))
+	// open DB with configured storage engine
+	KV, err = openStore(Config.BadgerDB)
 	if err != nil {
-		log.Fatal("unable to open badger DB", err)
+		log.Fatalf("unable to open %s DB, error: %v", Config.Engine, err)
 	}
-	log.Println("badger DB", DB)
-	defer DB.Close()
+	log.Printf("%s DB %s", Config.Engine, Config.BadgerDB)
+
+	// background tasks run until server receives termination signal
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	// the request handler
-	base := Config.Base
-	if !strings.HasSuffix(base, "/") {
-		base = fmt.Sprintf("%s/", Config.Base)
+	// start sampling of number of keys in DB
+	startTask(func() { keyCounter(ctx, Config.KeyCountInterval) })
+
+	// start value log garbage collection
+	if !Config.ReadOnly && DB != nil {
+		startTask(func() { gcScheduler(ctx, Config.GCInterval, Config.GCDiscardRatio) })
+		startTask(func() { deletedPruner(ctx, Config.ChangesRetention) })
 	}
 
-	// set our handlers
-	http.Handle(base, handlers())
+	// start replication of primary DB
+	if isReplica() {
+		if err := requireBadger("replica mode"); err != nil {
+			log.Fatal(err)
+		}
+		if Config.ReadOnly {
+			log.Fatal("replica mode requires writable DB, disable read_only option")
+		}
+		log.Printf("replica of %s prefixes=%v", Config.Replica.Primary, Config.Replica.Prefixes)
+		startTask(func() { replicate(ctx) })
+	}
+
+	// initialize router mode
+	if err := initRouter(); err != nil {
+		log.Fatal("unable to initialize router, ", err)
+	}
+
+	// start raft node of clustered mode
+	if isClustered() {
+		if err := startCluster(ctx); err != nil {
+			log.Fatal("unable to start cluster node, ", err)
+		}
+	}
+
+	// start delivery of webhook notifications
+	if err := initWebhooks(); err != nil {
+		log.Fatal("unable to initialize webhooks, ", err)
+	}
+	if webhooksEnabled() {
+		if Config.ReadOnly || isReplica() {
+			log.Println("webhooks are disabled in read-only and replica modes")
+			webhooks = nil
+		} else {
+			startWebhooks(ctx)
+		}
+	}
+
+	// start scheduled backups
+	if Config.BackupDir != "" {
+		if err := requireBadger("scheduled backups"); err != nil {
+			log.Fatal(err)
+		}
+		startTask(func() { backupScheduler(ctx, Config.BackupDir, Config.BackupInterval, Config.BackupRetention) })
+	}
+
+	// initialize authentication
+	if err := initAuth(); err != nil {
+		log.Fatal("unable to initialize authentication", err)
+	}
+	if !adminAccess() {
+		log.Println("WARNING: admin and watch end-points are not accessible, configure auth_token_file or client_ca of listeners")
+	}
+
+	// start HTTP, HTTPs and unix socket servers based on provided configuration
+	var servers []stoppable
+	for _, lc := range listeners() {
+		srv, err := newServer(lc.Address, listenerHandler(lc))
+		if err != nil {
+			log.Fatal(err)
+		}
+		ln, err := newListener(lc)
+		if err != nil {
+			log.Fatalf("unable to start listener %s, error: %v", lc, err)
+		}
+		servers = append(servers, srv)
+		go func(lc ListenerConfig) {
+			log.Printf("Starting HTTP server on %s", lc)
+			if err := srv.Serve(ln); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(lc)
+	}
+
+	// start gRPC server
+	if Config.GRPC.Address != "" {
+		srv, err := startGRPC(Config.GRPC)
+		if err != nil {
+			log.Fatalf("unable to start gRPC listener %s, error: %v", Config.GRPC, err)
+		}
+		servers = append(servers, srv)
+	}
+
+	// start RESP server
+	if Config.RESP.Address != "" {
+		srv, err := startRESP(Config.RESP)
+		if err != nil {
+			log.Fatalf("unable to start RESP listener %s, error: %v", Config.RESP, err)
+		}
+		servers = append(servers, srv)
+	}
 
-	// start HTTP or HTTPs server based on provided configuration
-	addr := fmt.Sprintf(":%d", Config.Port)
-	// Start server without user certificates
-	log.Printf("Starting HTTP server on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	// wait for termination signal and shutdown the server, the second
+	// signal terminates server immediately
+	sig := <-sigs
+	signal.Stop(sigs)
+	log.Printf("shutdown: received %v signal", sig)
+	cancel()
+	gracefulShutdown(servers)
 }
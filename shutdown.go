@@ -0,0 +1,113 @@
+package main
+
+// shutdown module provides graceful shutdown of our server
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shuttingDown is set to 1 when server starts its shutdown
+var shuttingDown int32
+
+// backgroundTasks keeps track of server background tasks
+var backgroundTasks sync.WaitGroup
+
+// streamsCtx is cancelled when server starts its shutdown, it is used to
+// stop long-living streaming requests which otherwise block draining
+var streamsCtx, stopStreams = context.WithCancel(context.Background())
+
+// helper function to create context of streaming request which is cancelled
+// either with given context or on server shutdown
+func streamContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(streamsCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// helper function to start background task which should be finished
+// before we close the DB
+func startTask(task func()) {
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		task()
+	}()
+}
+
+// helper function to wait for background tasks within given context
+func waitTasks(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		backgroundTasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stoppable represents server which can be gracefully shutdown or closed
+// immediately, e.g. http.Server
+type stoppable interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// helper function to gracefully shutdown servers and DB, we stop accepting
+// new connections, drain in-flight requests and background tasks within
+// shutdown timeout, and close the DB which flushes its memtables
+func gracefulShutdown(servers []stoppable) {
+	time0 := time.Now()
+	atomic.StoreInt32(&shuttingDown, 1)
+	stopStreams()
+	timeout, err := time.ParseDuration(Config.ShutdownTimeout)
+	if err != nil {
+		slog.Error("unable to parse shutdown timeout", "timeout", Config.ShutdownTimeout, "error", err)
+		timeout = 20 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	log.Printf("shutdown: stop accepting new connections, in-flight requests=%d timeout=%v",
+		atomic.LoadInt64(&InFlightRequests), timeout)
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv stoppable) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Error("shutdown: unable to drain in-flight requests",
+					"error", err, "in_flight", atomic.LoadInt64(&InFlightRequests))
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+	log.Printf("shutdown: in-flight requests are drained in %v", time.Since(time0))
+
+	log.Println("shutdown: waiting for background tasks")
+	if err := waitTasks(ctx); err != nil {
+		slog.Error("shutdown: background tasks are not finished", "error", err)
+	}
+
+	shutdownCluster()
+
+	log.Printf("shutdown: closing %s DB", Config.Engine)
+	if err := KV.Close(); err != nil {
+		slog.Error("shutdown: unable to close DB", "engine", Config.Engine, "error", err)
+	}
+	log.Printf("shutdown: completed in %v", time.Since(time0))
+}
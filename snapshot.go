@@ -0,0 +1,423 @@
+package main
+
+// snapshot module provides point-in-time snapshots of our DB
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+)
+
+// systemPrefix defines prefix of keys reserved for internal use
+const systemPrefix = "_cmskv/"
+
+// snapshotPrefix defines prefix of keys which hold snapshot records
+const snapshotPrefix = systemPrefix + "snapshot/"
+
+// snapshotPattern defines allowed snapshot names
+var snapshotPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// errNoSnapshot is returned when snapshot does not exist
+var errNoSnapshot = errors.New("snapshot does not exist")
+
+// Snapshot represents named snapshot of our DB
+type Snapshot struct {
+	Name    string `json:"name"`    // snapshot name
+	Version uint64 `json:"version"` // DB read timestamp of the snapshot
+	Records int    `json:"records"` // number of records in the snapshot
+	Created int64  `json:"created"` // creation time in seconds since epoch
+}
+
+// helper function to check if given key is reserved for internal use
+func isSystemKey(key string) bool {
+	return strings.HasPrefix(key, systemPrefix)
+}
+
+// helper function to return file name of snapshot with given name
+func snapshotFile(name string) string {
+	return filepath.Join(Config.SnapshotDir, name+backupSuffix)
+}
+
+// helper function to create new snapshot with given name, the user records
+// are written into snapshot file as of single read transaction, i.e. the
+// snapshot does not depend on versions kept by badger
+func createSnapshot(name string) (Snapshot, error) {
+	var snap Snapshot
+	if err := requireSnapshots(); err != nil {
+		return snap, err
+	}
+	if !snapshotPattern.MatchString(name) {
+		return snap, badRequest(fmt.Errorf("invalid snapshot name '%s'", name))
+	}
+	if _, err := getSnapshot(name); err == nil {
+		return snap, newError(ConflictCode, fmt.Errorf("snapshot %s already exists", name))
+	}
+	if err := os.MkdirAll(Config.SnapshotDir, 0700); err != nil {
+		return snap, err
+	}
+	version, records, err := writeSnapshot(snapshotFile(name))
+	if err != nil {
+		return snap, err
+	}
+	snap = Snapshot{Name: name, Version: version, Records: records, Created: time.Now().Unix()}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return snap, err
+	}
+	err = DB.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(snapshotPrefix+name), data)
+	})
+	if err != nil {
+		os.Remove(snapshotFile(name))
+		return snap, err
+	}
+	log.Printf("create snapshot %s version=%d records=%d", name, snap.Version, snap.Records)
+	return snap, nil
+}
+
+// helper function to check if snapshots can be created, deleted or
+// restored, the snapshots are local to the DB and modify it
+func requireSnapshots() error {
+	if err := requireBadger("snapshots"); err != nil {
+		return err
+	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	return requireStandalone("snapshots")
+}
+
+// helper function to write user records of the DB into given file in badger
+// backup format, the file is written into temporary file first and then
+// renamed to avoid partial snapshots
+func writeSnapshot(fname string) (uint64, int, error) {
+	tmp := fname + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, 0, err
+	}
+	txn := DB.NewTransaction(false)
+	defer txn.Discard()
+	var records int
+	w := bufio.NewWriter(file)
+	err = func() error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		list := &pb.KVList{}
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if isSystemKey(string(item.Key())) {
+				continue
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			kv := &pb.KV{Key: item.KeyCopy(nil), Value: val, Version: item.Version(), ExpiresAt: item.ExpiresAt()}
+			list.Kv = append(list.Kv, kv)
+			records++
+			if len(list.Kv) < 1000 {
+				continue
+			}
+			if err := writeKVList(w, list); err != nil {
+				return err
+			}
+			list = &pb.KVList{}
+		}
+		if len(list.Kv) > 0 {
+			if err := writeKVList(w, list); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}()
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, fname)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+	return txn.ReadTs(), records, nil
+}
+
+// helper function to get snapshot with given name
+func getSnapshot(name string) (Snapshot, error) {
+	var snap Snapshot
+	if err := requireBadger("snapshots"); err != nil {
+		return snap, err
+	}
+	err := DB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(snapshotPrefix + name))
+		if err == badger.ErrKeyNotFound {
+			return errNoSnapshot
+		} else if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &snap)
+		})
+	})
+	return snap, err
+}
+
+// helper function to list all snapshots
+func listSnapshots() ([]Snapshot, error) {
+	snapshots := []Snapshot{}
+	if err := requireBadger("snapshots"); err != nil {
+		return snapshots, err
+	}
+	err := DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(snapshotPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var snap Snapshot
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &snap)
+			})
+			if err != nil {
+				return err
+			}
+			snapshots = append(snapshots, snap)
+		}
+		return nil
+	})
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Version < snapshots[j].Version
+	})
+	return snapshots, err
+}
+
+// helper function to delete snapshot with given name
+func deleteSnapshot(name string) error {
+	if err := requireSnapshots(); err != nil {
+		return err
+	}
+	if _, err := getSnapshot(name); err != nil {
+		return err
+	}
+	err := DB.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(snapshotPrefix + name))
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(snapshotFile(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Printf("delete snapshot %s", name)
+	return nil
+}
+
+// helper function to write KV list in badger backup format
+func writeKVList(w io.Writer, list *pb.KVList) error {
+	data, err := list.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(data))); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// snapshotReader reads records of snapshot file (or badger backup) in key order
+type snapshotReader struct {
+	r       *bufio.Reader
+	list    []*pb.KV
+	expired bool // return expired records as well
+}
+
+// helper function to return next record of the snapshot which is not
+// expired, it returns nil at the end of the snapshot
+func (s *snapshotReader) next() (*pb.KV, error) {
+	for {
+		for len(s.list) > 0 {
+			kv := s.list[0]
+			s.list = s.list[1:]
+			if s.expired || kv.ExpiresAt == 0 || kv.ExpiresAt > uint64(time.Now().Unix()) {
+				return kv, nil
+			}
+		}
+		var size uint64
+		err := binary.Read(s.r, binary.LittleEndian, &size)
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(s.r, data); err != nil {
+			return nil, err
+		}
+		var list pb.KVList
+		if err := list.Unmarshal(data); err != nil {
+			return nil, err
+		}
+		s.list = list.Kv
+	}
+}
+
+// helper function to open snapshot file of given snapshot
+func openSnapshot(snap Snapshot) (*os.File, error) {
+	file, err := os.Open(snapshotFile(snap.Name))
+	if os.IsNotExist(err) {
+		return nil, newError(UnavailableCode, fmt.Errorf("file of snapshot %s does not exist", snap.Name))
+	}
+	return file, err
+}
+
+// helper function to read records of given snapshot with given key prefix
+func readSnapshot(name, prefix string, fn func(kv *pb.KV) error) error {
+	snap, err := getSnapshot(name)
+	if err != nil {
+		return err
+	}
+	file, err := openSnapshot(snap)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sr := &snapshotReader{r: bufio.NewReader(file)}
+	for {
+		kv, err := sr.next()
+		if err != nil || kv == nil {
+			return err
+		}
+		if !strings.HasPrefix(string(kv.Key), prefix) {
+			continue
+		}
+		if err := fn(kv); err != nil {
+			return err
+		}
+	}
+}
+
+// helper function to export given snapshot in badger backup format, i.e.
+// it can be loaded via restore command
+func exportSnapshot(w io.Writer, name string) error {
+	snap, err := getSnapshot(name)
+	if err != nil {
+		return err
+	}
+	file, err := openSnapshot(snap)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// helper function to restore DB to the state of given snapshot, i.e. keys
+// created after the snapshot are deleted and modified keys get their
+// snapshot values back, the current keys and snapshot records are merged
+// in key order
+func restoreSnapshot(name string) error {
+	if err := requireSnapshots(); err != nil {
+		return err
+	}
+	snap, err := getSnapshot(name)
+	if err != nil {
+		return err
+	}
+	file, err := openSnapshot(snap)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sr := &snapshotReader{r: bufio.NewReader(file)}
+	kv, err := sr.next()
+	if err != nil {
+		return err
+	}
+	var updated, deleted int
+	wb := DB.NewWriteBatch()
+	defer wb.Cancel()
+	// helper function to write snapshot record and advance to the next one
+	restore := func() error {
+		updated++
+		e := badger.NewEntry(kv.Key, kv.Value)
+		e.ExpiresAt = kv.ExpiresAt
+		if err := wb.SetEntry(e); err != nil {
+			return err
+		}
+		var err error
+		kv, err = sr.next()
+		return err
+	}
+	err = DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.Key()
+			if isSystemKey(string(key)) {
+				continue
+			}
+			// snapshot records which precede current key do not exist in DB
+			for kv != nil && bytes.Compare(kv.Key, key) < 0 {
+				if err := restore(); err != nil {
+					return err
+				}
+			}
+			if kv == nil || !bytes.Equal(kv.Key, key) {
+				deleted++
+				if err := wb.Delete(item.KeyCopy(nil)); err != nil {
+					return err
+				}
+				if err := wb.Set(deletedMarker(key), deletedMarkerValue()); err != nil {
+					return err
+				}
+				continue
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(val, kv.Value) && item.ExpiresAt() == kv.ExpiresAt {
+				if kv, err = sr.next(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := restore(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for err == nil && kv != nil {
+		err = restore()
+	}
+	if err != nil {
+		return err
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+	log.Printf("restore snapshot %s version=%d updated=%d deleted=%d", name, snap.Version, updated, deleted)
+	return nil
+}
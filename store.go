@@ -0,0 +1,303 @@
+package main
+
+// store module provides store, fetch, delete and list operations shared by
+// HTTP and gRPC APIs
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// helper function to check if given key can be modified
+func checkWritable(keys ...string) error {
+	if Config.ReadOnly {
+		return errReadOnly
+	}
+	if isReplica() {
+		return replicaWriteError()
+	}
+	for _, key := range keys {
+		if isSystemKey(key) {
+			return badRequest(fmt.Errorf("%s prefix is reserved", systemPrefix))
+		}
+	}
+	return nil
+}
+
+// helper function to set given key-value pairs without reverse look-up
+// records in single transaction, non-zero ttl defines expiration of the keys
+func setRecords(ctx context.Context, recs []Record, ttl time.Duration) error {
+	keys := make([]string, 0, len(recs))
+	for _, rec := range recs {
+		keys = append(keys, rec.Key)
+	}
+	if err := checkWritable(keys...); err != nil {
+		return err
+	}
+	if isRouter() {
+		return newError(UnavailableCode, errors.New("records without reverse look-up are not supported in router mode"))
+	}
+	if isClustered() {
+		cmd := clusterCommand{Op: clusterSet, Records: recs}
+		if ttl > 0 {
+			cmd.ExpiresAt = time.Now().Add(ttl).UnixNano()
+		}
+		_, err := clusterApply(ctx, cmd)
+		return err
+	}
+	return commitRecords(ctx, recs, ttl)
+}
+
+// helper function to check if given key and its value have reverse look-up
+// record, i.e. the key is stored via store API
+func hasReverseRecord(txn KVTxn, key, value []byte) (bool, error) {
+	rev, err := txn.Get(value)
+	if err == errKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return string(rev) == string(key), nil
+}
+
+// helper function to commit given key-value pairs in single transaction,
+// the keys which have reverse look-up records are rejected since setting
+// them would leave stale reverse records. The webhook notifications about
+// created or updated keys are queued in the same transaction.
+func commitRecords(ctx context.Context, recs []Record, ttl time.Duration) error {
+	_, span := tracer.Start(ctx, "txn.commit")
+	defer span.End()
+	var queued bool
+	err := KV.Txn(true, func(txn KVTxn) error {
+		for _, rec := range recs {
+			var event string
+			old, err := txn.Get([]byte(rec.Key))
+			if err == errKeyNotFound {
+				event = webhookCreate
+			} else if err != nil {
+				return err
+			} else if paired, err := hasReverseRecord(txn, []byte(rec.Key), old); err != nil {
+				return err
+			} else if paired {
+				return newError(ConflictCode, fmt.Errorf("key %s has reverse look-up record, use store API to change it", rec.Key))
+			} else if string(old) != rec.Value {
+				event = webhookUpdate
+			}
+			if err := txn.Set([]byte(rec.Key), []byte(rec.Value), ttl); err != nil {
+				return err
+			}
+			if event == "" {
+				continue
+			}
+			ok, err := queueWebhooks(ctx, txn, event, rec.Key, rec.Value)
+			if err != nil {
+				return err
+			}
+			queued = queued || ok
+		}
+		return nil
+	})
+	spanError(span, err)
+	if err == nil && queued {
+		wakeWebhooks()
+	}
+	return err
+}
+
+// helper function to store given record and its reverse look-up record in
+// DB, if record value is not provided we store hash of the record key
+func storeRecord(ctx context.Context, rec *HTTPRecord) error {
+	if err := checkWritable(rec.Key, rec.Value); err != nil {
+		return err
+	}
+
+	// create hash value for given key
+	_, span := tracer.Start(ctx, "hash")
+	var h hash.Hash
+	sha := strings.ToLower(Config.SHA)
+	if sha == "sha256" || rec.Sha == "sha256" {
+		h = sha256.New()
+		rec.Sha = "sha256"
+	} else if sha == "sha512" || rec.Sha == "sha512" {
+		h = sha512.New()
+		rec.Sha = "sha512"
+	} else {
+		h = sha1.New()
+		rec.Sha = "sha1"
+	}
+	h.Write([]byte(rec.Key))
+	// if record value is not provided we'll create a hash for it
+	// this will allow to anonimise the data
+	if rec.Value == "" {
+		rec.Value = hex.EncodeToString(h.Sum(nil))
+	}
+	span.SetAttributes(attribute.String("sha", rec.Sha))
+	span.End()
+
+	// in router mode the records are stored by backend shards
+	if isRouter() {
+		return routeStore(ctx, rec.Record)
+	}
+
+	// commit new key-value records into our store, in clustered mode the
+	// records are committed via raft log
+	if isClustered() {
+		cmd := clusterCommand{Op: clusterStore, Records: []Record{rec.Record}}
+		_, err := clusterApply(ctx, cmd)
+		return err
+	}
+	return commitRecord(ctx, rec.Key, rec.Value)
+}
+
+// helper function to commit key-value pair and its reverse look-up pair in
+// single transaction, the webhook notifications about created or updated
+// record are queued in the same transaction (the store of unchanged record
+// is not reported)
+func commitRecord(ctx context.Context, key, value string) error {
+	_, span := tracer.Start(ctx, "txn.commit")
+	defer span.End()
+	var queued bool
+	err := KV.Txn(true, func(txn KVTxn) error {
+		var event string
+		old, err := txn.Get([]byte(key))
+		if err == errKeyNotFound {
+			event = webhookCreate
+		} else if err != nil {
+			return err
+		} else if string(old) != value {
+			event = webhookUpdate
+		}
+		if err := txn.Set([]byte(key), []byte(value), 0); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte(value), []byte(key), 0); err != nil {
+			return err
+		}
+		if event == "" {
+			return nil
+		}
+		queued, err = queueWebhooks(ctx, txn, event, key, value)
+		return err
+	})
+	spanError(span, err)
+	if err != nil {
+		return err
+	}
+	slog.DebugContext(ctx, "record", "key", key, "value", value)
+	slog.DebugContext(ctx, "record", "key", value, "value", key)
+	if queued {
+		wakeWebhooks()
+	}
+	return nil
+}
+
+// helper function to fetch record of given key
+func fetchRecord(ctx context.Context, key string) (Record, error) {
+	rec := Record{Key: key}
+	if isSystemKey(key) {
+		return rec, errKeyNotFound
+	}
+	if isRouter() {
+		return routeFetch(ctx, key)
+	}
+	_, span := tracer.Start(ctx, "txn.get")
+	defer span.End()
+	val, err := KV.Get([]byte(key))
+	rec.Value = string(val)
+	spanError(span, err)
+	return rec, err
+}
+
+// helper function to delete record of given key along with its reverse
+// look-up record, the reverse record is deleted only if it points back to
+// given key
+func deleteRecord(ctx context.Context, key string) (Record, error) {
+	if err := checkWritable(key); err != nil {
+		return Record{Key: key}, err
+	}
+	if isRouter() {
+		return routeDelete(ctx, key)
+	}
+	var rec Record
+	var err error
+	if isClustered() {
+		rec, err = clusterApply(ctx, clusterCommand{Op: clusterDelete, Key: key})
+	} else {
+		rec, err = removeRecord(ctx, key)
+	}
+	if err == nil {
+		slog.DebugContext(ctx, "delete", "key", rec.Key, "value", rec.Value)
+	}
+	return rec, err
+}
+
+// helper function to remove record of given key along with its reverse
+// look-up record in single transaction, the webhook notifications about
+// deleted record are queued in the same transaction
+func removeRecord(ctx context.Context, key string) (Record, error) {
+	rec := Record{Key: key}
+	_, span := tracer.Start(ctx, "txn.delete")
+	defer span.End()
+	var queued bool
+	err := KV.Txn(true, func(txn KVTxn) error {
+		val, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		rec.Value = string(val)
+		if err := txn.Delete([]byte(key)); err != nil {
+			return err
+		}
+		if rec.Value != key {
+			rval, err := txn.Get(val)
+			if err != nil && err != errKeyNotFound {
+				return err
+			}
+			if err == nil && string(rval) == key {
+				if err := txn.Delete(val); err != nil {
+					return err
+				}
+			}
+		}
+		queued, err = queueWebhooks(ctx, txn, webhookDelete, rec.Key, rec.Value)
+		return err
+	})
+	spanError(span, err)
+	if err == nil && queued {
+		wakeWebhooks()
+	}
+	return rec, err
+}
+
+// helper function to iterate over records with given key prefix, the
+// iteration starts after given key and stops after given number of records
+// (zero limit means no limit)
+func listRecords(prefix, after string, limit int, fn func(rec Record) error) error {
+	if isRouter() {
+		return errRouterList
+	}
+	var count int
+	return KV.Iterate([]byte(prefix), []byte(after), func(key, value []byte) error {
+		if isSystemKey(string(key)) {
+			return nil
+		}
+		if limit > 0 && count >= limit {
+			return errStopIteration
+		}
+		count++
+		return fn(Record{Key: string(key), Value: string(value)})
+	})
+}
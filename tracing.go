@@ -0,0 +1,122 @@
+package main
+
+// tracing module provides OpenTelemetry tracing of our server
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer provides spans of our server, it is no-op until tracing is initialized
+var tracer = otel.Tracer("github.com/vkuznet/cmskv")
+
+// helper function to initialize tracing, it returns function which flushes
+// and stops tracing exporter
+func initTracing() (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	var err error
+	if Config.TracingEndpoint != "" {
+		var opts []otlptracehttp.Option
+		if strings.Contains(Config.TracingEndpoint, "://") {
+			opts = append(opts, otlptracehttp.WithEndpointURL(Config.TracingEndpoint))
+		} else {
+			opts = append(opts, otlptracehttp.WithEndpoint(Config.TracingEndpoint))
+		}
+		if Config.TracingInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	} else if Config.TracingFile != "" {
+		file, err = os.OpenFile(Config.TracingFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		}
+	} else {
+		return noop, nil
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return noop, err
+	}
+	res := resource.NewSchemaless(attribute.String("service.name", Config.TracingServiceName))
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(Config.TracingSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	log.Printf("tracing endpoint=%s file=%s service=%s", Config.TracingEndpoint, Config.TracingFile, Config.TracingServiceName)
+	shutdown := func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			if e := file.Close(); err == nil {
+				err = e
+			}
+		}
+		return err
+	}
+	return shutdown, nil
+}
+
+// helper function to start server span of given HTTP request, the trace
+// context is extracted from request headers, the span records route
+// template rather than request path since the path contains record keys
+func startRequestSpan(r *http.Request, route string) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, r.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("net.peer.addr", r.RemoteAddr),
+		))
+	return r.WithContext(ctx), span
+}
+
+// helper function to finish span of HTTP request with given status code
+func endRequestSpan(span trace.Span, status int) {
+	span.SetAttributes(attribute.Int("http.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// helper function to record error in given span
+func spanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// helper function to return trace id of given context, it returns empty
+// string if context does not have valid span
+func traceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
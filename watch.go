@@ -0,0 +1,175 @@
+package main
+
+// watch module provides watch API which allows clients to follow changes
+// of keys via Server-Sent Events
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// WatchEvent represents change of a key delivered to watch clients
+type WatchEvent struct {
+	Key       string `json:"key"`                 // changed key
+	Value     string `json:"value,omitempty"`     // new value of the key
+	Operation string `json:"op"`                  // operation, i.e. set or delete
+	Version   uint64 `json:"version"`             // DB version of the change
+	ExpiresAt uint64 `json:"expiresAt,omitempty"` // expiration time of the key in seconds since epoch
+}
+
+// helper function to convert change event into watch event
+func watchEvent(ev ChangeEvent) WatchEvent {
+	wev := WatchEvent{
+		Key:       string(ev.Key),
+		Value:     string(ev.Value),
+		Operation: "set",
+		Version:   ev.Version,
+		ExpiresAt: ev.ExpiresAt,
+	}
+	if ev.Deleted {
+		wev.Operation = "delete"
+	}
+	return wev
+}
+
+// helper function to get version watch should start from, the clients
+// resume from Last-Event-ID header which is sent by EventSource on reconnect
+// or from explicit since parameter, otherwise only new changes are watched
+func watchSince(r *http.Request) (uint64, error) {
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		val, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unable to parse Last-Event-ID header: %w", err)
+		}
+		return val + 1, nil
+	}
+	if v := r.FormValue("since"); v != "" {
+		val, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unable to parse since parameter: %w", err)
+		}
+		return val, nil
+	}
+	return DB.MaxVersion() + 1, nil
+}
+
+// helper function to get key prefixes to watch, the prefixes can be limited
+// to given namespace
+func watchPrefixes(r *http.Request) ([]string, error) {
+	namespace := r.FormValue("namespace")
+	prefixes := r.Form["prefix"]
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	var out []string
+	for _, p := range prefixes {
+		prefix, err := keyPrefix(p, namespace)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, prefix)
+	}
+	return out, nil
+}
+
+// helper function to write single SSE event, empty id is omitted
+func writeSSE(w *bufio.Writer, id, event string, data []byte) {
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	if event != "" {
+		fmt.Fprintf(w, "event: %s\n", event)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+// WatchHandler streams changes of keys with given prefixes as Server-Sent
+// Events, every change is delivered as message event with key, value,
+// operation and version of the change while heartbeat events report stream
+// position. The event ids allow clients to resume the stream after
+// disconnect via Last-Event-ID header or since parameter, if the changes
+// since that version are no longer retained the reset event is sent
+// followed by all existing keys.
+func WatchHandler(w http.ResponseWriter, r *http.Request) {
+	if err := requireBadger("watch"); err != nil {
+		handleError(w, r, "unable to watch changes", err)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		handleError(w, r, "unable to parse watch parameters", badRequest(err))
+		return
+	}
+	since, err := watchSince(r)
+	if err != nil {
+		handleError(w, r, "unable to watch changes", badRequest(err))
+		return
+	}
+	prefixes, err := watchPrefixes(r)
+	if err != nil {
+		handleError(w, r, "unable to watch changes", badRequest(err))
+		return
+	}
+	// deletes made since pruned history are lost, therefore the client
+	// should drop its state and receive all existing keys again
+	reset := false
+	if err := checkHistory(since); errors.Is(err, errHistoryGone) {
+		slog.WarnContext(r.Context(), "reset watch stream", "error", err)
+		reset = true
+		since = 0
+	} else if err != nil {
+		handleError(w, r, "unable to watch changes", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	disableWriteTimeout(w, r)
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	bw := bufio.NewWriter(w)
+	ctx, cancel := streamContext(r.Context())
+	defer cancel()
+	if reset {
+		writeSSE(bw, "", "reset", []byte("{}"))
+	}
+
+	// the events of catch-up are ordered by keys rather than versions,
+	// therefore we assign ids only after it is completed, i.e. starting from
+	// the first heartbeat, and only to the last event of every version since
+	// changes of single transaction share the same version
+	var live bool
+	err = streamChanges(ctx, prefixes, since, func(events []ChangeEvent) error {
+		for i, ev := range events {
+			if ev.heartbeat() {
+				live = true
+				data, _ := json.Marshal(map[string]any{"version": ev.Version, "time": ev.Time})
+				writeSSE(bw, strconv.FormatUint(ev.Version, 10), "heartbeat", data)
+				continue
+			}
+			data, err := json.Marshal(watchEvent(ev))
+			if err != nil {
+				return err
+			}
+			var id string
+			if live && (i == len(events)-1 || events[i+1].Version != ev.Version) {
+				id = strconv.FormatUint(ev.Version, 10)
+			}
+			writeSSE(bw, id, "", data)
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+	if err != nil && ctx.Err() == nil {
+		// we already sent response header, therefore we can only log the error
+		slog.ErrorContext(r.Context(), "watch stream is terminated", "error", err)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+// webhooks module provides webhook notifications about store and delete
+// events, the notifications are kept in durable queue within our DB until
+// they are delivered
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// webhook event types
+const (
+	webhookCreate = "create"
+	webhookUpdate = "update"
+	webhookDelete = "delete"
+)
+
+// webhookQueuePrefix defines prefix of keys which hold pending notifications
+const webhookQueuePrefix = systemPrefix + "webhooks/"
+
+// webhookIdleInterval defines how often webhook queue is checked if there
+// are no pending notifications
+const webhookIdleInterval = time.Minute
+
+// webhookMaxBackoff defines max interval between delivery attempts
+const webhookMaxBackoff = 5 * time.Minute
+
+// WebhookConfig represents configuration of webhook
+type WebhookConfig struct {
+	Name        string   `json:"name"`         // name of webhook, it identifies its queue
+	URL         string   `json:"url"`          // URL to send notifications to
+	Events      []string `json:"events"`       // event types: create, update, delete, all by default
+	Namespace   string   `json:"namespace"`    // notify only about keys of given namespace
+	SecretFile  string   `json:"secret_file"`  // file with HMAC secret to sign notifications
+	SecretEnv   string   `json:"secret_env"`   // env variable with HMAC secret to sign notifications
+	Timeout     string   `json:"timeout"`      // timeout of single delivery, default 10s
+	MaxAttempts int      `json:"max_attempts"` // max number of delivery attempts, default 20
+}
+
+// WebhookEvent represents notification sent to webhooks
+type WebhookEvent struct {
+	ID        string `json:"id"`                  // unique id of the event
+	Type      string `json:"type"`                // event type: create, update or delete
+	Key       string `json:"key"`                 // record key
+	Value     string `json:"value"`               // record value, deleted value for delete events
+	Time      string `json:"time"`                // time of the event in RFC3339 format
+	RequestID string `json:"requestId,omitempty"` // id of request which caused the event
+}
+
+// webhookDelivery represents pending notification in webhook queue
+type webhookDelivery struct {
+	Event       WebhookEvent `json:"event"`       // notification to deliver
+	Attempts    int          `json:"attempts"`    // number of failed delivery attempts
+	NextAttempt int64        `json:"nextAttempt"` // time of next attempt in nanoseconds since epoch
+}
+
+// webhook represents configured webhook along with its delivery worker
+type webhook struct {
+	WebhookConfig
+	events map[string]bool
+	secret []byte
+	wake   chan struct{}
+	client *http.Client
+}
+
+// webhooks holds configured webhooks
+var webhooks []*webhook
+
+// webhookSeq provides ordered ids of webhook events
+var webhookSeq uint64
+
+// webhook metrics
+var (
+	webhookDelivered uint64 // total number of delivered notifications
+	webhookFailed    uint64 // total number of failed delivery attempts
+	webhookDropped   uint64 // total number of notifications dropped after max attempts
+)
+
+// WebhookMetrics represents metrics of webhook notifications
+type WebhookMetrics struct {
+	Pending   int    `json:"pending"`   // number of notifications waiting for delivery
+	Delivered uint64 `json:"delivered"` // total number of delivered notifications
+	Failed    uint64 `json:"failed"`    // total number of failed delivery attempts
+	Dropped   uint64 `json:"dropped"`   // total number of notifications dropped after max attempts
+}
+
+// helper function to read HMAC secret of webhook
+func webhookSecret(wc WebhookConfig) ([]byte, error) {
+	var secret string
+	if wc.SecretFile != "" {
+		data, err := os.ReadFile(wc.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		secret = strings.TrimSpace(string(data))
+	} else if wc.SecretEnv != "" {
+		secret = strings.TrimSpace(os.Getenv(wc.SecretEnv))
+	}
+	return []byte(secret), nil
+}
+
+// helper function to initialize configured webhooks
+func initWebhooks() error {
+	webhooks = nil
+	names := make(map[string]bool)
+	for _, wc := range Config.Webhooks {
+		if wc.URL == "" {
+			return errors.New("webhook URL is not provided")
+		}
+		if wc.Name == "" {
+			h := sha256.Sum256([]byte(wc.URL))
+			wc.Name = hex.EncodeToString(h[:8])
+		}
+		if !snapshotPattern.MatchString(wc.Name) {
+			return fmt.Errorf("invalid webhook name %s", wc.Name)
+		}
+		if names[wc.Name] {
+			return fmt.Errorf("duplicate webhook name %s", wc.Name)
+		}
+		names[wc.Name] = true
+		if len(wc.Events) == 0 {
+			wc.Events = []string{webhookCreate, webhookUpdate, webhookDelete}
+		}
+		hook := &webhook{WebhookConfig: wc, events: make(map[string]bool), wake: make(chan struct{}, 1)}
+		for _, event := range wc.Events {
+			switch event {
+			case webhookCreate, webhookUpdate, webhookDelete:
+				hook.events[event] = true
+			default:
+				return fmt.Errorf("webhook %s has unsupported event type %s", wc.Name, event)
+			}
+		}
+		if hook.Timeout == "" {
+			hook.Timeout = "10s"
+		}
+		timeout, err := time.ParseDuration(hook.Timeout)
+		if err != nil {
+			return fmt.Errorf("unable to parse timeout of webhook %s: %w", wc.Name, err)
+		}
+		hook.client = &http.Client{Timeout: timeout}
+		if hook.MaxAttempts == 0 {
+			hook.MaxAttempts = 20
+		}
+		hook.secret, err = webhookSecret(wc)
+		if err != nil {
+			return fmt.Errorf("unable to read secret of webhook %s: %w", wc.Name, err)
+		}
+		webhooks = append(webhooks, hook)
+	}
+	webhookSeq = uint64(time.Now().UnixNano())
+	return nil
+}
+
+// helper function to check if webhooks are configured
+func webhooksEnabled() bool {
+	return len(webhooks) > 0
+}
+
+// helper function to check if webhook should be notified about given event
+func (h *webhook) match(typ, key string) bool {
+	if !h.events[typ] {
+		return false
+	}
+	if h.Namespace != "" && !strings.HasPrefix(key, h.Namespace+namespaceSeparator) {
+		return false
+	}
+	return true
+}
+
+// helper function to return queue prefix of webhook
+func (h *webhook) queuePrefix() string {
+	return webhookQueuePrefix + h.Name + "/"
+}
+
+// helper function to check if this node should queue webhook notifications,
+// in clustered mode the changes are applied by all nodes while the
+// notifications are queued only by the leader which committed the change
+func webhooksActive() bool {
+	if !webhooksEnabled() {
+		return false
+	}
+	return !isClustered() || clusterRaft.State() == raft.Leader
+}
+
+// helper function to queue notifications about given event within given
+// transaction, i.e. the event is persisted along with the change which
+// caused it, and it is delivered asynchronously once the transaction is
+// committed. It returns true if any notification is queued.
+func queueWebhooks(ctx context.Context, txn KVTxn, typ, key, value string) (bool, error) {
+	if !webhooksActive() {
+		return false, nil
+	}
+	seq := atomic.AddUint64(&webhookSeq, 1)
+	event := WebhookEvent{
+		ID:        fmt.Sprintf("%020d", seq),
+		Type:      typ,
+		Key:       key,
+		Value:     value,
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		RequestID: requestID(ctx),
+	}
+	data, err := json.Marshal(webhookDelivery{Event: event})
+	if err != nil {
+		return false, fmt.Errorf("unable to marshal webhook event: %w", err)
+	}
+	var queued bool
+	for _, h := range webhooks {
+		if !h.match(typ, key) {
+			continue
+		}
+		if err := txn.Set([]byte(h.queuePrefix()+event.ID), data, 0); err != nil {
+			return false, fmt.Errorf("unable to queue webhook event: %w", err)
+		}
+		queued = true
+	}
+	return queued, nil
+}
+
+// helper function to wake up delivery workers of webhooks after new
+// notifications are queued
+func wakeWebhooks() {
+	for _, h := range webhooks {
+		select {
+		case h.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// helper function to send notification to webhook, the body is signed with
+// HMAC-SHA256 of webhook secret
+func (h *webhook) send(ctx context.Context, event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Cmskv-Event", event.Type)
+	req.Header.Set("X-Cmskv-Delivery", event.ID)
+	if len(h.secret) > 0 {
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(body)
+		req.Header.Set("X-Cmskv-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	if event.RequestID != "" {
+		req.Header.Set("X-Request-ID", event.RequestID)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// helper function to get first pending notification of webhook
+func (h *webhook) head() ([]byte, *webhookDelivery, error) {
+	var key []byte
+	var delivery *webhookDelivery
+	err := KV.Iterate([]byte(h.queuePrefix()), nil, func(k, v []byte) error {
+		var d webhookDelivery
+		if err := json.Unmarshal(v, &d); err != nil {
+			return fmt.Errorf("unable to parse webhook queue record %s: %w", k, err)
+		}
+		key, delivery = k, &d
+		return errStopIteration
+	})
+	return key, delivery, err
+}
+
+// helper function to deliver pending notifications of webhook in order of
+// their events, it returns time to wait before next delivery attempt
+func (h *webhook) deliver(ctx context.Context) time.Duration {
+	for ctx.Err() == nil {
+		key, d, err := h.head()
+		if err != nil {
+			slog.Error("unable to read webhook queue", "webhook", h.Name, "error", err)
+			if key != nil {
+				// drop malformed record to not block the queue
+				KV.Delete(key)
+			}
+			return time.Second
+		}
+		if d == nil {
+			return webhookIdleInterval
+		}
+		if wait := time.Until(time.Unix(0, d.NextAttempt)); wait > 0 {
+			return wait
+		}
+		err = h.send(ctx, d.Event)
+		if ctx.Err() != nil {
+			// keep notification in queue to deliver it after restart
+			return 0
+		}
+		if err == nil {
+			atomic.AddUint64(&webhookDelivered, 1)
+			if err := KV.Delete(key); err != nil {
+				slog.Error("unable to remove delivered webhook event", "webhook", h.Name, "id", d.Event.ID, "error", err)
+				return time.Second
+			}
+			continue
+		}
+		atomic.AddUint64(&webhookFailed, 1)
+		d.Attempts++
+		if d.Attempts >= h.MaxAttempts {
+			atomic.AddUint64(&webhookDropped, 1)
+			slog.Error("drop webhook event after max attempts", "webhook", h.Name, "id", d.Event.ID, "attempts", d.Attempts, "error", err)
+			if err := KV.Delete(key); err != nil {
+				slog.Error("unable to remove webhook event", "webhook", h.Name, "id", d.Event.ID, "error", err)
+				return time.Second
+			}
+			continue
+		}
+		backoff := time.Second << min(d.Attempts-1, 16)
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+		d.NextAttempt = time.Now().Add(backoff).UnixNano()
+		slog.Warn("webhook delivery failed", "webhook", h.Name, "id", d.Event.ID, "attempts", d.Attempts, "retry", backoff, "error", err)
+		data, err := json.Marshal(d)
+		if err == nil {
+			err = KV.Set(key, data, 0)
+		}
+		if err != nil {
+			slog.Error("unable to update webhook event", "webhook", h.Name, "id", d.Event.ID, "error", err)
+		}
+		return backoff
+	}
+	return 0
+}
+
+// helper function to run delivery worker of webhook until given context is
+// cancelled
+func (h *webhook) run(ctx context.Context) {
+	log.Printf("webhook %s url=%s events=%v namespace=%s", h.Name, h.URL, h.Events, h.Namespace)
+	for {
+		wait := h.deliver(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// helper function to start delivery workers of configured webhooks
+func startWebhooks(ctx context.Context) {
+	for _, h := range webhooks {
+		h := h
+		startTask(func() { h.run(ctx) })
+	}
+}
+
+// helper function to collect webhook metrics
+func webhookMetrics() *WebhookMetrics {
+	if !webhooksEnabled() {
+		return nil
+	}
+	var pending int
+	KV.Iterate([]byte(webhookQueuePrefix), nil, func(key, value []byte) error {
+		pending++
+		return nil
+	})
+	return &WebhookMetrics{
+		Pending:   pending,
+		Delivered: atomic.LoadUint64(&webhookDelivered),
+		Failed:    atomic.LoadUint64(&webhookFailed),
+		Dropped:   atomic.LoadUint64(&webhookDropped),
+	}
+}
+
+// helper function to generate webhook metrics in prometheus format
+func promWebhookMetrics(prefix string, data *WebhookMetrics) string {
+	var out string
+	out += fmt.Sprintf("# HELP %s_webhook_pending reports number of notifications waiting for delivery\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_webhook_pending gauge\n", prefix)
+	out += fmt.Sprintf("%s_webhook_pending %v\n", prefix, data.Pending)
+	out += fmt.Sprintf("# HELP %s_webhook_delivered reports total number of delivered notifications\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_webhook_delivered counter\n", prefix)
+	out += fmt.Sprintf("%s_webhook_delivered %v\n", prefix, data.Delivered)
+	out += fmt.Sprintf("# HELP %s_webhook_failed reports total number of failed delivery attempts\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_webhook_failed counter\n", prefix)
+	out += fmt.Sprintf("%s_webhook_failed %v\n", prefix, data.Failed)
+	out += fmt.Sprintf("# HELP %s_webhook_dropped reports total number of notifications dropped after max attempts\n", prefix)
+	out += fmt.Sprintf("# TYPE %s_webhook_dropped counter\n", prefix)
+	out += fmt.Sprintf("%s_webhook_dropped %v\n", prefix, data.Dropped)
+	return out
+}
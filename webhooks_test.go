@@ -0,0 +1,287 @@
+package main
+
+// webhooks_test module provides tests of webhook notifications
+//
+// Copyright (c) 2021 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testReceiver represents webhook receiver which fails given number of
+// requests before it accepts notifications
+type testReceiver struct {
+	sync.Mutex
+	secret   []byte
+	failures int
+	events   []WebhookEvent
+	errors   []string
+}
+
+// ServeHTTP implements http.Handler interface
+func (rc *testReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.Lock()
+	defer rc.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	mac := hmac.New(sha256.New, rc.secret)
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if r.Header.Get("X-Cmskv-Signature") != signature {
+		rc.errors = append(rc.errors, "invalid signature "+r.Header.Get("X-Cmskv-Signature"))
+	}
+	if rc.failures > 0 {
+		rc.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		rc.errors = append(rc.errors, err.Error())
+	}
+	if r.Header.Get("X-Cmskv-Event") != event.Type || r.Header.Get("X-Cmskv-Delivery") != event.ID {
+		rc.errors = append(rc.errors, "event headers do not match event "+event.ID)
+	}
+	rc.events = append(rc.events, event)
+}
+
+// helper function to return received events and check receiver errors
+func (rc *testReceiver) received(t *testing.T) []WebhookEvent {
+	t.Helper()
+	rc.Lock()
+	defer rc.Unlock()
+	for _, msg := range rc.errors {
+		t.Error(msg)
+	}
+	return append([]WebhookEvent(nil), rc.events...)
+}
+
+// helper function to set up webhook with given receiver and DB in given
+// directory, the previous configuration is restored at the end of the test
+func setupWebhook(t *testing.T, dir string, rc *testReceiver) *webhook {
+	t.Helper()
+	config, kv := Config, KV
+	t.Cleanup(func() {
+		if KV != nil {
+			KV.Close()
+		}
+		Config, KV, webhooks = config, kv, nil
+	})
+	store, err := openBoltStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	KV = store
+	srv := httptest.NewServer(rc)
+	t.Cleanup(srv.Close)
+	fname := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(fname, append(rc.secret, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+	Config.Webhooks = []WebhookConfig{{Name: "test", URL: srv.URL, SecretFile: fname, MaxAttempts: 3}}
+	if err := initWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+	return webhooks[0]
+}
+
+// helper function to return pending notifications of webhook
+func pendingDeliveries(t *testing.T, h *webhook) []webhookDelivery {
+	t.Helper()
+	var out []webhookDelivery
+	err := KV.Iterate([]byte(h.queuePrefix()), nil, func(key, value []byte) error {
+		var d webhookDelivery
+		if err := json.Unmarshal(value, &d); err != nil {
+			return err
+		}
+		out = append(out, d)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// TestWebhookDelivery checks signing of notifications and their events
+func TestWebhookDelivery(t *testing.T) {
+	rc := &testReceiver{secret: []byte("secret")}
+	h := setupWebhook(t, t.TempDir(), rc)
+	ctx := context.Background()
+	if err := commitRecord(ctx, "k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitRecord(ctx, "k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitRecord(ctx, "k1", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := removeRecord(ctx, "k1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(pendingDeliveries(t, h)); n != 3 {
+		t.Fatalf("expect 3 queued notifications, got %d", n)
+	}
+	if wait := h.deliver(ctx); wait != webhookIdleInterval {
+		t.Fatalf("expect idle interval after delivery, got %v", wait)
+	}
+	var types []string
+	for _, event := range rc.received(t) {
+		types = append(types, event.Type+":"+event.Key+"="+event.Value)
+	}
+	expect := []string{"create:k1=v1", "update:k1=v2", "delete:k1=v2"}
+	if len(types) != len(expect) {
+		t.Fatalf("expect events %v, got %v", expect, types)
+	}
+	for i := range expect {
+		if types[i] != expect[i] {
+			t.Fatalf("expect events %v, got %v", expect, types)
+		}
+	}
+	if n := len(pendingDeliveries(t, h)); n != 0 {
+		t.Fatalf("expect empty queue after delivery, got %d notifications", n)
+	}
+}
+
+// TestWebhookRetry checks backoff of failed deliveries and drop of the
+// notifications after max attempts
+func TestWebhookRetry(t *testing.T) {
+	rc := &testReceiver{secret: []byte("secret"), failures: 1}
+	h := setupWebhook(t, t.TempDir(), rc)
+	ctx := context.Background()
+	if err := commitRecord(ctx, "k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// first attempt fails and the notification is retried after backoff
+	if wait := h.deliver(ctx); wait != time.Second {
+		t.Fatalf("expect 1s backoff after first failure, got %v", wait)
+	}
+	pending := pendingDeliveries(t, h)
+	if len(pending) != 1 || pending[0].Attempts != 1 {
+		t.Fatalf("expect one notification with one attempt, got %+v", pending)
+	}
+	if wait := h.deliver(ctx); wait <= 0 || wait > time.Second {
+		t.Fatalf("expect delivery to wait for backoff, got %v", wait)
+	}
+	time.Sleep(time.Until(time.Unix(0, pending[0].NextAttempt)))
+	h.deliver(ctx)
+	if events := rc.received(t); len(events) != 1 || events[0].Key != "k1" {
+		t.Fatalf("expect delivery of k1 after retry, got %+v", events)
+	}
+
+	// notification is dropped after max attempts
+	rc.Lock()
+	rc.failures = h.MaxAttempts
+	rc.Unlock()
+	if err := commitRecord(ctx, "k2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < h.MaxAttempts; i++ {
+		pending := pendingDeliveries(t, h)
+		if len(pending) != 1 {
+			t.Fatalf("attempt %d: expect one pending notification, got %d", i, len(pending))
+		}
+		// skip backoff interval of the notification
+		pending[0].NextAttempt = 0
+		data, _ := json.Marshal(pending[0])
+		if err := KV.Set([]byte(h.queuePrefix()+pending[0].Event.ID), data, 0); err != nil {
+			t.Fatal(err)
+		}
+		h.deliver(ctx)
+	}
+	if n := len(pendingDeliveries(t, h)); n != 0 {
+		t.Fatalf("expect notification to be dropped after max attempts, got %d pending", n)
+	}
+	if events := rc.received(t); len(events) != 1 {
+		t.Fatalf("expect no delivery of dropped notification, got %+v", events)
+	}
+}
+
+// TestWebhookRestart checks that queued notifications are delivered after
+// server restart and that notifications of failed transactions are not
+// queued
+func TestWebhookRestart(t *testing.T) {
+	dir := t.TempDir()
+	rc := &testReceiver{secret: []byte("secret")}
+	setupWebhook(t, dir, rc)
+	ctx := context.Background()
+	if err := commitRecord(ctx, "k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("failure")
+	err := KV.Txn(true, func(txn KVTxn) error {
+		if _, err := queueWebhooks(ctx, txn, webhookCreate, "k2", "v2"); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("expect failed transaction, got %v", err)
+	}
+
+	// restart server with the same DB
+	if err := KV.Close(); err != nil {
+		t.Fatal(err)
+	}
+	KV = nil
+	h := setupWebhook(t, dir, rc)
+	if len(rc.received(t)) != 0 {
+		t.Fatal("expect no delivery before restart")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		h.run(ctx)
+		close(done)
+	}()
+	var events []WebhookEvent
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if events = rc.received(t); len(events) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if len(events) != 1 || events[0].Key != "k1" || events[0].Type != webhookCreate {
+		t.Fatalf("expect create event of k1 after restart, got %+v", events)
+	}
+}
+
+// TestWebhookSet checks notifications of keys set without reverse look-up
+// records, e.g. via RESP SET and MSET commands
+func TestWebhookSet(t *testing.T) {
+	rc := &testReceiver{secret: []byte("secret")}
+	h := setupWebhook(t, t.TempDir(), rc)
+	ctx := context.Background()
+	if err := setRecords(ctx, []Record{{Key: "k1", Value: "v1"}, {Key: "k2", Value: "v2"}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := setRecords(ctx, []Record{{Key: "k1", Value: "v1"}, {Key: "k2", Value: "v3"}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	h.deliver(ctx)
+	var types []string
+	for _, event := range rc.received(t) {
+		types = append(types, event.Type+":"+event.Key+"="+event.Value)
+	}
+	expect := "create:k1=v1 create:k2=v2 update:k2=v3"
+	if got := strings.Join(types, " "); got != expect {
+		t.Fatalf("expect events %s, got %s", expect, got)
+	}
+}